@@ -1,6 +1,9 @@
 package main
 
 import (
+	"os"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/cli"
 	"github.com/vailcody/IKEv2TunnelManager/internal/ui"
 )
 
@@ -8,6 +11,11 @@ import (
 var Version = "dev"
 
 func main() {
+	// Subcommands run headless; the GUI stays the default
+	if cli.Handles(os.Args[1:]) {
+		os.Exit(cli.Run(os.Args[1:], Version))
+	}
+
 	app := ui.NewApp()
 	app.SetVersion(Version)
 	app.Run()
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+// maxBodySize bounds request bodies, which only ever hold a user
+const maxBodySize = 64 << 10
+
+func (s *Server) routes() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/v1/status", s.handleStatus)
+	api.HandleFunc("POST /api/v1/restart", s.handleRestart)
+	api.HandleFunc("GET /api/v1/users", s.handleListUsers)
+	api.HandleFunc("POST /api/v1/users", s.handleAddUser)
+	api.HandleFunc("GET /api/v1/users/{username}", s.handleGetUser)
+	api.HandleFunc("PUT /api/v1/users/{username}", s.handleUpdateUser)
+	api.HandleFunc("DELETE /api/v1/users/{username}", s.handleRemoveUser)
+	api.HandleFunc("GET /api/v1/users/{username}/mobileconfig", s.handleMobileConfig)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.Handle("/api/", s.authenticate(api))
+	return mux
+}
+
+// entry returns the server that hosts VPN users
+func (s *Server) entry() *remote {
+	return s.servers[0]
+}
+
+type serverStatus struct {
+	Name   string      `json:"name"`
+	Host   string      `json:"host"`
+	Status *vpn.Status `json:"status,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	results := make([]serverStatus, 0, len(s.servers))
+	for _, srv := range s.servers {
+		result := serverStatus{Name: srv.name, Host: srv.config.Host}
+		err := srv.with(func(c ssh.Executor) error {
+			status, err := vpn.GetStatusContext(r.Context(), c)
+			result.Status = status
+			return err
+		})
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// handleRestart restarts StrongSwan on all servers, or on ?server=N only
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+	targets := s.servers
+	if n := r.URL.Query().Get("server"); n != "" {
+		i, err := strconv.Atoi(n)
+		if err != nil || i < 1 || i > len(s.servers) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid server %q", n))
+			return
+		}
+		targets = s.servers[i-1 : i]
+	}
+
+	restarted := []string{}
+	for _, srv := range targets {
+		if err := srv.with(func(c ssh.Executor) error { return vpn.RestartVPN(c) }); err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Errorf("failed to restart %s: %w", srv.name, err))
+			return
+		}
+		s.logger.Logf("[API] Restarted StrongSwan on %s", srv.name)
+		restarted = append(restarted, srv.name)
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"restarted": restarted})
+}
+
+func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	var users []vpn.User
+	err := s.entry().with(func(c ssh.Executor) error {
+		var err error
+		users, err = vpn.NewUserManager(c, s.logger).ListUsers()
+		return err
+	})
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	if users == nil {
+		users = []vpn.User{}
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (s *Server) handleAddUser(w http.ResponseWriter, r *http.Request) {
+	var req vpn.User
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	var password string
+	err := s.entry().with(func(c ssh.Executor) error {
+		var err error
+		password, err = vpn.NewUserManager(c, s.logger).AddUser(req.Username, req.Password)
+		return err
+	})
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, vpn.User{Username: req.Username, Password: password})
+}
+
+func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	var password string
+	err := s.entry().with(func(c ssh.Executor) error {
+		var err error
+		password, err = vpn.NewUserManager(c, s.logger).GetUserPassword(username)
+		return err
+	})
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, vpn.User{Username: username, Password: password})
+}
+
+func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	var req vpn.User
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	var password string
+	err := s.entry().with(func(c ssh.Executor) error {
+		var err error
+		password, err = vpn.NewUserManager(c, s.logger).UpdatePassword(username, req.Password)
+		return err
+	})
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, vpn.User{Username: username, Password: password})
+}
+
+func (s *Server) handleRemoveUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	err := s.entry().with(func(c ssh.Executor) error {
+		um := vpn.NewUserManager(c, s.logger)
+		if _, err := um.GetUserPassword(username); err != nil {
+			return err
+		}
+		return um.RemoveUser(username)
+	})
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleMobileConfig(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	entry := s.entry()
+
+	var profile []byte
+	err := entry.with(func(c ssh.Executor) error {
+		password, err := vpn.NewUserManager(c, s.logger).GetUserPassword(username)
+		if err != nil {
+			return err
+		}
+		caCert, err := c.ReadFile(vpn.CACertPath)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		profile = vpn.GenerateMobileConfig(username, password, entry.config.Host, string(caCert), s.proposals)
+		return nil
+	})
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.mobileconfig"`, username))
+	w.Write(profile)
+}
+
+// decodeBody reads the JSON request body into v, answering with an error if
+// it is invalid or larger than maxBodySize
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", maxBodySize))
+	} else {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+	}
+	return false
+}
+
+// writeUserError maps UserManager errors to HTTP status codes
+func writeUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, vpn.ErrInvalidUser):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, vpn.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, vpn.ErrUserExists):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusBadGateway, err)
+	}
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+const (
+	usersPath = "/etc/swanctl/users.conf"
+	usersConf = `eap-1 {
+    id = "alice"
+    secret = "alice-pass"
+}
+eap-2 {
+    id = "bob"
+    secret = "bob-pass"
+}
+`
+)
+
+// usersServer returns a Server whose entry point has alice and bob as VPN users
+func usersServer(t *testing.T) (*Server, *sshtest.Fake) {
+	t.Helper()
+	entry := sshtest.NewFake().On("cat "+usersPath, usersConf)
+	return newTestServer(t, entry, sshtest.NewFake()), entry
+}
+
+var usersWritePattern = regexp.MustCompile(`^echo '([A-Za-z0-9+/=]*)' \| base64 -d \| tee ` + regexp.QuoteMeta(usersPath) + ` `)
+
+// writtenUsers returns the last content written to the users file, empty if
+// it was not written
+func writtenUsers(t *testing.T, f *sshtest.Fake) string {
+	t.Helper()
+	var content []byte
+	for _, cmd := range f.Commands() {
+		if m := usersWritePattern.FindStringSubmatch(cmd); m != nil {
+			var err error
+			if content, err = base64.StdEncoding.DecodeString(m[1]); err != nil {
+				t.Fatalf("invalid base64 in %q: %v", cmd, err)
+			}
+		}
+	}
+	return string(content)
+}
+
+// decodeUser decodes a user response body
+func decodeUser(t *testing.T, body []byte) vpn.User {
+	t.Helper()
+	var u vpn.User
+	if err := json.Unmarshal(body, &u); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	return u
+}
+
+func TestListUsers(t *testing.T) {
+	s, _ := usersServer(t)
+
+	rec := serve(s, http.MethodGet, "/api/v1/users", testToken, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var users []vpn.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body, err)
+	}
+	if want := []vpn.User{{Username: "alice"}, {Username: "bob"}}; !reflect.DeepEqual(users, want) {
+		t.Errorf("users = %+v, want %+v without passwords", users, want)
+	}
+}
+
+func TestAddUser(t *testing.T) {
+	s, entry := usersServer(t)
+
+	rec := serve(s, http.MethodPost, "/api/v1/users", testToken, `{"username":"carol","password":"carol-pass"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if u := decodeUser(t, rec.Body.Bytes()); u != (vpn.User{Username: "carol", Password: "carol-pass"}) {
+		t.Errorf("response = %+v", u)
+	}
+	if written := writtenUsers(t, entry); !strings.Contains(written, `"carol"`) || !strings.Contains(written, `"alice"`) {
+		t.Errorf("users file after adding carol:\n%s", written)
+	}
+}
+
+func TestGetUpdateRemoveUser(t *testing.T) {
+	s, entry := usersServer(t)
+
+	rec := serve(s, http.MethodGet, "/api/v1/users/alice", testToken, "")
+	if rec.Code != http.StatusOK || decodeUser(t, rec.Body.Bytes()).Password != "alice-pass" {
+		t.Errorf("GET alice = %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(s, http.MethodPut, "/api/v1/users/bob", testToken, `{"password":"new-pass"}`)
+	if rec.Code != http.StatusOK || decodeUser(t, rec.Body.Bytes()).Password != "new-pass" {
+		t.Errorf("PUT bob = %d: %s", rec.Code, rec.Body)
+	}
+	if written := writtenUsers(t, entry); !strings.Contains(written, `"new-pass"`) {
+		t.Errorf("users file after updating bob:\n%s", written)
+	}
+
+	rec = serve(s, http.MethodDelete, "/api/v1/users/alice", testToken, "")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE alice = %d: %s", rec.Code, rec.Body)
+	}
+	if written := writtenUsers(t, entry); strings.Contains(written, `"alice"`) {
+		t.Errorf("users file after removing alice:\n%s", written)
+	}
+}
+
+func TestUserErrors(t *testing.T) {
+	tests := []struct {
+		name, method, target, body string
+		want                       int
+	}{
+		{"invalid username", http.MethodPost, "/api/v1/users", `{"username":"bad name"}`, http.StatusBadRequest},
+		{"invalid JSON", http.MethodPost, "/api/v1/users", `{"username":`, http.StatusBadRequest},
+		{"oversized body", http.MethodPost, "/api/v1/users", `{"username":"carol","password":"` + strings.Repeat("x", maxBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"oversized update", http.MethodPut, "/api/v1/users/bob", `{"password":"` + strings.Repeat("x", maxBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"existing user", http.MethodPost, "/api/v1/users", `{"username":"alice"}`, http.StatusConflict},
+		{"unknown user", http.MethodGet, "/api/v1/users/carol", "", http.StatusNotFound},
+		{"update unknown user", http.MethodPut, "/api/v1/users/carol", `{}`, http.StatusNotFound},
+		{"remove unknown user", http.MethodDelete, "/api/v1/users/carol", "", http.StatusNotFound},
+		{"profile of unknown user", http.MethodGet, "/api/v1/users/carol/mobileconfig", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		s, entry := usersServer(t)
+		if rec := serve(s, tt.method, tt.target, testToken, tt.body); rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+		if written := writtenUsers(t, entry); written != "" {
+			t.Errorf("%s: users file rewritten:\n%s", tt.name, written)
+		}
+	}
+
+	// Failures on the server are reported as a bad gateway
+	entry := sshtest.NewFake().Fail("cat "+usersPath, fmt.Errorf("permission denied"))
+	s := newTestServer(t, entry)
+	if rec := serve(s, http.MethodGet, "/api/v1/users", testToken, ""); rec.Code != http.StatusBadGateway {
+		t.Errorf("failed read: status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestMobileConfig(t *testing.T) {
+	s, entry := usersServer(t)
+	entry.SetFile(vpn.CACertPath, "-----BEGIN CERTIFICATE-----\nTUlJQ0FD\n-----END CERTIFICATE-----\n")
+
+	rec := serve(s, http.MethodGet, "/api/v1/users/alice/mobileconfig", testToken, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-apple-aspen-config" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="alice.mobileconfig"` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"<string>alice</string>", "<string>alice-pass</string>", "<string>192.0.2.1</string>", "TUlJQ0FD"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("profile missing %q:\n%s", want, body)
+		}
+	}
+}
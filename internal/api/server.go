@@ -0,0 +1,233 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+const keepAliveInterval = 30 * time.Second
+
+// Server is a local HTTP/JSON API for tunnel management.
+// It keeps one persistent SSH connection per server and reconnects when it drops.
+type Server struct {
+	token     string
+	logger    vpn.Logger
+	servers   []*remote
+	proposals vpn.ProposalProfile // Profile the servers were set up with, used for client profiles
+	http      *http.Server
+}
+
+// remote is a persistent, serialized SSH connection to one server
+type remote struct {
+	name   string
+	config *ssh.ServerConfig
+
+	mu     sync.Mutex
+	client ssh.Executor
+
+	// connect opens the executor for the server; tests replace it with fakes
+	connect func(config *ssh.ServerConfig) (ssh.Executor, error)
+}
+
+// NewServer creates an API server for the given servers; the first one is the entry point.
+// proposals is the profile the servers were set up with.
+func NewServer(addr, token string, names []string, configs []*ssh.ServerConfig, proposals vpn.ProposalProfile, logger vpn.Logger) (*Server, error) {
+	if err := checkLoopback(addr); err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, fmt.Errorf("API token must not be empty")
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no servers configured")
+	}
+
+	s := &Server{token: token, logger: logger, proposals: proposals}
+	for i, cfg := range configs {
+		s.servers = append(s.servers, &remote{name: names[i], config: cfg, connect: ssh.Dial})
+	}
+
+	s.http = &http.Server{
+		Addr:              addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+// Run serves the API until ctx is cancelled
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.http.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.http.Addr, err)
+	}
+	s.logger.Logf("API listening on http://%s", ln.Addr())
+
+	go s.keepAlive(ctx)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.http.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		s.closeAll()
+		return err
+	case <-ctx.Done():
+	}
+
+	s.logger.Log("Shutting down API...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = s.http.Shutdown(shutdownCtx)
+	s.closeAll()
+	return err
+}
+
+// keepAlive pings idle connections so dropped ones are noticed and re-established on next use
+func (s *Server) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, r := range s.servers {
+				r.mu.Lock()
+				if r.client != nil && !alive(r.client) {
+					s.logger.Logf("[%s] SSH connection lost, will reconnect on next request", r.name)
+					r.close()
+				}
+				r.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (s *Server) closeAll() {
+	for _, r := range s.servers {
+		r.mu.Lock()
+		r.close()
+		r.mu.Unlock()
+	}
+}
+
+// with runs fn with a live connection to the server, holding its lock
+func (r *remote) with(fn func(ssh.Executor) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client != nil && !alive(r.client) {
+		r.close()
+	}
+	if r.client == nil {
+		client, err := r.connect(r.config)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", r.name, err)
+		}
+		r.client = client
+	}
+
+	return fn(r.client)
+}
+
+// close drops the connection; the caller holds the lock
+func (r *remote) close() {
+	if c, ok := r.client.(io.Closer); ok {
+		c.Close()
+	}
+	r.client = nil
+}
+
+// alive reports whether a connection still answers keepalives; executors
+// without a connection of their own are always alive
+func alive(exec ssh.Executor) bool {
+	c, ok := exec.(interface{ KeepAlive() error })
+	return !ok || c.KeepAlive() == nil
+}
+
+// authenticate checks the bearer token on every request
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tunnelmanager"`)
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing API token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// checkLoopback refuses to expose the API beyond localhost
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("listen address %q is not a loopback address; the API only serves localhost", addr)
+	}
+	return nil
+}
+
+// LoadOrCreateToken reads the API token from path, generating a new one if the file does not exist
+func LoadOrCreateToken(path string) (token string, created bool, err error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token = strings.TrimSpace(string(data))
+		if token == "" {
+			return "", false, fmt.Errorf("token file %s is empty", path)
+		}
+		return token, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", false, fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", false, fmt.Errorf("failed to generate token: %w", err)
+	}
+	token = hex.EncodeToString(buf)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", false, fmt.Errorf("failed to create token directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", false, fmt.Errorf("failed to write token file: %w", err)
+	}
+	return token, true, nil
+}
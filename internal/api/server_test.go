@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+const testToken = "secret"
+
+type nopLogger struct{}
+
+func (nopLogger) Log(string)                    {}
+func (nopLogger) Logf(string, ...interface{})   {}
+func (nopLogger) Error(string)                  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// newTestServer creates a Server whose servers are answered by fakes; a nil
+// fake fails to connect
+func newTestServer(t *testing.T, fakes ...*sshtest.Fake) *Server {
+	t.Helper()
+	var names []string
+	var configs []*ssh.ServerConfig
+	for i := range fakes {
+		names = append(names, fmt.Sprintf("Server %d", i+1))
+		configs = append(configs, &ssh.ServerConfig{Host: fmt.Sprintf("192.0.2.%d", i+1), Port: 22})
+	}
+	s, err := NewServer("127.0.0.1:0", testToken, names, configs, vpn.DefaultProposalProfile, nopLogger{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	for i, r := range s.servers {
+		fake := fakes[i]
+		r.connect = func(*ssh.ServerConfig) (ssh.Executor, error) {
+			if fake == nil {
+				return nil, fmt.Errorf("connection refused")
+			}
+			return fake, nil
+		}
+	}
+	return s
+}
+
+// serve sends a request with the given bearer token and body to s; an empty
+// token sends none
+func serve(s *Server, method, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthentication(t *testing.T) {
+	fake := sshtest.NewFake()
+	s := newTestServer(t, fake)
+
+	for _, token := range []string{"", "wrong"} {
+		rec := serve(s, http.MethodGet, "/api/v1/status", token, "")
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status = %d, want %d", token, rec.Code, http.StatusUnauthorized)
+		}
+		if rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q: no WWW-Authenticate header", token)
+		}
+	}
+	if len(fake.Commands()) != 0 {
+		t.Errorf("unauthenticated requests reached the server: %v", fake.Commands())
+	}
+
+	if rec := serve(s, http.MethodGet, "/api/v1/health", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("health status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestNewServerListenAddress(t *testing.T) {
+	configs := []*ssh.ServerConfig{{Host: "192.0.2.1"}}
+	for _, addr := range []string{"127.0.0.1:8787", "[::1]:8787", "localhost:8787"} {
+		if _, err := NewServer(addr, testToken, []string{"Server 1"}, configs, vpn.DefaultProposalProfile, nopLogger{}); err != nil {
+			t.Errorf("NewServer(%q): %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:8787", ":8787", "[::]:8787", "192.0.2.10:8787", "example.com:8787", "127.0.0.1"} {
+		if _, err := NewServer(addr, testToken, []string{"Server 1"}, configs, vpn.DefaultProposalProfile, nopLogger{}); err == nil {
+			t.Errorf("NewServer(%q) accepted a non-loopback address", addr)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	entry := sshtest.NewFake().
+		On("systemctl is-active", "running\n").
+		On("swanctl --list-sas", "ikev2-vpn: #7, ESTABLISHED, IKEv2, 1b5d8e0c3f9a2b44_i 9c0e7d6a5b4f3e21_r*\n  remote 'alice' @ 198.51.100.7[4500]\n").
+		On("curl -4", "192.0.2.1\n")
+	s := newTestServer(t, entry, nil)
+
+	rec := serve(s, http.MethodGet, "/api/v1/status", testToken, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var results []serverStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body, err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d servers, want 2", len(results))
+	}
+
+	got := results[0]
+	if got.Error != "" || got.Status == nil {
+		t.Fatalf("Server 1 = %+v", got)
+	}
+	if !got.Status.Connected || got.Status.ActiveClients != 1 || got.Status.ServerIP != "192.0.2.1" {
+		t.Errorf("Server 1 status = %+v", got.Status)
+	}
+	if results[1].Status != nil || results[1].Error == "" {
+		t.Errorf("unreachable Server 2 = %+v, want an error", results[1])
+	}
+}
+
+func TestRestart(t *testing.T) {
+	server1, server2 := sshtest.NewFake(), sshtest.NewFake()
+	s := newTestServer(t, server1, server2)
+
+	rec := serve(s, http.MethodPost, "/api/v1/restart?server=2", testToken, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if server1.Ran("systemctl restart") || !server2.Ran("systemctl restart") {
+		t.Errorf("restart reached the wrong servers: %v / %v", server1.Commands(), server2.Commands())
+	}
+
+	for _, n := range []string{"0", "3", "x"} {
+		if rec := serve(s, http.MethodPost, "/api/v1/restart?server="+n, testToken, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("server=%s: status = %d, want %d", n, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	server1.Fail("systemctl restart", fmt.Errorf("unit not found"))
+	if rec := serve(s, http.MethodPost, "/api/v1/restart", testToken, ""); rec.Code != http.StatusBadGateway {
+		t.Errorf("failed restart: status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,287 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/logging"
+	"github.com/vailcody/IKEv2TunnelManager/internal/saved"
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/storage"
+)
+
+const (
+	// PassphraseEnv holds the passphrase for encrypted private keys in headless mode
+	PassphraseEnv = "TUNNELMANAGER_KEY_PASSPHRASE"
+	// NewPassphraseEnv holds the passphrase for keys generated by keygen and rotate-key
+	NewPassphraseEnv = "TUNNELMANAGER_NEW_KEY_PASSPHRASE"
+)
+
+// command is a CLI subcommand
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(e *env, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"setup", "setup [-dry-run] [-resume] [-topology chain|single] [-vpn-subnet CIDR] [-tunnel-subnet CIDR] [-vpn-subnet6 CIDR|none] [-dns IP,...] [-proposals compatible|modern|cnsa] [-firewall auto|iptables|nftables]", "Set up the IKEv2 chain on the configured servers", runSetup},
+		{"preflight", "preflight", "Check that the servers can run the VPN without changing them", runPreflight},
+		{"teardown", "teardown [-keep-ca] [-purge]", "Remove the VPN from the configured servers", runTeardown},
+		{"status", "status", "Show tunnel status of all servers", runStatus},
+		{"logs", "logs [-server N] [-lines N]", "Fetch StrongSwan logs from a server", runLogs},
+		{"users", "users list | add <name> [-password P] | remove <name>", "Manage VPN users on the entry server", runUsers},
+		{"profile", "profile <username> [-out FILE]", "Generate an Apple .mobileconfig profile for a user", runProfile},
+		{"keygen", "keygen [-type T] [-path P] [-comment C]", "Generate an SSH key pair", runKeygen},
+		{"copy-key", "copy-key [-path P]", "Install the SSH public key on all servers", runCopyKey},
+		{"rotate-key", "rotate-key [-type T] [-comment C]", "Rotate the SSH key on all servers", runRotateKey},
+		{"daemon", "daemon [-listen ADDR] [-token-file FILE]", "Serve the local REST API", runDaemon},
+		{"version", "version", "Print the version", runVersion},
+	}
+}
+
+// Handles reports whether args select a CLI subcommand rather than the GUI
+func Handles(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		return true
+	}
+	return findCommand(args[0]) != nil
+}
+
+// Run executes a CLI subcommand and returns the process exit code
+func Run(args []string, version string) int {
+	if len(args) == 0 || findCommand(args[0]) == nil {
+		printUsage(os.Stderr)
+		if len(args) > 0 && (args[0] == "help" || strings.HasPrefix(args[0], "-")) {
+			return 0
+		}
+		return 2
+	}
+
+	cmd := findCommand(args[0])
+	e, err := newEnv(version)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer e.close()
+
+	if err := cmd.run(e, args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		if _, ok := err.(usageError); ok {
+			fmt.Fprintf(os.Stderr, "Error: %v\nUsage: vpnmanager %s\n", err, cmd.usage)
+			return 2
+		}
+		e.Errorf("%v", err)
+		if e.json && !e.printed {
+			e.printJSON(map[string]string{"error": err.Error()})
+		}
+		return 1
+	}
+	return 0
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: vpnmanager [command] [flags]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Without a command the graphical interface is started.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Common flags:")
+	fmt.Fprintln(w, "  -json                   Print machine-readable JSON to stdout")
+	fmt.Fprintln(w, "  -accept-new-host-keys   Trust unknown SSH host keys without asking")
+	fmt.Fprintln(w, "")
+	fmt.Fprintf(w, "Passphrases for encrypted keys are read from $%s;\n", PassphraseEnv)
+	fmt.Fprintf(w, "new keys are encrypted with $%s if it is set.\n", NewPassphraseEnv)
+}
+
+// usageError marks errors caused by wrong arguments
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// env holds the state shared by all subcommands
+type env struct {
+	version string
+	store   *storage.Storage
+	config  *storage.AppConfig
+	logger  *logging.Logger
+	stdout  io.Writer
+	stderr  io.Writer
+
+	json           bool
+	acceptNewHosts bool
+	printed        bool // JSON output already written
+}
+
+func newEnv(version string) (*env, error) {
+	store, err := storage.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize storage: %w", err)
+	}
+
+	config, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	e := &env{
+		version: version,
+		store:   store,
+		config:  config,
+		stdout:  os.Stdout,
+		stderr:  os.Stderr,
+	}
+
+	// Log to the usual log files and mirror to stderr so stdout stays clean for JSON
+	if logger, err := logging.New(store.GetLogDir()); err == nil {
+		logger.AddWriter(os.Stderr)
+		e.logger = logger
+	}
+
+	return e, nil
+}
+
+func (e *env) close() {
+	if e.logger != nil {
+		e.logger.Close()
+	}
+}
+
+// flags creates a flag set with the common flags registered
+func (e *env) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.BoolVar(&e.json, "json", false, "print JSON output")
+	fs.BoolVar(&e.acceptNewHosts, "accept-new-host-keys", false, "trust unknown SSH host keys")
+	return fs
+}
+
+// parse parses flags allowing them after positional arguments
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// Log implements vpn.Logger
+func (e *env) Log(message string) {
+	if e.logger != nil {
+		e.logger.Log(message)
+	} else {
+		fmt.Fprintln(e.stderr, message)
+	}
+}
+
+// Logf implements vpn.Logger
+func (e *env) Logf(format string, args ...interface{}) {
+	e.Log(fmt.Sprintf(format, args...))
+}
+
+// Error implements vpn.Logger
+func (e *env) Error(message string) {
+	e.Log("ERROR: " + message)
+}
+
+// Errorf implements vpn.Logger
+func (e *env) Errorf(format string, args ...interface{}) {
+	e.Error(fmt.Sprintf(format, args...))
+}
+
+func (e *env) printJSON(v interface{}) error {
+	e.printed = true
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// serverConfig returns the SSH config of the n-th configured server (0-based)
+func (e *env) serverConfig(n int) (*ssh.ServerConfig, error) {
+	if n < 0 || n >= len(e.config.Servers) {
+		return nil, usageError(fmt.Sprintf("server %d is not configured", n+1))
+	}
+	server := &e.config.Servers[n]
+	if server.Host == "" {
+		return nil, fmt.Errorf("%s has no host configured", serverName(n))
+	}
+
+	cfg := saved.SSHConfig(server)
+	cfg.KnownHostsPath = e.store.GetKnownHostsPath()
+	cfg.HostKeyPrompt = e.confirmHostKey
+	cfg.PassphrasePrompt = passphraseFromEnv
+	return cfg, nil
+}
+
+func serverName(n int) string {
+	return fmt.Sprintf("Server %d", n+1)
+}
+
+// confirmHostKey trusts unknown host keys when allowed by flag or answered on a terminal
+func (e *env) confirmHostKey(host, fingerprint string) bool {
+	if e.acceptNewHosts {
+		e.Logf("Trusting new host key for %s: %s", host, fingerprint)
+		return true
+	}
+	if !isTerminal(os.Stdin) {
+		e.Errorf("Unknown host key for %s: %s (use -accept-new-host-keys to trust it)", host, fingerprint)
+		return false
+	}
+
+	fmt.Fprintf(e.stderr, "The authenticity of host %s can't be established.\nKey fingerprint: %s\nTrust this key and remember it? [y/N] ", host, fingerprint)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func passphraseFromEnv(keyPath string) ([]byte, error) {
+	passphrase, ok := os.LookupEnv(PassphraseEnv)
+	if !ok {
+		return nil, fmt.Errorf("key %s is encrypted; set %s", keyPath, PassphraseEnv)
+	}
+	return []byte(passphrase), nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
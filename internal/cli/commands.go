@@ -0,0 +1,656 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/saved"
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/storage"
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+func runVersion(e *env, args []string) error {
+	if _, err := parse(e.flags("version"), args); err != nil {
+		return err
+	}
+	if e.json {
+		return e.printJSON(map[string]string{"version": e.version})
+	}
+	fmt.Fprintln(e.stdout, e.version)
+	return nil
+}
+
+func runSetup(e *env, args []string) error {
+	fs := e.flags("setup")
+	dryRun := fs.Bool("dry-run", false, "print the commands and files for each server without changing anything")
+	resume := fs.Bool("resume", false, "continue a failed setup with the step that failed")
+	topology := fs.String("topology", "", "chain or single; saved to the config when given")
+	vpnSubnet := fs.String("vpn-subnet", "", "subnet for VPN client addresses, e.g. 10.10.10.0/24; saved to the config when given")
+	tunnelSubnet := fs.String("tunnel-subnet", "", "subnet reserved for the tunnels between servers; saved to the config when given")
+	vpnSubnet6 := fs.String("vpn-subnet6", "", "IPv6 subnet for VPN client addresses, e.g. fd10:10:10::/64, or none for IPv4 only; saved to the config when given")
+	dns := fs.String("dns", "", "comma separated DNS servers pushed to clients; saved to the config when given")
+	firewall := fs.String("firewall", "", "firewall backend: auto, iptables or nftables; saved to the config when given")
+	proposals := fs.String("proposals", "", "IKE/ESP proposal profile: compatible, modern or cnsa; saved to the config when given")
+	if _, err := parse(fs, args); err != nil {
+		return err
+	}
+
+	changed := false
+	if *topology != "" {
+		switch *topology {
+		case "chain":
+			e.config.Topology = storage.TopologyChain
+		case "single":
+			e.config.Topology = storage.TopologySingle
+		default:
+			return usageError(fmt.Sprintf("unknown topology: %s", *topology))
+		}
+		changed = true
+	}
+	if *vpnSubnet != "" {
+		if err := vpn.ValidateSubnet(*vpnSubnet); err != nil {
+			return usageError(err.Error())
+		}
+		e.config.Network.VPNSubnet = *vpnSubnet
+		changed = true
+	}
+	if *tunnelSubnet != "" {
+		if err := vpn.ValidateSubnet(*tunnelSubnet); err != nil {
+			return usageError(err.Error())
+		}
+		e.config.Network.TunnelSubnet = *tunnelSubnet
+		changed = true
+	}
+	switch *vpnSubnet6 {
+	case "":
+	case "none":
+		e.config.Network.VPNSubnet6 = ""
+		changed = true
+	default:
+		if err := vpn.ValidateSubnet(*vpnSubnet6); err != nil {
+			return usageError(err.Error())
+		}
+		e.config.Network.VPNSubnet6 = *vpnSubnet6
+		changed = true
+	}
+	if *dns != "" {
+		servers := vpn.SplitList(*dns)
+		if err := vpn.ValidateDNS(servers); err != nil {
+			return usageError(err.Error())
+		}
+		e.config.Network.DNS = servers
+		changed = true
+	}
+	if *firewall != "" {
+		if err := vpn.ValidateFirewallBackend(vpn.FirewallBackend(*firewall)); err != nil {
+			return usageError(err.Error())
+		}
+		e.config.Network.Firewall = *firewall
+		changed = true
+	}
+	if *proposals != "" {
+		if err := vpn.ValidateProposalProfile(vpn.ProposalProfile(*proposals)); err != nil {
+			return usageError(err.Error())
+		}
+		e.config.Network.Proposals = *proposals
+		changed = true
+	}
+	if changed {
+		if err := e.store.Save(e.config); err != nil {
+			return fmt.Errorf("failed to save config: %w", err)
+		}
+	}
+
+	config, err := e.setupConfig()
+	if err != nil {
+		return err
+	}
+
+	// Ctrl-C stops at the running remote command; a cancelled setup can be resumed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *dryRun {
+		plan, err := vpn.NewManager(config, e).PlanContext(ctx)
+		if err != nil {
+			return fmt.Errorf("planning failed: %w", err)
+		}
+		if e.json {
+			return e.printJSON(plan)
+		}
+		for _, sp := range plan.Servers {
+			fmt.Fprintln(e.stdout, sp.Script())
+		}
+		return nil
+	}
+
+	manager := vpn.NewManager(config, e)
+	if *resume {
+		state, err := e.store.LoadSetupState()
+		if err != nil {
+			return fmt.Errorf("failed to load setup state: %w", err)
+		}
+		if !saved.Resumable(state) {
+			return usageError("there is no unfinished setup to resume")
+		}
+		if state.Fingerprint != config.Fingerprint() {
+			return usageError("servers or network settings changed since the unfinished setup, run setup without -resume")
+		}
+		manager.SkipSteps(saved.CompletedSteps(state))
+	}
+
+	// Record every step so a failed run can be resumed. The state is saved
+	// from the first step event on, so a run stopped by preflight keeps the
+	// previous one.
+	state := &storage.SetupState{Fingerprint: config.Fingerprint()}
+	for _, step := range manager.Steps() {
+		state.Set(saved.StepState(step))
+	}
+	events := manager.Progress()
+	recorded := make(chan struct{})
+	go func() {
+		defer close(recorded)
+		for ev := range events {
+			state.Set(saved.StepState(ev.Step))
+			if err := e.store.SaveSetupState(state); err != nil {
+				e.Errorf("Failed to save setup state: %v", err)
+			}
+			if ev.Step.Status != vpn.StepRunning {
+				e.Logf("Step %d/%d %s: %s", ev.Index+1, ev.Total, ev.Step.ID, ev.Step.Status)
+			}
+		}
+	}()
+
+	err = manager.SetupAllContext(ctx)
+	<-recorded
+	if err != nil {
+		return fmt.Errorf("setup failed: %w", err)
+	}
+
+	if e.json {
+		return e.printJSON(map[string]string{"result": "ok"})
+	}
+	fmt.Fprintln(e.stdout, "IKEv2 tunnel setup completed")
+	return nil
+}
+
+func runPreflight(e *env, args []string) error {
+	if _, err := parse(e.flags("preflight"), args); err != nil {
+		return err
+	}
+
+	config, err := e.setupConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	reports, err := vpn.NewManager(config, e).PreflightContext(ctx)
+	if err != nil {
+		return fmt.Errorf("preflight failed: %w", err)
+	}
+
+	failed := 0
+	for _, r := range reports {
+		failed += len(r.Failed())
+	}
+	if e.json {
+		if err := e.printJSON(reports); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVER\tCHECK\tRESULT\tDETAIL")
+		for _, r := range reports {
+			for _, c := range r.Checks {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Name, c.Name, c.Status, c.Detail)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d preflight checks failed", failed)
+	}
+	return nil
+}
+
+func runTeardown(e *env, args []string) error {
+	fs := e.flags("teardown")
+	keepCA := fs.Bool("keep-ca", false, "keep the CA so a later setup is trusted by existing client profiles")
+	purge := fs.Bool("purge", false, "also uninstall the StrongSwan packages")
+	if _, err := parse(fs, args); err != nil {
+		return err
+	}
+
+	config, err := e.setupConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	reports, err := vpn.NewManager(config, e).TeardownContext(ctx, vpn.TeardownOptions{KeepCA: *keepCA, Purge: *purge})
+	if e.json && reports != nil {
+		if err := e.printJSON(reports); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range reports {
+			fmt.Fprintf(e.stdout, "%s (%s):\n", r.Name, r.Host)
+			if len(r.Removed) == 0 && r.Error == "" {
+				fmt.Fprintln(e.stdout, "  nothing to remove")
+			}
+			for _, item := range r.Removed {
+				fmt.Fprintf(e.stdout, "  removed %s\n", item)
+			}
+			if r.Error != "" {
+				fmt.Fprintf(e.stdout, "  error: %s\n", r.Error)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("teardown failed: %w", err)
+	}
+	return nil
+}
+
+// setupConfig builds the chain from all configured servers, in order
+func (e *env) setupConfig() (*vpn.SetupConfig, error) {
+	config := &vpn.SetupConfig{
+		Topology:     vpn.Topology(e.config.Topology),
+		VPNSubnet:    e.config.Network.VPNSubnet,
+		TunnelSubnet: e.config.Network.TunnelSubnet,
+		DNS:          e.config.Network.DNS,
+		VPNSubnet6:   e.config.Network.VPNSubnet6,
+		Proposals:    vpn.ProposalProfile(e.config.Network.Proposals),
+		Firewall:     vpn.FirewallBackend(e.config.Network.Firewall),
+	}
+	config.SetDefaults()
+	for i := 0; i < e.config.ActiveServers(); i++ {
+		cfg, err := e.serverConfig(i)
+		if err != nil {
+			return nil, err
+		}
+		config.Hops = append(config.Hops, &vpn.Hop{Name: serverName(i), Server: cfg, Domain: cfg.Host})
+	}
+	return config, nil
+}
+
+func runStatus(e *env, args []string) error {
+	if _, err := parse(e.flags("status"), args); err != nil {
+		return err
+	}
+
+	type serverStatus struct {
+		Name   string      `json:"name"`
+		Host   string      `json:"host"`
+		Status *vpn.Status `json:"status,omitempty"`
+		Error  string      `json:"error,omitempty"`
+	}
+
+	var results []serverStatus
+	failed := false
+	for i := 0; i < e.config.ActiveServers(); i++ {
+		result := serverStatus{Name: serverName(i), Host: e.config.Servers[i].Host}
+		cfg, err := e.serverConfig(i)
+		if err == nil {
+			client := ssh.NewClient(cfg)
+			result.Status, err = vpn.GetStatus(client)
+			client.Close()
+		}
+		if err != nil {
+			result.Error = err.Error()
+			failed = true
+		}
+		results = append(results, result)
+	}
+
+	if e.json {
+		if err := e.printJSON(results); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVER\tHOST\tSTRONGSWAN\tTUNNEL\tCLIENTS\tPUBLIC IP")
+		for _, r := range results {
+			switch {
+			case r.Error != "":
+				fmt.Fprintf(w, "%s\t%s\terror: %s\t\t\t\n", r.Name, r.Host, r.Error)
+			case !r.Status.Connected:
+				fmt.Fprintf(w, "%s\t%s\tstopped\t\t\t\n", r.Name, r.Host)
+			default:
+				tunnel := "down"
+				if r.Status.TunnelActive {
+					tunnel = "up"
+				}
+				publicIP := r.Status.ServerIP
+				if r.Status.ServerIPv6 != "" {
+					publicIP += ", " + r.Status.ServerIPv6
+				}
+				fmt.Fprintf(w, "%s\t%s\trunning\t%s\t%d\t%s\n", r.Name, r.Host, tunnel, r.Status.ActiveClients, publicIP)
+			}
+		}
+		w.Flush()
+
+		for _, r := range results {
+			if r.Status != nil && len(r.Status.RoutingDrift) > 0 {
+				fmt.Fprintf(e.stdout, "\nWARNING: policy routing on %s differs from the deployed rules:\n", r.Name)
+				for _, d := range r.Status.RoutingDrift {
+					fmt.Fprintf(e.stdout, "  %s\n", d)
+				}
+			}
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("failed to get status of some servers")
+	}
+	return nil
+}
+
+func runLogs(e *env, args []string) error {
+	fs := e.flags("logs")
+	server := fs.Int("server", 1, "server number")
+	lines := fs.Int("lines", 50, "number of journal lines")
+	if _, err := parse(fs, args); err != nil {
+		return err
+	}
+
+	cfg, err := e.serverConfig(*server - 1)
+	if err != nil {
+		return err
+	}
+	client := ssh.NewClient(cfg)
+	defer client.Close()
+
+	logs, err := vpn.GetDetailedLogs(client, *lines)
+	if err != nil {
+		return err
+	}
+
+	if e.json {
+		return e.printJSON(map[string]string{"server": serverName(*server - 1), "logs": logs})
+	}
+	fmt.Fprintln(e.stdout, logs)
+	return nil
+}
+
+func runUsers(e *env, args []string) error {
+	fs := e.flags("users")
+	password := fs.String("password", "", "password for the new user (generated if empty)")
+	positional, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return usageError("missing users subcommand")
+	}
+
+	cfg, err := e.serverConfig(0)
+	if err != nil {
+		return err
+	}
+	client := ssh.NewClient(cfg)
+	defer client.Close()
+	um := vpn.NewUserManager(client, e)
+
+	switch positional[0] {
+	case "list":
+		users, err := um.ListUsers()
+		if err != nil {
+			return err
+		}
+		if e.json {
+			if users == nil {
+				users = []vpn.User{}
+			}
+			return e.printJSON(users)
+		}
+		for _, u := range users {
+			fmt.Fprintln(e.stdout, u.Username)
+		}
+		return nil
+
+	case "add":
+		if len(positional) != 2 {
+			return usageError("users add requires a username")
+		}
+		pass, err := um.AddUser(positional[1], *password)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(vpn.User{Username: positional[1], Password: pass})
+		}
+		fmt.Fprintf(e.stdout, "Added %s, password: %s\n", positional[1], pass)
+		return nil
+
+	case "remove":
+		if len(positional) != 2 {
+			return usageError("users remove requires a username")
+		}
+		if err := um.RemoveUser(positional[1]); err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(map[string]string{"removed": positional[1]})
+		}
+		fmt.Fprintf(e.stdout, "Removed %s\n", positional[1])
+		return nil
+
+	default:
+		return usageError(fmt.Sprintf("unknown users subcommand: %s", positional[0]))
+	}
+}
+
+func runProfile(e *env, args []string) error {
+	fs := e.flags("profile")
+	out := fs.String("out", "", "output file (default <username>.mobileconfig, - for stdout)")
+	positional, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("profile requires a username")
+	}
+	username := positional[0]
+
+	cfg, err := e.serverConfig(0)
+	if err != nil {
+		return err
+	}
+	client := ssh.NewClient(cfg)
+	defer client.Close()
+
+	um := vpn.NewUserManager(client, e)
+	password, err := um.GetUserPassword(username)
+	if err != nil {
+		return err
+	}
+	caCert, err := client.ReadFile(vpn.CACertPath)
+	if err != nil {
+		return fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+
+	profile := vpn.GenerateMobileConfig(username, password, cfg.Host, string(caCert), vpn.ProposalProfile(e.config.Network.Proposals))
+
+	path := *out
+	if path == "" {
+		path = username + ".mobileconfig"
+	}
+	if path == "-" {
+		_, err := e.stdout.Write(profile)
+		return err
+	}
+	if err := os.WriteFile(path, profile, 0600); err != nil {
+		return fmt.Errorf("failed to write profile: %w", err)
+	}
+
+	if e.json {
+		return e.printJSON(map[string]string{"username": username, "file": path})
+	}
+	fmt.Fprintf(e.stdout, "Saved %s\n", path)
+	return nil
+}
+
+// keyFlags holds the key generation flags shared by keygen and rotate-key
+type keyFlags struct {
+	keyType string
+	comment string
+}
+
+func (k *keyFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&k.keyType, "type", string(ssh.KeyTypeEd25519), "key type: ed25519, ecdsa-p256 or rsa-4096")
+	fs.StringVar(&k.comment, "comment", "tunnelmanager", "key comment")
+}
+
+// options builds key options; the new key is encrypted if NewPassphraseEnv is set
+func (k *keyFlags) options() ssh.KeyOptions {
+	return ssh.KeyOptions{
+		Type:       ssh.KeyType(k.keyType),
+		Passphrase: []byte(os.Getenv(NewPassphraseEnv)),
+		Comment:    k.comment,
+	}
+}
+
+func runKeygen(e *env, args []string) error {
+	var k keyFlags
+	fs := e.flags("keygen")
+	k.register(fs)
+	path := fs.String("path", e.defaultKeyPath(), "private key path")
+	force := fs.Bool("force", false, "overwrite an existing key")
+	if _, err := parse(fs, args); err != nil {
+		return err
+	}
+
+	keygen := ssh.NewKeyGenerator()
+	if keygen.KeyExists(*path) && !*force {
+		return fmt.Errorf("key %s already exists (use -force to overwrite)", *path)
+	}
+	if err := keygen.GenerateKey(*path, k.options()); err != nil {
+		return err
+	}
+	pub, err := keygen.GetPublicKey(*path)
+	if err != nil {
+		return err
+	}
+
+	if e.json {
+		return e.printJSON(map[string]string{"path": *path, "public_key": pub})
+	}
+	fmt.Fprintf(e.stdout, "Generated %s\n%s\n", *path, pub)
+	return nil
+}
+
+func runCopyKey(e *env, args []string) error {
+	fs := e.flags("copy-key")
+	path := fs.String("path", e.defaultKeyPath(), "private key path")
+	if _, err := parse(fs, args); err != nil {
+		return err
+	}
+
+	keygen := ssh.NewKeyGenerator()
+	pub, err := keygen.GetPublicKey(*path)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < e.config.ActiveServers(); i++ {
+		if e.config.Servers[i].Host == "" {
+			continue
+		}
+		cfg, err := e.serverConfig(i)
+		if err != nil {
+			return err
+		}
+		e.Logf("Copying key to %s (%s)...", serverName(i), cfg.Host)
+		client := ssh.NewClient(cfg)
+		err = keygen.CopyKeyToServer(client, pub)
+		client.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy key to %s: %w", serverName(i), err)
+		}
+
+		e.config.Servers[i].Password = "" // Clear password as we have key now
+		e.config.Servers[i].KeyPath = *path
+		e.config.Servers[i].AuthMethod = string(ssh.AuthKey)
+	}
+
+	if err := e.store.Save(e.config); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+
+	if e.json {
+		return e.printJSON(map[string]string{"result": "ok", "path": *path})
+	}
+	fmt.Fprintln(e.stdout, "Key installed on all configured servers")
+	return nil
+}
+
+func runRotateKey(e *env, args []string) error {
+	var k keyFlags
+	fs := e.flags("rotate-key")
+	k.register(fs)
+	if _, err := parse(fs, args); err != nil {
+		return err
+	}
+	opts := k.options()
+
+	var targets []ssh.RotationTarget
+	var indexes []int
+	for i := 0; i < e.config.ActiveServers(); i++ {
+		if e.config.Servers[i].Host == "" {
+			continue
+		}
+		cfg, err := e.serverConfig(i)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, ssh.RotationTarget{Name: serverName(i), Config: cfg})
+		indexes = append(indexes, i)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no servers configured")
+	}
+
+	newKeyPath := filepath.Join(filepath.Dir(e.defaultKeyPath()),
+		fmt.Sprintf("tunnelmanager_%s_%s", opts.Type, time.Now().Format("20060102-150405")))
+
+	if err := ssh.NewKeyGenerator().RotateKey(targets, newKeyPath, opts, e.Logf); err != nil {
+		return fmt.Errorf("key rotation failed and was rolled back: %w", err)
+	}
+
+	for _, i := range indexes {
+		e.config.Servers[i].KeyPath = newKeyPath
+		e.config.Servers[i].AuthMethod = string(ssh.AuthKey)
+	}
+	e.config.SSHKeyPath = newKeyPath
+	if err := e.store.Save(e.config); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+
+	if e.json {
+		return e.printJSON(map[string]string{"result": "ok", "path": newKeyPath})
+	}
+	fmt.Fprintf(e.stdout, "Rotated key on %d servers, new key: %s\n", len(targets), newKeyPath)
+	return nil
+}
+
+func (e *env) defaultKeyPath() string {
+	if e.config.SSHKeyPath != "" {
+		return e.config.SSHKeyPath
+	}
+	return e.store.GetDefaultKeyPath()
+}
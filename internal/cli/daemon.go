@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/api"
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+const defaultListenAddr = "127.0.0.1:8787"
+
+func runDaemon(e *env, args []string) error {
+	fs := e.flags("daemon")
+	listen := fs.String("listen", defaultListenAddr, "loopback address to listen on")
+	tokenFile := fs.String("token-file", e.store.GetAPITokenPath(), "file holding the API bearer token")
+	if _, err := parse(fs, args); err != nil {
+		return err
+	}
+
+	token, created, err := api.LoadOrCreateToken(*tokenFile)
+	if err != nil {
+		return err
+	}
+	if created {
+		e.Logf("Generated new API token in %s", *tokenFile)
+	}
+
+	var names []string
+	var configs []*ssh.ServerConfig
+	for i := 0; i < e.config.ActiveServers(); i++ {
+		cfg, err := e.serverConfig(i)
+		if err != nil {
+			return err
+		}
+		cfg.HostKeyPrompt = e.daemonHostKey
+		names = append(names, serverName(i))
+		configs = append(configs, cfg)
+	}
+
+	server, err := api.NewServer(*listen, token, names, configs, vpn.ProposalProfile(e.config.Network.Proposals), e)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return server.Run(ctx)
+}
+
+// daemonHostKey trusts unknown host keys only when allowed by flag; the daemon
+// connects from request handlers, where a prompt on stdin would block the request
+func (e *env) daemonHostKey(host, fingerprint string) bool {
+	if e.acceptNewHosts {
+		e.Logf("Trusting new host key for %s: %s", host, fingerprint)
+		return true
+	}
+	e.Errorf("Unknown host key for %s: %s (use -accept-new-host-keys, or run another command once to trust it)", host, fingerprint)
+	return false
+}
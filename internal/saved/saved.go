@@ -0,0 +1,70 @@
+// Package saved converts between the records kept by package storage and the
+// types of the packages that use them, so storage depends on neither.
+package saved
+
+import (
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/storage"
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+// SSHConfig converts a saved server into SSH connection parameters
+func SSHConfig(s *storage.ServerConfig) *ssh.ServerConfig {
+	cfg := &ssh.ServerConfig{
+		Host:       s.Host,
+		Port:       s.Port,
+		User:       s.User,
+		Password:   s.Password,
+		KeyPath:    s.KeyPath,
+		AuthMethod: ssh.AuthMethod(s.AuthMethod),
+	}
+	if cfg.Port == 0 {
+		cfg.Port = ssh.DefaultPort
+	}
+	if s.JumpHost != nil && s.JumpHost.Host != "" {
+		cfg.JumpHost = SSHConfig(s.JumpHost)
+	}
+	return cfg
+}
+
+// UpdateServer copies connection parameters back from an SSH config into a
+// saved server, keeping its name
+func UpdateServer(s *storage.ServerConfig, cfg *ssh.ServerConfig) {
+	s.Host = cfg.Host
+	s.Port = cfg.Port
+	s.User = cfg.User
+	s.Password = cfg.Password
+	s.KeyPath = cfg.KeyPath
+	s.AuthMethod = string(cfg.AuthMethod)
+
+	if cfg.JumpHost != nil && cfg.JumpHost.Host != "" {
+		jump := &storage.ServerConfig{Name: "Jump Host"}
+		UpdateServer(jump, cfg.JumpHost)
+		s.JumpHost = jump
+	} else {
+		s.JumpHost = nil
+	}
+}
+
+// StepState converts a setup step for the setup state file
+func StepState(step vpn.Step) storage.StepState {
+	return storage.StepState{ID: step.ID, Server: step.Server, Name: step.Name, Status: string(step.Status), Error: step.Error}
+}
+
+// CompletedSteps returns the IDs of the steps of a recorded run that
+// finished, including ones skipped because an earlier run finished them
+func CompletedSteps(state *storage.SetupState) []string {
+	var ids []string
+	for _, step := range state.Steps {
+		switch vpn.StepStatus(step.Status) {
+		case vpn.StepDone, vpn.StepSkipped:
+			ids = append(ids, step.ID)
+		}
+	}
+	return ids
+}
+
+// Resumable reports whether a recorded run stopped before all steps finished
+func Resumable(state *storage.SetupState) bool {
+	return state != nil && len(state.Steps) > 0 && len(CompletedSteps(state)) < len(state.Steps)
+}
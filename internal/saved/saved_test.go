@@ -0,0 +1,61 @@
+package saved
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/storage"
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+func TestCompletedSteps(t *testing.T) {
+	state := &storage.SetupState{}
+	for _, step := range []vpn.Step{
+		{ID: "Server 2/install", Status: vpn.StepSkipped},
+		{ID: "Server 2/sysctl", Status: vpn.StepDone},
+		{ID: "Server 2/certs", Status: vpn.StepFailed, Error: "exit status 1"},
+		{ID: "Server 2/firewall", Status: vpn.StepPending},
+	} {
+		state.Set(StepState(step))
+	}
+
+	if got, want := CompletedSteps(state), []string{"Server 2/install", "Server 2/sysctl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CompletedSteps = %v, want %v", got, want)
+	}
+	if !Resumable(state) {
+		t.Error("failed run not resumable")
+	}
+
+	state.Set(StepState(vpn.Step{ID: "Server 2/certs", Status: vpn.StepDone}))
+	state.Set(StepState(vpn.Step{ID: "Server 2/firewall", Status: vpn.StepDone}))
+	if Resumable(state) {
+		t.Error("finished run resumable")
+	}
+	if Resumable(nil) || Resumable(&storage.SetupState{}) {
+		t.Error("missing run resumable")
+	}
+}
+
+func TestSSHConfig(t *testing.T) {
+	server := &storage.ServerConfig{
+		Name: "Server 1", Host: "198.51.100.10", User: "root", KeyPath: "/keys/id", AuthMethod: "key",
+		JumpHost: &storage.ServerConfig{Host: "192.0.2.5", Port: 2222, User: "bastion"},
+	}
+
+	cfg := SSHConfig(server)
+	if cfg.Port != ssh.DefaultPort || cfg.AuthMethod != ssh.AuthKey || cfg.KeyPath != "/keys/id" {
+		t.Errorf("SSHConfig = %+v", cfg)
+	}
+	if cfg.JumpHost == nil || cfg.JumpHost.Host != "192.0.2.5" || cfg.JumpHost.Port != 2222 {
+		t.Fatalf("jump host = %+v", cfg.JumpHost)
+	}
+
+	cfg.Host = "198.51.100.11"
+	cfg.JumpHost = nil
+	UpdateServer(server, cfg)
+	want := storage.ServerConfig{Name: "Server 1", Host: "198.51.100.11", Port: 22, User: "root", KeyPath: "/keys/id", AuthMethod: "key"}
+	if !reflect.DeepEqual(*server, want) {
+		t.Errorf("UpdateServer = %+v, want %+v", *server, want)
+	}
+}
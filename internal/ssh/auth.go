@@ -0,0 +1,146 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AuthMethod selects how a client authenticates to a server
+type AuthMethod string
+
+const (
+	// AuthAuto uses a private key if one is configured and falls back to the password
+	AuthAuto AuthMethod = ""
+	// AuthPassword uses password authentication only
+	AuthPassword AuthMethod = "password"
+	// AuthKey uses the configured private key file or content
+	AuthKey AuthMethod = "key"
+	// AuthAgent uses the keys loaded in ssh-agent (SSH_AUTH_SOCK)
+	AuthAgent AuthMethod = "agent"
+)
+
+// PassphrasePrompt asks for the passphrase of an encrypted private key.
+// keyPath is empty when the key was supplied as KeyContent.
+type PassphrasePrompt func(keyPath string) ([]byte, error)
+
+// authMethods builds the SSH auth methods for the configured AuthMethod.
+// The password is always offered last since it is also used for sudo.
+func (c *Client) authMethods() ([]ssh.AuthMethod, error) {
+	methods := []ssh.AuthMethod{}
+
+	switch c.config.AuthMethod {
+	case AuthAgent:
+		signers, err := c.agentSigners()
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, ssh.PublicKeysCallback(signers))
+	case AuthKey:
+		signer, err := c.keySigner()
+		if err != nil {
+			return nil, err
+		}
+		if signer == nil {
+			return nil, fmt.Errorf("key authentication selected but no key configured")
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	case AuthPassword:
+		if c.config.Password == "" {
+			return nil, fmt.Errorf("password authentication selected but no password provided")
+		}
+	case AuthAuto:
+		signer, err := c.keySigner()
+		if err != nil {
+			return nil, err
+		}
+		if signer != nil {
+			methods = append(methods, ssh.PublicKeys(signer))
+		}
+	default:
+		return nil, fmt.Errorf("unknown authentication method: %s", c.config.AuthMethod)
+	}
+
+	if c.config.Password != "" {
+		methods = append(methods, ssh.Password(c.config.Password))
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no authentication method provided")
+	}
+
+	return methods, nil
+}
+
+// keySigner parses the configured private key, asking for a passphrase if it is encrypted.
+// Returns nil if no key is configured.
+func (c *Client) keySigner() (ssh.Signer, error) {
+	var key []byte
+	if c.config.KeyPath != "" {
+		data, err := os.ReadFile(c.config.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		key = data
+	} else if len(c.config.KeyContent) > 0 {
+		key = c.config.KeyContent
+	} else {
+		return nil, nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	if c.config.PassphrasePrompt == nil {
+		return nil, fmt.Errorf("private key is passphrase-protected but no passphrase prompt is available")
+	}
+
+	passphrase, err := c.config.PassphrasePrompt(c.config.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key passphrase: %w", err)
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return signer, nil
+}
+
+// agentSigners connects to ssh-agent and returns its signers callback.
+// The agent connection stays open until the client is closed.
+func (c *Client) agentSigners() (func() ([]ssh.Signer, error), error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("ssh-agent authentication selected but SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+	c.agentConn = conn
+
+	return agent.NewClient(conn).Signers, nil
+}
+
+// CheckPassphrase reports whether passphrase decrypts the private key at keyPath
+func CheckPassphrase(keyPath string, passphrase []byte) error {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	if _, err := ssh.ParsePrivateKeyWithPassphrase(key, passphrase); err != nil {
+		return fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -12,6 +13,9 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// DefaultPort is used when a ServerConfig has no port
+const DefaultPort = 22
+
 // ServerConfig holds SSH connection parameters
 type ServerConfig struct {
 	Host       string
@@ -20,77 +24,134 @@ type ServerConfig struct {
 	Password   string
 	KeyPath    string
 	KeyContent []byte
+
+	// AuthMethod selects password, key or ssh-agent authentication
+	AuthMethod AuthMethod
+	// PassphrasePrompt is called for passphrase-protected keys; the passphrase is never stored
+	PassphrasePrompt PassphrasePrompt
+
+	// Host key verification
+	KnownHostsPath string
+	HostKeyPrompt  HostKeyPrompt
+
+	// JumpHost is an optional bastion the connection is tunneled through (like ProxyJump)
+	JumpHost *ServerConfig
 }
 
 // Client wraps SSH client functionality
 type Client struct {
 	config     *ServerConfig
 	connection *ssh.Client
+	agentConn  net.Conn
+	jump       *Client
 }
 
 // NewClient creates a new SSH client
 func NewClient(config *ServerConfig) *Client {
 	if config.Port == 0 {
-		config.Port = 22
+		config.Port = DefaultPort
 	}
 	return &Client{config: config}
 }
 
 // Connect establishes SSH connection
 func (c *Client) Connect() error {
-	authMethods := []ssh.AuthMethod{}
+	authMethods, err := c.authMethods()
+	if err != nil {
+		c.closeAgent()
+		return err
+	}
 
-	// Try key authentication first
-	if c.config.KeyPath != "" {
-		key, err := os.ReadFile(c.config.KeyPath)
-		if err != nil {
-			return fmt.Errorf("failed to read key file: %w", err)
-		}
-		signer, err := ssh.ParsePrivateKey(key)
-		if err != nil {
-			return fmt.Errorf("failed to parse private key: %w", err)
-		}
-		authMethods = append(authMethods, ssh.PublicKeys(signer))
-	} else if len(c.config.KeyContent) > 0 {
-		signer, err := ssh.ParsePrivateKey(c.config.KeyContent)
+	addr := net.JoinHostPort(c.config.Host, fmt.Sprintf("%d", c.config.Port))
+
+	hostKeyCallback, err := hostKeyCallback(c.config.KnownHostsPath, c.config.HostKeyPrompt)
+	if err != nil {
+		c.closeAgent()
+		return err
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:              c.config.User,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: knownHostAlgorithms(c.config.KnownHostsPath, addr),
+		Timeout:           10 * time.Second,
+	}
+
+	conn, err := c.dial(addr, sshConfig)
+	if err != nil {
+		c.closeAgent()
+		return err
+	}
+
+	c.connection = conn
+	return nil
+}
+
+// dial opens the SSH connection, directly or through the configured jump host
+func (c *Client) dial(addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	if c.config.JumpHost == nil {
+		conn, err := ssh.Dial("tcp", addr, sshConfig)
 		if err != nil {
-			return fmt.Errorf("failed to parse private key: %w", err)
+			return nil, fmt.Errorf("failed to connect: %w", err)
 		}
-		authMethods = append(authMethods, ssh.PublicKeys(signer))
+		return conn, nil
 	}
 
-	// Add password authentication
-	if c.config.Password != "" {
-		authMethods = append(authMethods, ssh.Password(c.config.Password))
+	// The jump host is verified against the same known_hosts store
+	jumpConfig := *c.config.JumpHost
+	if jumpConfig.KnownHostsPath == "" {
+		jumpConfig.KnownHostsPath = c.config.KnownHostsPath
+	}
+	if jumpConfig.HostKeyPrompt == nil {
+		jumpConfig.HostKeyPrompt = c.config.HostKeyPrompt
+	}
+	if jumpConfig.PassphrasePrompt == nil {
+		jumpConfig.PassphrasePrompt = c.config.PassphrasePrompt
 	}
 
-	if len(authMethods) == 0 {
-		return fmt.Errorf("no authentication method provided")
+	jump := NewClient(&jumpConfig)
+	if err := jump.Connect(); err != nil {
+		return nil, fmt.Errorf("failed to connect to jump host %s: %w", jumpConfig.Host, err)
 	}
 
-	sshConfig := &ssh.ClientConfig{
-		User:            c.config.User,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO: implement proper host key verification
-		Timeout:         10 * time.Second,
+	netConn, err := jump.connection.Dial("tcp", addr)
+	if err != nil {
+		jump.Close()
+		return nil, fmt.Errorf("failed to reach %s through jump host %s: %w", addr, jumpConfig.Host, err)
 	}
 
-	addr := net.JoinHostPort(c.config.Host, fmt.Sprintf("%d", c.config.Port))
-	conn, err := ssh.Dial("tcp", addr, sshConfig)
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, sshConfig)
 	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+		netConn.Close()
+		jump.Close()
+		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
 
-	c.connection = conn
-	return nil
+	c.jump = jump
+	return ssh.NewClient(sshConn, chans, reqs), nil
 }
 
 // Close closes the SSH connection
 func (c *Client) Close() error {
+	c.closeAgent()
+	var err error
 	if c.connection != nil {
-		return c.connection.Close()
+		err = c.connection.Close()
+		c.connection = nil
+	}
+	if c.jump != nil {
+		c.jump.Close()
+		c.jump = nil
+	}
+	return err
+}
+
+func (c *Client) closeAgent() {
+	if c.agentConn != nil {
+		c.agentConn.Close()
+		c.agentConn = nil
 	}
-	return nil
 }
 
 // IsConnected returns true if connected
@@ -98,8 +159,26 @@ func (c *Client) IsConnected() bool {
 	return c.connection != nil
 }
 
+// KeepAlive sends a keepalive request and reports an error if the connection is gone
+func (c *Client) KeepAlive() error {
+	if c.connection == nil {
+		return fmt.Errorf("not connected")
+	}
+	if _, _, err := c.connection.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		return fmt.Errorf("connection lost: %w", err)
+	}
+	return nil
+}
+
 // Run executes a command and returns output
 func (c *Client) Run(command string) (string, error) {
+	return c.RunContext(context.Background(), command)
+}
+
+// RunContext executes a command and returns output. When ctx is done first
+// the command is killed and the session closed; see wait for what that
+// reaches on the server.
+func (c *Client) RunContext(ctx context.Context, command string) (string, error) {
 	if c.connection == nil {
 		return "", fmt.Errorf("not connected")
 	}
@@ -114,13 +193,37 @@ func (c *Client) Run(command string) (string, error) {
 	session.Stdout = &stdout
 	session.Stderr = &stderr
 
-	if err := session.Run(command); err != nil {
+	if err := wait(ctx, session, func() error { return session.Run(command) }); err != nil {
 		return "", fmt.Errorf("command failed: %w, stderr: %s", err, stderr.String())
 	}
 
 	return stdout.String(), nil
 }
 
+// wait runs fn on session, killing and closing the session if ctx is done first.
+// OpenSSH 7.9 and later deliver the SIGKILL to the process the session started,
+// which for sudo and shell commands is the shell, not its children. Sessions
+// have no pty, so closing the channel sends no SIGHUP either: it only closes
+// the command's stdio. A child such as apt-get can therefore keep running, and
+// holding the dpkg lock, until it exits or writes to the closed output.
+func wait(ctx context.Context, session *ssh.Session, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
 // RunWithOutput executes a command and streams output to writer
 func (c *Client) RunWithOutput(command string, stdout, stderr io.Writer) error {
 	if c.connection == nil {
@@ -141,6 +244,11 @@ func (c *Client) RunWithOutput(command string, stdout, stderr io.Writer) error {
 
 // RunSudo executes a command with sudo
 func (c *Client) RunSudo(command string) (string, error) {
+	return c.RunSudoContext(context.Background(), command)
+}
+
+// RunSudoContext executes a command with sudo, closing the session when ctx is done first
+func (c *Client) RunSudoContext(ctx context.Context, command string) (string, error) {
 	if c.connection == nil {
 		return "", fmt.Errorf("not connected")
 	}
@@ -176,7 +284,7 @@ func (c *Client) RunSudo(command string) (string, error) {
 	}
 	stdin.Close() // Close stdin to signal EOF
 
-	if err := session.Wait(); err != nil {
+	if err := wait(ctx, session, session.Wait); err != nil {
 		return "", fmt.Errorf("command failed: %w, stderr: %s", err, stderr.String())
 	}
 
@@ -199,6 +307,11 @@ func (c *Client) CopyFile(localPath, remotePath string, mode os.FileMode) error
 
 // WriteFile writes content to a remote file
 func (c *Client) WriteFile(remotePath string, content []byte, mode os.FileMode) error {
+	return c.WriteFileContext(context.Background(), remotePath, content, mode)
+}
+
+// WriteFileContext writes content to a remote file, closing the session when ctx is done first
+func (c *Client) WriteFileContext(ctx context.Context, remotePath string, content []byte, mode os.FileMode) error {
 	if c.connection == nil {
 		return fmt.Errorf("not connected")
 	}
@@ -209,20 +322,28 @@ func (c *Client) WriteFile(remotePath string, content []byte, mode os.FileMode)
 	}
 	defer session.Close()
 
+	w, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
 	go func() {
-		w, _ := session.StdinPipe()
 		defer w.Close()
 		fmt.Fprintf(w, "C%04o %d %s\n", mode, len(content), "file")
 		w.Write(content)
 		fmt.Fprint(w, "\x00")
 	}()
 
-	return session.Run(fmt.Sprintf("scp -t %s", remotePath))
+	return wait(ctx, session, func() error { return session.Run(fmt.Sprintf("scp -t %s", remotePath)) })
 }
 
 // ReadFile reads content from a remote file
 func (c *Client) ReadFile(remotePath string) ([]byte, error) {
-	output, err := c.Run(fmt.Sprintf("cat %s", remotePath))
+	return c.ReadFileContext(context.Background(), remotePath)
+}
+
+// ReadFileContext reads content from a remote file, giving up when ctx is done
+func (c *Client) ReadFileContext(ctx context.Context, remotePath string) ([]byte, error) {
+	output, err := c.RunContext(ctx, fmt.Sprintf("cat %s", remotePath))
 	if err != nil {
 		return nil, err
 	}
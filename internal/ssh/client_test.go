@@ -0,0 +1,336 @@
+package ssh_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+)
+
+// passwordConfig returns a config that logs in with the server's password
+// and trusts its host key on first use
+func passwordConfig(t *testing.T, srv *sshtest.Server) *ssh.ServerConfig {
+	t.Helper()
+	return &ssh.ServerConfig{
+		Host:           srv.Host,
+		Port:           srv.Port,
+		User:           srv.User,
+		Password:       srv.Password,
+		AuthMethod:     ssh.AuthPassword,
+		KnownHostsPath: filepath.Join(t.TempDir(), "known_hosts"),
+		HostKeyPrompt:  func(host, fingerprint string) bool { return true },
+	}
+}
+
+// connect opens a client and closes it when the test ends
+func connect(t *testing.T, cfg *ssh.ServerConfig) *ssh.Client {
+	t.Helper()
+	client := ssh.NewClient(cfg)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// generateKey creates an unencrypted ed25519 key pair in a temp directory
+func generateKey(t *testing.T) (string, gossh.PublicKey) {
+	t.Helper()
+	return generateKeyOfType(t, ssh.KeyTypeEd25519)
+}
+
+// generateKeyOfType creates an unencrypted key pair of the given type in a temp directory
+func generateKeyOfType(t *testing.T, keyType ssh.KeyType) (string, gossh.PublicKey) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "id_"+string(keyType))
+	kg := ssh.NewKeyGenerator()
+	if err := kg.GenerateKey(path, ssh.KeyOptions{Type: keyType, Comment: "test"}); err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	pub, err := kg.GetPublicKey(path)
+	if err != nil {
+		t.Fatalf("GetPublicKey: %v", err)
+	}
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(pub))
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKey: %v", err)
+	}
+	return path, key
+}
+
+func TestConnectPassword(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	client := connect(t, passwordConfig(t, srv))
+
+	if !client.IsConnected() {
+		t.Fatal("expected client to be connected")
+	}
+	out, err := client.Run("echo hello && pwd")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if out != "hello\n"+srv.Dir+"\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if err := client.KeepAlive(); err != nil {
+		t.Errorf("KeepAlive: %v", err)
+	}
+}
+
+func TestConnectWrongPassword(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	cfg := passwordConfig(t, srv)
+	cfg.Password = "wrong"
+
+	client := ssh.NewClient(cfg)
+	if err := client.Connect(); err == nil {
+		client.Close()
+		t.Fatal("expected authentication to fail")
+	}
+}
+
+func TestConnectPublicKey(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	keyPath, pub := generateKey(t)
+	if err := srv.AuthorizeKey(pub); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := passwordConfig(t, srv)
+	cfg.Password = ""
+	cfg.AuthMethod = ssh.AuthKey
+	cfg.KeyPath = keyPath
+	client := connect(t, cfg)
+
+	if out, err := client.Run("echo $HOME"); err != nil || strings.TrimSpace(out) != srv.Dir {
+		t.Errorf("Run = %q, %v", out, err)
+	}
+}
+
+func TestConnectUnauthorizedKey(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	keyPath, _ := generateKey(t)
+
+	cfg := passwordConfig(t, srv)
+	cfg.Password = ""
+	cfg.AuthMethod = ssh.AuthKey
+	cfg.KeyPath = keyPath
+
+	client := ssh.NewClient(cfg)
+	if err := client.Connect(); err == nil {
+		client.Close()
+		t.Fatal("expected unauthorized key to be rejected")
+	}
+}
+
+func TestRunError(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	client := connect(t, passwordConfig(t, srv))
+
+	if _, err := client.Run("echo oops >&2; exit 3"); err == nil {
+		t.Fatal("expected non-zero exit status to return an error")
+	} else if !strings.Contains(err.Error(), "oops") {
+		t.Errorf("error should include stderr: %v", err)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	client := connect(t, passwordConfig(t, srv))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.RunContext(ctx, "sleep 2")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("RunContext returned after %s, want right after the deadline", elapsed)
+	}
+
+	// The connection stays usable for further commands
+	if out, err := client.Run("echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("Run after cancel = %q, %v", out, err)
+	}
+}
+
+func TestRunSudo(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	client := connect(t, passwordConfig(t, srv))
+
+	out, err := client.RunSudo(`printf '%s|' 'it'"'"'s quoted' "$HOME"`)
+	if err != nil {
+		t.Fatalf("RunSudo: %v", err)
+	}
+	if out != "it's quoted|"+srv.Dir+"|" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if cmds := srv.Commands(); !strings.HasPrefix(cmds[len(cmds)-1], "sudo -S -p '' bash -c ") {
+		t.Errorf("command not wrapped in sudo: %q", cmds[len(cmds)-1])
+	}
+}
+
+func TestRunSudoWithoutPassword(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	keyPath, pub := generateKey(t)
+	if err := srv.AuthorizeKey(pub); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := passwordConfig(t, srv)
+	cfg.Password = ""
+	cfg.AuthMethod = ssh.AuthKey
+	cfg.KeyPath = keyPath
+	client := connect(t, cfg)
+
+	if _, err := client.RunSudo("true"); err == nil || !strings.Contains(err.Error(), "password is required") {
+		t.Errorf("expected sudo to require a password, got %v", err)
+	}
+
+	srv.NoPasswordSudo = true
+	if out, err := client.RunSudo("echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("RunSudo with NOPASSWD = %q, %v", out, err)
+	}
+}
+
+func TestWriteAndReadFile(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	client := connect(t, passwordConfig(t, srv))
+
+	path := filepath.Join(srv.Dir, "ipsec.conf")
+	content := []byte("config setup\n    uniqueids=no\n\x00binary\n")
+	if err := client.WriteFile(path, content, 0640); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("file not written: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode = %o, want 640", info.Mode().Perm())
+	}
+
+	got, err := client.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("ReadFile = %q, want %q", got, content)
+	}
+
+	if _, err := client.ReadFile(filepath.Join(srv.Dir, "missing")); err == nil {
+		t.Error("expected reading a missing file to fail")
+	}
+}
+
+func TestTestConnection(t *testing.T) {
+	srv := sshtest.NewServer(t)
+
+	if err := ssh.NewClient(passwordConfig(t, srv)).TestConnection(); err != nil {
+		t.Errorf("TestConnection: %v", err)
+	}
+
+	cfg := passwordConfig(t, srv)
+	cfg.Password = "wrong"
+	if err := ssh.NewClient(cfg).TestConnection(); err == nil {
+		t.Error("expected TestConnection to fail with a wrong password")
+	}
+}
+
+func TestHostKeyTrustOnFirstUse(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	cfg := passwordConfig(t, srv)
+
+	prompts := 0
+	cfg.HostKeyPrompt = func(host, fingerprint string) bool {
+		prompts++
+		if fingerprint != gossh.FingerprintSHA256(srv.HostKey) {
+			t.Errorf("prompted with fingerprint %s", fingerprint)
+		}
+		return true
+	}
+
+	connect(t, cfg)
+	connect(t, cfg)
+	if prompts != 1 {
+		t.Errorf("prompted %d times, want 1", prompts)
+	}
+
+	cfg.HostKeyPrompt = func(host, fingerprint string) bool { return false }
+	other := passwordConfig(t, srv)
+	other.HostKeyPrompt = cfg.HostKeyPrompt
+	client := ssh.NewClient(other)
+	if err := client.Connect(); !errors.Is(err, ssh.ErrHostKeyNotTrusted) {
+		client.Close()
+		t.Errorf("expected ErrHostKeyNotTrusted, got %v", err)
+	}
+}
+
+func TestHostKeyChanged(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	cfg := passwordConfig(t, srv)
+
+	// Pretend a different key was stored for this server earlier
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := gossh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr())}, otherKey)
+	if err := os.WriteFile(cfg.KnownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := ssh.NewClient(cfg)
+	err = client.Connect()
+	var changed *ssh.HostKeyChangedError
+	if !errors.As(err, &changed) {
+		client.Close()
+		t.Fatalf("expected HostKeyChangedError, got %v", err)
+	}
+	if changed.Fingerprint != gossh.FingerprintSHA256(srv.HostKey) {
+		t.Errorf("error reports fingerprint %s", changed.Fingerprint)
+	}
+}
+
+func TestConnectThroughJumpHost(t *testing.T) {
+	jump := sshtest.NewServer(t)
+	target := sshtest.NewServer(t)
+
+	cfg := passwordConfig(t, target)
+	cfg.JumpHost = &ssh.ServerConfig{
+		Host:       jump.Host,
+		Port:       jump.Port,
+		User:       jump.User,
+		Password:   jump.Password,
+		AuthMethod: ssh.AuthPassword,
+	}
+	client := connect(t, cfg)
+
+	out, err := client.Run("pwd")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if strings.TrimSpace(out) != target.Dir {
+		t.Errorf("command ran in %q, want target %q", out, target.Dir)
+	}
+	if len(jump.Commands()) != 0 {
+		t.Errorf("jump host should only forward, ran %v", jump.Commands())
+	}
+}
@@ -0,0 +1,41 @@
+package ssh
+
+import (
+	"context"
+	"os"
+)
+
+// Executor runs commands and transfers files on a server.
+// Client implements it over SSH; tests use the scripted fake in package sshtest.
+type Executor interface {
+	Run(command string) (string, error)
+	RunSudo(command string) (string, error)
+	// RunContext and RunSudoContext give up on the command when ctx is done
+	RunContext(ctx context.Context, command string) (string, error)
+	RunSudoContext(ctx context.Context, command string) (string, error)
+	ReadFile(remotePath string) ([]byte, error)
+	WriteFile(remotePath string, content []byte, mode os.FileMode) error
+	// ReadFileContext and WriteFileContext give up on the transfer when ctx is done
+	ReadFileContext(ctx context.Context, remotePath string) ([]byte, error)
+	WriteFileContext(ctx context.Context, remotePath string, content []byte, mode os.FileMode) error
+}
+
+var _ Executor = (*Client)(nil)
+
+// Dial connects a new Client to the server described by config
+func Dial(config *ServerConfig) (Executor, error) {
+	client := NewClient(config)
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// EnsureConnected connects exec first if it is a Client that is not connected yet
+func EnsureConnected(exec Executor) error {
+	c, ok := exec.(*Client)
+	if !ok || c.IsConnected() {
+		return nil
+	}
+	return c.Connect()
+}
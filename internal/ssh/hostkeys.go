@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyPrompt asks the user whether to trust a host key seen for the first time.
+// It receives the host address and the SHA256 fingerprint of the presented key.
+type HostKeyPrompt func(host, fingerprint string) bool
+
+// ErrHostKeyNotTrusted is returned when an unknown host key was not accepted
+var ErrHostKeyNotTrusted = errors.New("host key not trusted")
+
+// HostKeyChangedError is returned when a server presents a key that differs
+// from the one stored in known_hosts
+type HostKeyChangedError struct {
+	Host           string
+	Fingerprint    string
+	KnownHostsPath string
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("host key for %s has changed (server presented %s): possible man-in-the-middle attack, refusing to connect. "+
+		"If the server was reinstalled, remove its entry from %s", e.Host, e.Fingerprint, e.KnownHostsPath)
+}
+
+// knownHostsMu serializes writes to known_hosts files
+var knownHostsMu sync.Mutex
+
+// hostKeyCallback builds a callback that verifies host keys against the
+// known_hosts file at path, asking prompt about hosts that are not yet known
+func hostKeyCallback(path string, prompt HostKeyPrompt) (ssh.HostKeyCallback, error) {
+	if path == "" {
+		return nil, fmt.Errorf("host key verification is not configured: no known_hosts path")
+	}
+	if err := ensureKnownHostsFile(path); err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		check, err := knownhosts.New(path)
+		knownHostsMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to read known_hosts: %w", err)
+		}
+
+		err = check(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return &HostKeyChangedError{Host: hostname, Fingerprint: fingerprint, KnownHostsPath: path}
+		}
+
+		// Unknown host: trust on first use if the user agrees
+		if prompt == nil || !prompt(hostname, fingerprint) {
+			return fmt.Errorf("%w: %s (%s)", ErrHostKeyNotTrusted, hostname, fingerprint)
+		}
+
+		return addKnownHost(path, hostname, key)
+	}, nil
+}
+
+// knownHostAlgorithms returns the host key algorithms matching the keys stored
+// for addr, so the server is asked for a key type we can actually verify
+func knownHostAlgorithms(path, addr string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	normalized := knownhosts.Normalize(addr)
+	var algos []string
+	for len(data) > 0 {
+		_, hosts, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err != nil {
+			break
+		}
+		data = rest
+		for _, h := range hosts {
+			if h == normalized {
+				algos = append(algos, algorithmsForKeyType(key.Type())...)
+				break
+			}
+		}
+	}
+	return algos
+}
+
+func algorithmsForKeyType(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+func ensureKnownHostsFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create known_hosts directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts: %w", err)
+	}
+	return f.Close()
+}
+
+func addKnownHost(path, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts: %w", err)
+	}
+	defer f.Close()
+
+	var line bytes.Buffer
+	line.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	line.WriteByte('\n')
+	if _, err := f.Write(line.Bytes()); err != nil {
+		return fmt.Errorf("failed to write known_hosts: %w", err)
+	}
+	return nil
+}
@@ -1,9 +1,14 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"os"
@@ -14,9 +19,28 @@ import (
 )
 
 const (
-	keyBits = 4096
+	rsaKeyBits = 4096
 )
 
+// KeyType selects the algorithm of a generated SSH key
+type KeyType string
+
+const (
+	KeyTypeEd25519   KeyType = "ed25519"
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+	KeyTypeRSA4096   KeyType = "rsa-4096"
+)
+
+// KeyTypes lists the supported key types, default first
+var KeyTypes = []KeyType{KeyTypeEd25519, KeyTypeECDSAP256, KeyTypeRSA4096}
+
+// KeyOptions controls SSH key generation
+type KeyOptions struct {
+	Type       KeyType // Defaults to ed25519
+	Passphrase []byte  // Optional; encrypts the private key
+	Comment    string  // Stored in the private key and appended to the public key
+}
+
 // KeyGenerator handles SSH key generation and management
 type KeyGenerator struct{}
 
@@ -25,25 +49,29 @@ func NewKeyGenerator() *KeyGenerator {
 	return &KeyGenerator{}
 }
 
-// GenerateKey generates a new RSA SSH key pair
-// Returns the path to the private key
-func (kg *KeyGenerator) GenerateKey(keyPath string) error {
+// GenerateKey generates a new SSH key pair in OpenSSH format.
+// The private key is written to keyPath and the public key to keyPath + ".pub".
+func (kg *KeyGenerator) GenerateKey(keyPath string, opts KeyOptions) error {
 	// Ensure directory exists
 	dir := filepath.Dir(keyPath)
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return fmt.Errorf("failed to create key directory: %w", err)
 	}
 
-	// Generate RSA key
-	privateKey, err := rsa.GenerateKey(rand.Reader, keyBits)
+	privateKey, err := generatePrivateKey(opts.Type)
 	if err != nil {
-		return fmt.Errorf("failed to generate RSA key: %w", err)
+		return err
 	}
 
-	// Save private key in PEM format
-	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	// Save private key in OpenSSH format
+	var privateKeyPEM *pem.Block
+	if len(opts.Passphrase) > 0 {
+		privateKeyPEM, err = ssh.MarshalPrivateKeyWithPassphrase(privateKey, opts.Comment, opts.Passphrase)
+	} else {
+		privateKeyPEM, err = ssh.MarshalPrivateKey(privateKey, opts.Comment)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
 	}
 
 	privateFile, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
@@ -57,22 +85,50 @@ func (kg *KeyGenerator) GenerateKey(keyPath string) error {
 	}
 
 	// Generate public key
-	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	signer, err := ssh.NewSignerFromKey(privateKey)
 	if err != nil {
 		return fmt.Errorf("failed to generate public key: %w", err)
 	}
 
 	// Save public key
 	publicKeyPath := keyPath + ".pub"
-	publicKeyBytes := ssh.MarshalAuthorizedKey(publicKey)
+	publicKeyLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	if opts.Comment != "" {
+		publicKeyLine += " " + opts.Comment
+	}
 
-	if err := os.WriteFile(publicKeyPath, publicKeyBytes, 0644); err != nil {
+	if err := os.WriteFile(publicKeyPath, []byte(publicKeyLine+"\n"), 0644); err != nil {
 		return fmt.Errorf("failed to write public key: %w", err)
 	}
 
 	return nil
 }
 
+func generatePrivateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeEd25519, "":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate Ed25519 key: %w", err)
+		}
+		return key, nil
+	case KeyTypeECDSAP256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+		}
+		return key, nil
+	case KeyTypeRSA4096:
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", keyType)
+	}
+}
+
 // KeyExists checks if SSH key already exists
 func (kg *KeyGenerator) KeyExists(keyPath string) bool {
 	_, err := os.Stat(keyPath)
@@ -90,11 +146,9 @@ func (kg *KeyGenerator) GetPublicKey(keyPath string) (string, error) {
 }
 
 // CopyKeyToServer adds the public key to the server's authorized_keys
-func (kg *KeyGenerator) CopyKeyToServer(client *Client, publicKey string) error {
-	if !client.IsConnected() {
-		if err := client.Connect(); err != nil {
-			return fmt.Errorf("failed to connect: %w", err)
-		}
+func (kg *KeyGenerator) CopyKeyToServer(client Executor, publicKey string) error {
+	if err := EnsureConnected(client); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
 	}
 
 	// Get the remote user's home directory
@@ -129,12 +183,16 @@ func (kg *KeyGenerator) CopyKeyToServer(client *Client, publicKey string) error
 	return nil
 }
 
-// RemoveKeyFromServer removes the public key from the server's authorized_keys
-func (kg *KeyGenerator) RemoveKeyFromServer(client *Client, publicKey string) error {
-	if !client.IsConnected() {
-		if err := client.Connect(); err != nil {
-			return fmt.Errorf("failed to connect: %w", err)
-		}
+// RemoveKeyFromServer removes the public key from the server's authorized_keys.
+// Only lines holding exactly this key are removed; options and comments are ignored when matching.
+func (kg *KeyGenerator) RemoveKeyFromServer(client Executor, publicKey string) error {
+	if err := EnsureConnected(client); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+
+	target, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
 	}
 
 	// Get the remote user's home directory
@@ -145,13 +203,44 @@ func (kg *KeyGenerator) RemoveKeyFromServer(client *Client, publicKey string) er
 	homeDir = strings.TrimSpace(homeDir)
 
 	authKeysPath := homeDir + "/.ssh/authorized_keys"
-
-	// Create a temp file without the key and replace
-	escapedKey := strings.ReplaceAll(publicKey, "/", "\\/")
-	_, err = client.Run(fmt.Sprintf("sed -i '/%s/d' %s 2>/dev/null || true", escapedKey[:50], authKeysPath))
+	existingKeys, err := client.Run(fmt.Sprintf("cat %s 2>/dev/null || true", authKeysPath))
 	if err != nil {
+		return fmt.Errorf("failed to read authorized_keys: %w", err)
+	}
+
+	kept, removed := filterAuthorizedKeys(existingKeys, target)
+	if removed == 0 {
+		return nil // Key not present
+	}
+
+	// Write the filtered file next to the original and swap it in atomically
+	encoded := base64.StdEncoding.EncodeToString([]byte(kept))
+	cmd := fmt.Sprintf("echo '%s' | base64 -d > %s.tmp && chmod 600 %s.tmp && mv %s.tmp %s",
+		encoded, authKeysPath, authKeysPath, authKeysPath, authKeysPath)
+	if _, err := client.Run(cmd); err != nil {
 		return fmt.Errorf("failed to remove key from authorized_keys: %w", err)
 	}
 
 	return nil
 }
+
+// filterAuthorizedKeys drops every authorized_keys line holding target and
+// returns the remaining content with the number of removed lines
+func filterAuthorizedKeys(content string, target ssh.PublicKey) (string, int) {
+	var kept []string
+	removed := 0
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil && bytes.Equal(key.Marshal(), target.Marshal()) {
+			removed++
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	result := strings.Join(kept, "\n")
+	if result != "" {
+		result += "\n"
+	}
+	return result, removed
+}
@@ -0,0 +1,273 @@
+package ssh_test
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+)
+
+func TestCopyKeyToServer(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	keyPath, _ := generateKey(t)
+	kg := ssh.NewKeyGenerator()
+	pub, err := kg.GetPublicKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CopyKeyToServer connects on its own if needed
+	client := ssh.NewClient(passwordConfig(t, srv))
+	defer client.Close()
+	if err := kg.CopyKeyToServer(client, pub); err != nil {
+		t.Fatalf("CopyKeyToServer: %v", err)
+	}
+	// Copying again must not duplicate the key
+	if err := kg.CopyKeyToServer(client, pub); err != nil {
+		t.Fatalf("CopyKeyToServer (again): %v", err)
+	}
+
+	authKeysPath := filepath.Join(srv.Dir, ".ssh", "authorized_keys")
+	data, err := os.ReadFile(authKeysPath)
+	if err != nil {
+		t.Fatalf("authorized_keys not created: %v", err)
+	}
+	if n := strings.Count(string(data), strings.TrimSpace(pub)); n != 1 {
+		t.Errorf("key present %d times, want 1", n)
+	}
+	info, _ := os.Stat(authKeysPath)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("authorized_keys mode = %o, want 600", info.Mode().Perm())
+	}
+
+	// The installed key now works on its own
+	cfg := passwordConfig(t, srv)
+	cfg.Password = ""
+	cfg.AuthMethod = ssh.AuthKey
+	cfg.KeyPath = keyPath
+	if err := ssh.NewClient(cfg).TestConnection(); err != nil {
+		t.Errorf("key login after CopyKeyToServer failed: %v", err)
+	}
+}
+
+func TestRemoveKeyFromServer(t *testing.T) {
+	srv := sshtest.NewServer(t)
+	keepPath, keep := generateKey(t)
+	_, remove := generateKey(t)
+	if err := srv.AuthorizeKey(keep); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AuthorizeKey(remove); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same key with options and another comment must match too
+	authKeysPath := filepath.Join(srv.Dir, ".ssh", "authorized_keys")
+	f, err := os.OpenFile(authKeysPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("no-pty " + strings.TrimSpace(string(gossh.MarshalAuthorizedKey(remove))) + " old-laptop\n")
+	f.Close()
+
+	client := connect(t, passwordConfig(t, srv))
+	kg := ssh.NewKeyGenerator()
+	if err := kg.RemoveKeyFromServer(client, string(gossh.MarshalAuthorizedKey(remove))); err != nil {
+		t.Fatalf("RemoveKeyFromServer: %v", err)
+	}
+
+	data, err := os.ReadFile(authKeysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	if strings.Contains(content, strings.TrimSpace(string(gossh.MarshalAuthorizedKey(remove)))) {
+		t.Errorf("removed key still present:\n%s", content)
+	}
+	if strings.Count(content, "\n") != 1 {
+		t.Errorf("expected exactly the kept key to remain:\n%s", content)
+	}
+
+	cfg := passwordConfig(t, srv)
+	cfg.Password = ""
+	cfg.AuthMethod = ssh.AuthKey
+	cfg.KeyPath = keepPath
+	if err := ssh.NewClient(cfg).TestConnection(); err != nil {
+		t.Errorf("remaining key no longer works: %v", err)
+	}
+}
+
+// keyConfig returns a config that logs in to srv with the key at keyPath only
+func keyConfig(t *testing.T, srv *sshtest.Server, keyPath string) *ssh.ServerConfig {
+	t.Helper()
+	cfg := passwordConfig(t, srv)
+	cfg.Password = ""
+	cfg.AuthMethod = ssh.AuthKey
+	cfg.KeyPath = keyPath
+	return cfg
+}
+
+// rotationServers starts two servers that authorize oldKey and returns them
+// with their rotation targets
+func rotationServers(t *testing.T, oldPath string, oldKey gossh.PublicKey) ([]*sshtest.Server, []ssh.RotationTarget) {
+	t.Helper()
+	var servers []*sshtest.Server
+	var targets []ssh.RotationTarget
+	for i := 1; i <= 2; i++ {
+		srv := sshtest.NewServer(t)
+		if err := srv.AuthorizeKey(oldKey); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, srv)
+		targets = append(targets, ssh.RotationTarget{Name: fmt.Sprintf("Server %d", i), Config: keyConfig(t, srv, oldPath)})
+	}
+	return servers, targets
+}
+
+func authorizedKeys(t *testing.T, srv *sshtest.Server) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(srv.Dir, ".ssh", "authorized_keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotateKey(t *testing.T) {
+	oldPath, oldKey := generateKeyOfType(t, ssh.KeyTypeECDSAP256)
+	servers, targets := rotationServers(t, oldPath, oldKey)
+	newPath := filepath.Join(t.TempDir(), "tunnelmanager_ed25519")
+
+	kg := ssh.NewKeyGenerator()
+	if err := kg.RotateKey(targets, newPath, ssh.KeyOptions{Type: ssh.KeyTypeEd25519, Comment: "rotated"}, t.Logf); err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+
+	if !kg.KeyExists(newPath) || !kg.KeyExists(newPath+".pub") {
+		t.Fatal("new key files not written")
+	}
+	newPub, err := kg.GetPublicKey(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLine := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(oldKey)))
+	for i, srv := range servers {
+		keys := authorizedKeys(t, srv)
+		if strings.Contains(keys, oldLine) || !strings.Contains(keys, newPub) {
+			t.Errorf("Server %d authorized_keys after rotation:\n%s", i+1, keys)
+		}
+		if err := ssh.NewClient(keyConfig(t, srv, newPath)).TestConnection(); err != nil {
+			t.Errorf("Server %d: login with the new key failed: %v", i+1, err)
+		}
+		if err := ssh.NewClient(keyConfig(t, srv, oldPath)).TestConnection(); err == nil {
+			t.Errorf("Server %d: old key still logs in", i+1)
+		}
+	}
+}
+
+func TestRotateKeyRollback(t *testing.T) {
+	oldPath, oldKey := generateKeyOfType(t, ssh.KeyTypeECDSAP256)
+	servers, targets := rotationServers(t, oldPath, oldKey)
+	// The second server refuses the type of the new key, as sshd does with
+	// a restrictive PubkeyAcceptedAlgorithms
+	servers[1].KeyAlgorithms = []string{gossh.KeyAlgoECDSA256}
+	original := []string{authorizedKeys(t, servers[0]), authorizedKeys(t, servers[1])}
+	newPath := filepath.Join(t.TempDir(), "tunnelmanager_ed25519")
+
+	kg := ssh.NewKeyGenerator()
+	err := kg.RotateKey(targets, newPath, ssh.KeyOptions{Type: ssh.KeyTypeEd25519}, t.Logf)
+	if err == nil || !strings.Contains(err.Error(), "login with new key failed on Server 2") {
+		t.Fatalf("RotateKey error = %v, want a failed login on Server 2", err)
+	}
+
+	for i, srv := range servers {
+		if keys := authorizedKeys(t, srv); keys != original[i] {
+			t.Errorf("Server %d authorized_keys not restored:\n%s\nwant:\n%s", i+1, keys, original[i])
+		}
+		if err := ssh.NewClient(keyConfig(t, srv, oldPath)).TestConnection(); err != nil {
+			t.Errorf("Server %d: old key no longer logs in: %v", i+1, err)
+		}
+	}
+	if kg.KeyExists(newPath) || kg.KeyExists(newPath+".pub") {
+		t.Error("new key files not deleted")
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	tests := []struct {
+		keyType    ssh.KeyType
+		passphrase string
+		comment    string
+		want       string // Public key type
+	}{
+		{ssh.KeyTypeEd25519, "", "alice@laptop", gossh.KeyAlgoED25519},
+		{ssh.KeyTypeECDSAP256, "", "", gossh.KeyAlgoECDSA256},
+		{ssh.KeyTypeRSA4096, "", "rsa", gossh.KeyAlgoRSA},
+		{ssh.KeyTypeEd25519, "correct horse", "encrypted", gossh.KeyAlgoED25519},
+		{ssh.KeyTypeECDSAP256, "correct horse", "", gossh.KeyAlgoECDSA256},
+		{"", "", "default", gossh.KeyAlgoED25519},
+	}
+	kg := ssh.NewKeyGenerator()
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s/%q/%q", tt.keyType, tt.passphrase, tt.comment)
+		path := filepath.Join(t.TempDir(), "key")
+		if err := kg.GenerateKey(path, ssh.KeyOptions{Type: tt.keyType, Passphrase: []byte(tt.passphrase), Comment: tt.comment}); err != nil {
+			t.Fatalf("%s: GenerateKey: %v", name, err)
+		}
+
+		private, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		} else if info.Mode().Perm() != 0600 {
+			t.Errorf("%s: private key mode = %o, want 600", name, info.Mode().Perm())
+		}
+		var raw interface{}
+		if tt.passphrase != "" {
+			if _, err := gossh.ParseRawPrivateKey(private); !errors.As(err, new(*gossh.PassphraseMissingError)) {
+				t.Errorf("%s: key readable without the passphrase: %v", name, err)
+			}
+			raw, err = gossh.ParseRawPrivateKeyWithPassphrase(private, []byte(tt.passphrase))
+		} else {
+			raw, err = gossh.ParseRawPrivateKey(private)
+		}
+		if err != nil {
+			t.Fatalf("%s: parsing private key: %v", name, err)
+		}
+		signer, err := gossh.NewSignerFromKey(raw)
+		if err != nil {
+			t.Fatalf("%s: NewSignerFromKey: %v", name, err)
+		}
+
+		line, err := os.ReadFile(path + ".pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, comment, _, _, err := gossh.ParseAuthorizedKey(line)
+		if err != nil {
+			t.Fatalf("%s: parsing public key %q: %v", name, line, err)
+		}
+		if pub.Type() != tt.want || comment != tt.comment {
+			t.Errorf("%s: public key is %s %q, want %s %q", name, pub.Type(), comment, tt.want, tt.comment)
+		}
+		if !bytes.Equal(pub.Marshal(), signer.PublicKey().Marshal()) {
+			t.Errorf("%s: public key does not match the private key", name)
+		}
+		if tt.keyType == ssh.KeyTypeRSA4096 {
+			if bits := raw.(*rsa.PrivateKey).N.BitLen(); bits != 4096 {
+				t.Errorf("%s: RSA key has %d bits, want 4096", name, bits)
+			}
+		}
+	}
+}
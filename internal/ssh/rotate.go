@@ -0,0 +1,162 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+)
+
+// RotationTarget is a server whose login key is rotated
+type RotationTarget struct {
+	Name   string
+	Config *ServerConfig
+}
+
+// RotateKey replaces the login key on every target server.
+// It generates a new key at newKeyPath, installs it everywhere, verifies that
+// each server accepts a login with it, and only then removes the old public key
+// (read from each target's KeyPath + ".pub"). If any step fails, all servers are
+// rolled back to their previous authorized_keys and the new key files are deleted.
+// The caller is responsible for saving newKeyPath to its configuration afterwards.
+func (kg *KeyGenerator) RotateKey(targets []RotationTarget, newKeyPath string, opts KeyOptions, logf func(format string, args ...interface{})) error {
+	for _, t := range targets {
+		if t.Config.KeyPath == newKeyPath {
+			return fmt.Errorf("%s already uses %s; choose a different path for the new key", t.Name, newKeyPath)
+		}
+	}
+
+	logf("Generating new %s key at %s...", opts.Type, newKeyPath)
+	if err := kg.GenerateKey(newKeyPath, opts); err != nil {
+		return err
+	}
+	newPub, err := kg.GetPublicKey(newKeyPath)
+	if err != nil {
+		removeKeyFiles(newKeyPath)
+		return err
+	}
+
+	r := &rotation{kg: kg, newKeyPath: newKeyPath, newPub: newPub, opts: opts, logf: logf}
+	if err := r.run(targets); err != nil {
+		r.rollback()
+		return err
+	}
+	return nil
+}
+
+type rotation struct {
+	kg         *KeyGenerator
+	newKeyPath string
+	newPub     string
+	opts       KeyOptions
+	logf       func(format string, args ...interface{})
+
+	installed []RotationTarget   // servers that have the new key
+	removed   map[string]string  // server name -> old public key removed from it
+	clients   map[string]*Client // connections authenticated with the new key
+}
+
+func (r *rotation) run(targets []RotationTarget) error {
+	r.removed = make(map[string]string)
+	r.clients = make(map[string]*Client)
+	defer func() {
+		for _, c := range r.clients {
+			c.Close()
+		}
+	}()
+
+	// Step 1: install the new key using the current credentials
+	for _, t := range targets {
+		r.logf("[%s] Installing new key...", t.Name)
+		client := NewClient(t.Config)
+		err := r.kg.CopyKeyToServer(client, r.newPub)
+		client.Close()
+		if err != nil {
+			return fmt.Errorf("failed to install new key on %s: %w", t.Name, err)
+		}
+		r.installed = append(r.installed, t)
+	}
+
+	// Step 2: check that every server accepts the new key on its own
+	for _, t := range targets {
+		r.logf("[%s] Verifying login with new key...", t.Name)
+		client := NewClient(r.newKeyConfig(t.Config))
+		if err := client.Connect(); err != nil {
+			return fmt.Errorf("login with new key failed on %s: %w", t.Name, err)
+		}
+		if _, err := client.Run("true"); err != nil {
+			client.Close()
+			return fmt.Errorf("login with new key failed on %s: %w", t.Name, err)
+		}
+		r.clients[t.Name] = client
+	}
+
+	// Step 3: remove the old public keys
+	for _, t := range targets {
+		if t.Config.KeyPath == "" {
+			continue
+		}
+		oldPub, err := r.kg.GetPublicKey(t.Config.KeyPath)
+		if err != nil {
+			r.logf("[%s] Old public key not found locally, leaving authorized_keys as is", t.Name)
+			continue
+		}
+		if oldPub == r.newPub {
+			continue
+		}
+		r.logf("[%s] Removing old key...", t.Name)
+		if err := r.kg.RemoveKeyFromServer(r.clients[t.Name], oldPub); err != nil {
+			return fmt.Errorf("failed to remove old key from %s: %w", t.Name, err)
+		}
+		r.removed[t.Name] = oldPub
+	}
+
+	return nil
+}
+
+// rollback restores the old keys and removes the new one from every server it reached
+func (r *rotation) rollback() {
+	r.logf("Key rotation failed, rolling back...")
+
+	for _, t := range r.installed {
+		oldPub, removed := r.removed[t.Name]
+		config := t.Config
+		if removed {
+			// The old key is gone, so connect with the new one to put it back
+			config = r.newKeyConfig(t.Config)
+		}
+
+		client := NewClient(config)
+		if removed {
+			if err := r.kg.CopyKeyToServer(client, oldPub); err != nil {
+				r.logf("[%s] Rollback: failed to restore old key: %v", t.Name, err)
+				client.Close()
+				continue
+			}
+		}
+		if err := r.kg.RemoveKeyFromServer(client, r.newPub); err != nil {
+			r.logf("[%s] Rollback: failed to remove new key: %v", t.Name, err)
+		} else {
+			r.logf("[%s] Rolled back", t.Name)
+		}
+		client.Close()
+	}
+
+	removeKeyFiles(r.newKeyPath)
+}
+
+// newKeyConfig returns a copy of cfg that authenticates with the new key only
+func (r *rotation) newKeyConfig(cfg *ServerConfig) *ServerConfig {
+	c := *cfg
+	c.KeyPath = r.newKeyPath
+	c.KeyContent = nil
+	c.Password = ""
+	c.AuthMethod = AuthKey
+	c.PassphrasePrompt = func(string) ([]byte, error) {
+		return r.opts.Passphrase, nil
+	}
+	return &c
+}
+
+func removeKeyFiles(keyPath string) {
+	os.Remove(keyPath)
+	os.Remove(keyPath + ".pub")
+}
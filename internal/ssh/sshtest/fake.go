@@ -0,0 +1,198 @@
+// Package sshtest provides test doubles for the ssh package.
+package sshtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+)
+
+// Call is one command or file operation received by a Fake
+type Call struct {
+	Command string // Command as passed to Run or RunSudo
+	Sudo    bool   // Run through RunSudo
+	Path    string // File path for ReadFile/WriteFile
+	Content []byte // Written content for WriteFile
+}
+
+// response is a canned result for commands containing match
+type response struct {
+	match  string
+	output string
+	err    error
+	hang   bool // Block until the context of the call is done
+}
+
+// Fake is a scripted ssh.Executor. It records every call and answers
+// commands with canned outputs registered via On and Fail; commands
+// without a matching response succeed with empty output.
+type Fake struct {
+	mu        sync.Mutex
+	calls     []Call
+	responses []response
+	files     map[string][]byte
+}
+
+var _ ssh.Executor = (*Fake)(nil)
+
+// NewFake creates a Fake with no canned responses
+func NewFake() *Fake {
+	return &Fake{files: make(map[string][]byte)}
+}
+
+// On answers commands containing match with output.
+// Later registrations take precedence over earlier ones.
+func (f *Fake) On(match, output string) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, response{match: match, output: output})
+	return f
+}
+
+// Fail makes commands containing match return err
+func (f *Fake) Fail(match string, err error) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, response{match: match, err: err})
+	return f
+}
+
+// Hang makes commands containing match block until their context is done,
+// like a command waiting for a lock; without a context they block forever
+func (f *Fake) Hang(match string) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, response{match: match, hang: true})
+	return f
+}
+
+// SetFile sets the content returned by ReadFile for path
+func (f *Fake) SetFile(path, content string) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[path] = []byte(content)
+	return f
+}
+
+// Run implements ssh.Executor
+func (f *Fake) Run(command string) (string, error) {
+	return f.exec(context.Background(), Call{Command: command})
+}
+
+// RunSudo implements ssh.Executor
+func (f *Fake) RunSudo(command string) (string, error) {
+	return f.exec(context.Background(), Call{Command: command, Sudo: true})
+}
+
+// RunContext implements ssh.Executor
+func (f *Fake) RunContext(ctx context.Context, command string) (string, error) {
+	return f.exec(ctx, Call{Command: command})
+}
+
+// RunSudoContext implements ssh.Executor
+func (f *Fake) RunSudoContext(ctx context.Context, command string) (string, error) {
+	return f.exec(ctx, Call{Command: command, Sudo: true})
+}
+
+func (f *Fake) exec(ctx context.Context, call Call) (string, error) {
+	r := f.record(call)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if r.hang {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return r.output, r.err
+}
+
+// record adds call and returns the response for it
+func (f *Fake) record(call Call) response {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+
+	for i := len(f.responses) - 1; i >= 0; i-- {
+		r := f.responses[i]
+		if strings.Contains(call.Command, r.match) {
+			return r
+		}
+	}
+	return response{}
+}
+
+// ReadFile implements ssh.Executor
+func (f *Fake) ReadFile(remotePath string) ([]byte, error) {
+	return f.ReadFileContext(context.Background(), remotePath)
+}
+
+// ReadFileContext implements ssh.Executor
+func (f *Fake) ReadFileContext(ctx context.Context, remotePath string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, Call{Path: remotePath})
+
+	content, ok := f.files[remotePath]
+	if !ok {
+		return nil, fmt.Errorf("cat %s: %w", remotePath, os.ErrNotExist)
+	}
+	return content, nil
+}
+
+// WriteFile implements ssh.Executor
+func (f *Fake) WriteFile(remotePath string, content []byte, mode os.FileMode) error {
+	return f.WriteFileContext(context.Background(), remotePath, content, mode)
+}
+
+// WriteFileContext implements ssh.Executor
+func (f *Fake) WriteFileContext(ctx context.Context, remotePath string, content []byte, mode os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, Call{Path: remotePath, Content: content})
+	f.files[remotePath] = content
+	return nil
+}
+
+// Calls returns all calls received so far, in order
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// Commands returns the commands received so far, in order
+func (f *Fake) Commands() []string {
+	var commands []string
+	for _, c := range f.Calls() {
+		if c.Command != "" {
+			commands = append(commands, c.Command)
+		}
+	}
+	return commands
+}
+
+// Index returns the position in Commands of the first command containing
+// match, or -1 if no command matched
+func (f *Fake) Index(match string) int {
+	for i, c := range f.Commands() {
+		if strings.Contains(c, match) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Ran reports whether any command contained match
+func (f *Fake) Ran(match string) bool {
+	return f.Index(match) >= 0
+}
@@ -0,0 +1,384 @@
+package sshtest
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sudoPrefix is how ssh.Client.RunSudo wraps commands
+const sudoPrefix = "sudo -S -p '' "
+
+// Server is an in-process SSH server for tests. Commands run through bash
+// in Dir, which is also the user's home directory, so nothing outside the
+// test's temp directory is touched. It supports password and public key
+// auth (keys are read from Dir/.ssh/authorized_keys on every login), the
+// scp sink protocol used by ssh.Client.WriteFile, a sudo emulation matching
+// ssh.Client.RunSudo, and direct-tcpip channels for jump host tests.
+type Server struct {
+	Host     string
+	Port     int
+	User     string
+	Password string // Accepted login and sudo password; empty disables password auth
+	Dir      string // Home and working directory for commands
+
+	// NoPasswordSudo accepts sudo without reading a password, like NOPASSWD in sudoers
+	NoPasswordSudo bool
+
+	// KeyAlgorithms limits public key auth to these key types, like
+	// PubkeyAcceptedAlgorithms in sshd_config; empty accepts all
+	KeyAlgorithms []string
+
+	// HostKey is the server's public host key
+	HostKey ssh.PublicKey
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	commands []string
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// NewServer starts a server on a random loopback port and stops it when the test ends.
+// It accepts user "test" with password "secret".
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is required for the test SSH server")
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create host key signer: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	s := &Server{
+		Host:     "127.0.0.1",
+		Port:     ln.Addr().(*net.TCPAddr).Port,
+		User:     "test",
+		Password: "secret",
+		Dir:      t.TempDir(),
+		HostKey:  signer.PublicKey(),
+		listener: ln,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback:  s.checkPassword,
+		PublicKeyCallback: s.checkPublicKey,
+	}
+	s.config.AddHostKey(signer)
+
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// AuthorizeKey appends a public key to the user's authorized_keys
+func (s *Server) AuthorizeKey(key ssh.PublicKey) error {
+	sshDir := filepath.Join(s.Dir, ".ssh")
+	if err := os.MkdirAll(sshDir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(sshDir, "authorized_keys"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(ssh.MarshalAuthorizedKey(key))
+	return err
+}
+
+// Commands returns the commands executed so far, in order
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Close stops the server and drops open connections
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if s.Password != "" && conn.User() == s.User && string(password) == s.Password {
+		return nil, nil
+	}
+	return nil, errors.New("invalid credentials")
+}
+
+func (s *Server) checkPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if conn.User() != s.User {
+		return nil, errors.New("unknown user")
+	}
+	if len(s.KeyAlgorithms) > 0 && !slices.Contains(s.KeyAlgorithms, key.Type()) {
+		return nil, fmt.Errorf("key type %s not accepted", key.Type())
+	}
+	data, err := os.ReadFile(filepath.Join(s.Dir, ".ssh", "authorized_keys"))
+	if err != nil {
+		return nil, errors.New("no authorized keys")
+	}
+	for len(data) > 0 {
+		authorized, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		if string(authorized.Marshal()) == string(key.Marshal()) {
+			return nil, nil
+		}
+		data = rest
+	}
+	return nil, errors.New("key not authorized")
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Server) handleConn(netConn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		netConn.Close()
+		return
+	}
+	s.conns[netConn] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, netConn)
+		s.mu.Unlock()
+		netConn.Close()
+	}()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			ch, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handleSession(ch, requests)
+			}()
+		case "direct-tcpip":
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handleDirectTCPIP(newChannel)
+			}()
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+	wg.Wait()
+}
+
+func (s *Server) handleSession(ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+
+		s.mu.Lock()
+		s.commands = append(s.commands, payload.Command)
+		s.mu.Unlock()
+
+		status := s.exec(ch, payload.Command)
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// exec runs a command on the session and returns its exit status
+func (s *Server) exec(ch ssh.Channel, command string) uint32 {
+	stdin := bufio.NewReader(ch)
+
+	if path, ok := strings.CutPrefix(command, "scp -t "); ok {
+		if err := s.scpSink(stdin, path); err != nil {
+			fmt.Fprintf(ch.Stderr(), "scp: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if rest, ok := strings.CutPrefix(command, sudoPrefix); ok {
+		if !s.NoPasswordSudo {
+			password, err := stdin.ReadString('\n')
+			if err != nil || strings.TrimSuffix(password, "\n") != s.Password || s.Password == "" {
+				fmt.Fprintln(ch.Stderr(), "sudo: a password is required")
+				return 1
+			}
+		}
+		command = rest
+	}
+
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Dir = s.Dir
+	cmd.Env = append(os.Environ(), "HOME="+s.Dir)
+	cmd.Stdin = stdin
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return uint32(exitErr.ExitCode())
+		}
+		fmt.Fprintln(ch.Stderr(), err)
+		return 127
+	}
+	return 0
+}
+
+// scpSink receives a single file the way "scp -t" does
+func (s *Server) scpSink(r *bufio.Reader, path string) error {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+
+	// C<mode> <size> <name>
+	fields := strings.SplitN(strings.TrimSuffix(header, "\n"), " ", 3)
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "C") {
+		return fmt.Errorf("invalid header %q", header)
+	}
+	mode, err := strconv.ParseUint(fields[0][1:], 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode %q", fields[0])
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", fields[1])
+	}
+
+	content := make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return fmt.Errorf("failed to read content: %w", err)
+	}
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return errors.New("missing end of file marker")
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.Dir, path)
+	}
+	return os.WriteFile(path, content, os.FileMode(mode))
+}
+
+// handleDirectTCPIP forwards a connection, as a jump host does for ProxyJump
+func (s *Server) handleDirectTCPIP(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer target.Close()
+
+	ch, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(requests)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(target, ch)
+		if tcp, ok := target.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(ch, target)
+	ch.CloseWrite()
+	<-done
+}
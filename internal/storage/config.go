@@ -1,19 +1,52 @@
 package storage
 
+import "time"
+
 // ServerConfig represents a saved server configuration
 type ServerConfig struct {
-	Name     string `json:"name"`
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	User     string `json:"user"`
-	Password string `json:"password,omitempty"` // Not saved if using key auth
-	KeyPath  string `json:"key_path,omitempty"`
+	Name       string `json:"name"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	User       string `json:"user"`
+	Password   string `json:"password,omitempty"` // Not saved if using key auth
+	KeyPath    string `json:"key_path,omitempty"`
+	AuthMethod string `json:"auth_method,omitempty"` // "password", "key", "agent" or empty for auto
+
+	JumpHost *ServerConfig `json:"jump_host,omitempty"` // Optional bastion to connect through
+}
+
+// Topology values for AppConfig.Topology
+const (
+	TopologyChain  = ""       // Entry point, optional relays and exit node
+	TopologySingle = "single" // One server that is both entry point and exit
+)
+
+// NetworkConfig holds the VPN network settings of a deployment; empty fields use the defaults
+type NetworkConfig struct {
+	VPNSubnet    string   `json:"vpn_subnet,omitempty"`    // Addresses handed out to VPN clients
+	TunnelSubnet string   `json:"tunnel_subnet,omitempty"` // Reserved for the tunnels between servers
+	DNS          []string `json:"dns,omitempty"`           // DNS servers pushed to VPN clients
+	VPNSubnet6   string   `json:"vpn_subnet6,omitempty"`   // IPv6 addresses for VPN clients; empty keeps the VPN IPv4-only
+	Proposals    string   `json:"proposals,omitempty"`     // IKE/ESP proposal profile for servers and client profiles
+	Firewall     string   `json:"firewall,omitempty"`      // auto, iptables or nftables
 }
 
 // AppConfig holds the application configuration
 type AppConfig struct {
+	// Servers is the chain in traffic order: entry point first, exit node last
 	Servers    []ServerConfig `json:"servers"`
 	SSHKeyPath string         `json:"ssh_key_path"`
+	Topology   string         `json:"topology,omitempty"`
+	Network    NetworkConfig  `json:"network"`
+}
+
+// ActiveServers returns how many of Servers the topology uses; in single-server
+// mode the remaining servers are kept so switching back restores the chain
+func (c *AppConfig) ActiveServers() int {
+	if c.Topology == TopologySingle && len(c.Servers) > 0 {
+		return 1
+	}
+	return len(c.Servers)
 }
 
 // NewAppConfig creates a new config with defaults
@@ -25,3 +58,31 @@ func NewAppConfig() *AppConfig {
 		},
 	}
 }
+
+// StepState is the recorded status of one setup step
+type StepState struct {
+	ID     string `json:"id"`
+	Server string `json:"server,omitempty"`
+	Name   string `json:"name"`
+	Status string `json:"status"` // One of the vpn.StepStatus values
+	Error  string `json:"error,omitempty"`
+}
+
+// SetupState records the steps of the last setup run so a failed run can be resumed
+type SetupState struct {
+	Fingerprint string      `json:"fingerprint"` // Servers and settings the run used; resuming requires the same
+	UpdatedAt   time.Time   `json:"updated_at"`
+	Steps       []StepState `json:"steps"`
+}
+
+// Set records the status of a step, adding it when it is new
+func (s *SetupState) Set(step StepState) {
+	s.UpdatedAt = time.Now()
+	for i := range s.Steps {
+		if s.Steps[i].ID == step.ID {
+			s.Steps[i] = step
+			return
+		}
+	}
+	s.Steps = append(s.Steps, step)
+}
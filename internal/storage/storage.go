@@ -9,6 +9,9 @@ import (
 const (
 	configDirName  = ".tunnelmanager"
 	configFileName = "config.json"
+	setupStateName = "setup_state.json"
+	knownHostsName = "known_hosts"
+	apiTokenName   = "api_token"
 	logsDirName    = "logs"
 )
 
@@ -38,6 +41,16 @@ func (s *Storage) GetLogDir() string {
 	return filepath.Join(s.configDir, logsDirName)
 }
 
+// GetKnownHostsPath returns the path of the known_hosts file used for host key verification
+func (s *Storage) GetKnownHostsPath() string {
+	return filepath.Join(s.configDir, knownHostsName)
+}
+
+// GetAPITokenPath returns the path of the token file for the local API daemon
+func (s *Storage) GetAPITokenPath() string {
+	return filepath.Join(s.configDir, apiTokenName)
+}
+
 // GetSSHKeyDir returns the SSH keys directory path
 func (s *Storage) GetSSHKeyDir() string {
 	return filepath.Join(s.configDir, "ssh")
@@ -108,3 +121,35 @@ func (s *Storage) Save(config *AppConfig) error {
 
 	return os.WriteFile(configPath, data, 0600)
 }
+
+// LoadSetupState reads the step record of the last setup run; it returns nil
+// when no run was recorded
+func (s *Storage) LoadSetupState() (*SetupState, error) {
+	data, err := os.ReadFile(filepath.Join(s.configDir, setupStateName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var state SetupState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// SaveSetupState writes the step record of the current setup run
+func (s *Storage) SaveSetupState(state *SetupState) error {
+	if err := s.EnsureDirs(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(s.configDir, setupStateName), data, 0600)
+}
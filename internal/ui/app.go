@@ -1,9 +1,13 @@
 package ui
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image/color"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +22,7 @@ import (
 	"fyne.io/fyne/v2/widget"
 
 	"github.com/vailcody/IKEv2TunnelManager/internal/logging"
+	"github.com/vailcody/IKEv2TunnelManager/internal/saved"
 	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
 	"github.com/vailcody/IKEv2TunnelManager/internal/storage"
 	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
@@ -33,23 +38,32 @@ type App struct {
 	config *storage.AppConfig
 	logger *logging.Logger
 
-	// Server configs
-	server1Config *ssh.ServerConfig
-	server2Config *ssh.ServerConfig
+	// Server configs, one per hop in chain order (entry first, exit last)
+	servers []*ssh.ServerConfig
 
-	// SSH clients
-	client1 *ssh.Client
-	client2 *ssh.Client
+	// SSH clients, parallel to servers and created on first use
+	clients []*ssh.Client
 
 	// UI components
-	logWidget    *widget.RichText
-	logBinding   binding.String
-	statusWidget *widget.Label
-	tabs         *container.AppTabs
+	logWidget       *widget.RichText
+	logBinding      binding.String
+	statusWidget    *widget.Label
+	tabs            *container.AppTabs
+	hopsBox         *fyne.Container
+	addHopBtn       *widget.Button
+	logServerSelect *widget.Select
+	stepsBox        *fyne.Container     // Steps of the current or last setup run
+	progressBar     *widget.ProgressBar // Share of completed setup steps
+	resumeBtn       *widget.Button      // Continues a failed setup run
+	cancelBtn       *widget.Button      // Stops the running setup, preview or teardown
+
+	// Key passphrases entered this session, never written to config.json
+	passphrases map[string][]byte
 
 	// State
 	mu        sync.Mutex
 	isRunning bool
+	cancel    context.CancelFunc // Cancels the running remote operation; nil when none
 	version   string
 }
 
@@ -81,34 +95,20 @@ func NewApp() *App {
 	}
 
 	a := &App{
-		fyneApp:       app.New(),
-		store:         store,
-		config:        config,
-		logger:        logger,
-		server1Config: &ssh.ServerConfig{Port: 22},
-		server2Config: &ssh.ServerConfig{Port: 22},
+		fyneApp:     app.New(),
+		store:       store,
+		config:      config,
+		logger:      logger,
+		passphrases: make(map[string][]byte),
 	}
 
 	// Apply loaded config to runtime configs
-	if len(config.Servers) >= 2 {
-		s1 := config.Servers[0]
-		a.server1Config.Host = s1.Host
-		if s1.Port > 0 {
-			a.server1Config.Port = s1.Port
-		}
-		a.server1Config.User = s1.User
-		a.server1Config.Password = s1.Password
-		a.server1Config.KeyPath = s1.KeyPath
-
-		s2 := config.Servers[1]
-		a.server2Config.Host = s2.Host
-		if s2.Port > 0 {
-			a.server2Config.Port = s2.Port
-		}
-		a.server2Config.User = s2.User
-		a.server2Config.Password = s2.Password
-		a.server2Config.KeyPath = s2.KeyPath
+	for i := range config.Servers {
+		cfg := saved.SSHConfig(&config.Servers[i])
+		a.applyPrompts(cfg)
+		a.servers = append(a.servers, cfg)
 	}
+	a.clients = make([]*ssh.Client, len(a.servers))
 
 	a.mainWindow = a.fyneApp.NewWindow("IKEv2 Tunnel Manager")
 	a.mainWindow.Resize(fyne.NewSize(900, 700))
@@ -147,113 +147,38 @@ func (a *App) buildUI() {
 func (a *App) createConnectionTab() fyne.CanvasObject {
 	// SSH Key Management
 	keyPathEntry := widget.NewEntry()
-	if a.store != nil {
+	if a.config.SSHKeyPath != "" {
+		keyPathEntry.SetText(a.config.SSHKeyPath)
+	} else if a.store != nil {
 		keyPathEntry.SetText(a.store.GetDefaultKeyPath())
 	} else {
 		keyPathEntry.SetPlaceHolder("Path to SSH key")
 	}
 
 	generateKeyBtn := widget.NewButton("🔑 Generate SSH Key", func() {
-		go a.generateKey(keyPathEntry.Text)
+		path := keyPathEntry.Text
+		a.showKeyOptionsDialog("Generate SSH Key", "Generate", func(opts ssh.KeyOptions) {
+			go a.generateKey(path, opts)
+		})
 	})
 
 	copyKeysBtn := widget.NewButton("📤 Copy Key to Servers", func() {
 		go a.copyKeyToAllServers(keyPathEntry.Text)
 	})
 
-	// Server 1 section
-	server1Title := widget.NewLabel("Server 1 (Entry Point)")
-	server1Title.TextStyle = fyne.TextStyle{Bold: true}
-	server1PingLabel := widget.NewLabel("⚫ Not configured")
-
-	server1Host := widget.NewEntry()
-	server1Host.SetPlaceHolder("IP address or hostname")
-	server1Host.SetText(a.server1Config.Host)
-	server1Host.OnChanged = func(s string) {
-		a.server1Config.Host = s
-		a.saveConfig()
-		if s != "" {
-			go a.updatePingStatus(s, server1PingLabel)
-		} else {
-			server1PingLabel.SetText("⚫ Not configured")
-		}
-	}
-	// Initial ping if host is set
-	if a.server1Config.Host != "" {
-		go a.updatePingStatus(a.server1Config.Host, server1PingLabel)
-	}
-
-	server1User := widget.NewEntry()
-	server1User.SetPlaceHolder("root")
-	server1User.SetText(a.server1Config.User)
-	server1User.OnChanged = func(s string) {
-		a.server1Config.User = s
-		a.saveConfig()
-	}
-
-	server1Pass := widget.NewPasswordEntry()
-	server1Pass.SetPlaceHolder("Password (optional if using key)")
-	server1Pass.SetText(a.server1Config.Password)
-	server1Pass.OnChanged = func(s string) {
-		a.server1Config.Password = s
-		a.saveConfig()
-	}
-
-	server1Form := container.NewVBox(
-		container.NewHBox(server1Title, server1PingLabel),
-		container.NewGridWithColumns(2,
-			widget.NewLabel("Host:"), server1Host,
-			widget.NewLabel("User:"), server1User,
-			widget.NewLabel("Password:"), server1Pass,
-		),
-	)
-
-	// Server 2 section
-	server2Title := widget.NewLabel("Server 2 (Exit Node)")
-	server2Title.TextStyle = fyne.TextStyle{Bold: true}
-	server2PingLabel := widget.NewLabel("⚫ Not configured")
-
-	server2Host := widget.NewEntry()
-	server2Host.SetPlaceHolder("IP address or hostname")
-	server2Host.SetText(a.server2Config.Host)
-	server2Host.OnChanged = func(s string) {
-		a.server2Config.Host = s
-		a.saveConfig()
-		if s != "" {
-			go a.updatePingStatus(s, server2PingLabel)
-		} else {
-			server2PingLabel.SetText("⚫ Not configured")
-		}
-	}
-	// Initial ping if host is set
-	if a.server2Config.Host != "" {
-		go a.updatePingStatus(a.server2Config.Host, server2PingLabel)
-	}
-
-	server2User := widget.NewEntry()
-	server2User.SetPlaceHolder("root")
-	server2User.SetText(a.server2Config.User)
-	server2User.OnChanged = func(s string) {
-		a.server2Config.User = s
-		a.saveConfig()
-	}
-
-	server2Pass := widget.NewPasswordEntry()
-	server2Pass.SetPlaceHolder("Password (optional if using key)")
-	server2Pass.SetText(a.server2Config.Password)
-	server2Pass.OnChanged = func(s string) {
-		a.server2Config.Password = s
-		a.saveConfig()
-	}
+	rotateKeyBtn := widget.NewButton("🔄 Rotate Key", func() {
+		a.showKeyOptionsDialog("Rotate SSH Key", "Rotate", func(opts ssh.KeyOptions) {
+			go a.rotateKey(keyPathEntry, opts)
+		})
+	})
 
-	server2Form := container.NewVBox(
-		container.NewHBox(server2Title, server2PingLabel),
-		container.NewGridWithColumns(2,
-			widget.NewLabel("Host:"), server2Host,
-			widget.NewLabel("User:"), server2User,
-			widget.NewLabel("Password:"), server2Pass,
-		),
-	)
+	// Chain of servers
+	a.hopsBox = container.NewVBox()
+	a.addHopBtn = widget.NewButtonWithIcon("Add Relay", theme.ContentAddIcon(), func() {
+		a.addHop()
+	})
+	topologySelect := a.createTopologySelect()
+	a.refreshHops()
 
 	// Buttons
 	testBtn := widget.NewButton("Test Connections", func() {
@@ -262,18 +187,35 @@ func (a *App) createConnectionTab() fyne.CanvasObject {
 	testBtn.Importance = widget.MediumImportance
 
 	setupBtn := widget.NewButton("Setup IKEv2 Tunnel", func() {
-		go a.setupVPN()
+		go a.setupVPN(false)
 	})
 	setupBtn.Importance = widget.HighImportance
 
-	buttons := container.NewHBox(testBtn, setupBtn)
+	previewBtn := widget.NewButton("Preview", func() {
+		go a.previewSetup()
+	})
+
+	preflightBtn := widget.NewButton("Check Servers", func() {
+		go a.preflightCheck()
+	})
+
+	teardownBtn := widget.NewButtonWithIcon("Remove VPN", theme.DeleteIcon(), func() {
+		a.confirmTeardown()
+	})
+	teardownBtn.Importance = widget.DangerImportance
+
+	a.cancelBtn = widget.NewButtonWithIcon("Cancel", theme.CancelIcon(), a.cancelRun)
+	a.cancelBtn.Disable()
 
 	// Status
 	a.statusWidget = widget.NewLabel("Ready")
+	setupProgress := a.createSetupProgress()
+
+	buttons := container.NewHBox(testBtn, preflightBtn, previewBtn, setupBtn, a.resumeBtn, a.cancelBtn, teardownBtn)
 
 	// Global Key Management Section
 	keyPathRow := container.NewBorder(nil, nil, widget.NewLabel("Default Key Path:"), nil, keyPathEntry)
-	keyButtons := container.NewGridWithColumns(2, generateKeyBtn, copyKeysBtn)
+	keyButtons := container.NewGridWithColumns(3, generateKeyBtn, copyKeysBtn, rotateKeyBtn)
 
 	keyMgmt := container.NewVBox(
 		widget.NewLabelWithStyle("SSH Key Management", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
@@ -282,15 +224,199 @@ func (a *App) createConnectionTab() fyne.CanvasObject {
 		widget.NewSeparator(),
 	)
 
-	return container.NewVBox(
+	return container.NewVScroll(container.NewVBox(
 		keyMgmt,
-		server1Form,
-		widget.NewSeparator(),
-		server2Form,
+		container.NewHBox(widget.NewLabel("Topology:"), topologySelect),
+		a.hopsBox,
+		container.NewHBox(a.addHopBtn),
 		widget.NewSeparator(),
+		a.createNetworkSettings(),
 		buttons,
 		a.statusWidget,
+		setupProgress,
+	))
+}
+
+// applyPrompts wires host key verification and passphrase prompts into a server config.
+// Every connection (setup, status, users) verifies host keys against the same store.
+func (a *App) applyPrompts(cfg *ssh.ServerConfig) {
+	if a.store != nil {
+		cfg.KnownHostsPath = a.store.GetKnownHostsPath()
+	}
+	cfg.HostKeyPrompt = a.confirmHostKey
+	cfg.PassphrasePrompt = a.askPassphrase
+}
+
+// confirmHostKey asks the user to trust a host key seen for the first time.
+// It blocks until the dialog is answered, so it must not be called from the UI thread.
+func (a *App) confirmHostKey(host, fingerprint string) bool {
+	a.Logf("Unknown host key for %s: %s", host, fingerprint)
+
+	answer := make(chan bool, 1)
+	fyne.Do(func() {
+		if a.tabs != nil {
+			a.tabs.SelectIndex(0)
+		}
+		msg := fmt.Sprintf("The authenticity of host %s can't be established.\n\nKey fingerprint:\n%s\n\nTrust this key and remember it?", host, fingerprint)
+		dialog.ShowConfirm("Unknown Host Key", msg, func(trust bool) {
+			answer <- trust
+		}, a.mainWindow)
+	})
+
+	trusted := <-answer
+	if trusted {
+		a.Logf("Host key for %s added to known_hosts", host)
+	} else {
+		a.Logf("Host key for %s rejected", host)
+	}
+	return trusted
+}
+
+// createJumpHostForm builds the optional bastion settings for a server.
+// The jump host is only used when its host field is filled in.
+func (a *App) createJumpHostForm(cfg *ssh.ServerConfig) fyne.CanvasObject {
+	jump := cfg.JumpHost
+	if jump == nil {
+		jump = &ssh.ServerConfig{Port: 22}
+	}
+	apply := func() {
+		if jump.Host != "" {
+			cfg.JumpHost = jump
+		} else {
+			cfg.JumpHost = nil
+		}
+		a.saveConfig()
+	}
+
+	host := widget.NewEntry()
+	host.SetPlaceHolder("Bastion IP or hostname (optional)")
+	host.SetText(jump.Host)
+	host.OnChanged = func(s string) {
+		jump.Host = s
+		apply()
+	}
+
+	port := widget.NewEntry()
+	port.SetText(fmt.Sprintf("%d", jump.Port))
+	port.OnChanged = func(s string) {
+		var p int
+		if _, err := fmt.Sscanf(s, "%d", &p); err == nil && p > 0 && p < 65536 {
+			jump.Port = p
+			apply()
+		}
+	}
+
+	user := widget.NewEntry()
+	user.SetPlaceHolder("root")
+	user.SetText(jump.User)
+	user.OnChanged = func(s string) {
+		jump.User = s
+		apply()
+	}
+
+	pass := widget.NewPasswordEntry()
+	pass.SetPlaceHolder("Password (optional if using key)")
+	pass.SetText(jump.Password)
+	pass.OnChanged = func(s string) {
+		jump.Password = s
+		apply()
+	}
+
+	auth, key := a.createAuthWidgets(jump)
+
+	form := container.NewGridWithColumns(2,
+		widget.NewLabel("Host:"), host,
+		widget.NewLabel("Port:"), port,
+		widget.NewLabel("User:"), user,
+		widget.NewLabel("Password:"), pass,
+		widget.NewLabel("Auth:"), auth,
+		widget.NewLabel("Key:"), key,
 	)
+
+	item := widget.NewAccordionItem("Jump Host", form)
+	item.Open = jump.Host != ""
+	return widget.NewAccordion(item)
+}
+
+var authMethodLabels = []string{"Auto", "Password", "SSH Key", "SSH Agent"}
+
+var authMethodByLabel = map[string]ssh.AuthMethod{
+	"Auto":      ssh.AuthAuto,
+	"Password":  ssh.AuthPassword,
+	"SSH Key":   ssh.AuthKey,
+	"SSH Agent": ssh.AuthAgent,
+}
+
+// createAuthWidgets builds the auth method selector and key path entry for a server
+func (a *App) createAuthWidgets(cfg *ssh.ServerConfig) (*widget.Select, *widget.Entry) {
+	keyEntry := widget.NewEntry()
+	keyEntry.SetPlaceHolder("Path to private key")
+	keyEntry.SetText(cfg.KeyPath)
+	keyEntry.OnChanged = func(s string) {
+		cfg.KeyPath = s
+		a.saveConfig()
+	}
+
+	authSelect := widget.NewSelect(authMethodLabels, func(label string) {
+		cfg.AuthMethod = authMethodByLabel[label]
+		if cfg.AuthMethod == ssh.AuthAgent || cfg.AuthMethod == ssh.AuthPassword {
+			keyEntry.Disable()
+		} else {
+			keyEntry.Enable()
+		}
+		a.saveConfig()
+	})
+	for label, method := range authMethodByLabel {
+		if method == cfg.AuthMethod {
+			authSelect.SetSelected(label)
+		}
+	}
+
+	return authSelect, keyEntry
+}
+
+// askPassphrase prompts for the passphrase of an encrypted private key.
+// Passphrases are kept in memory for this session only.
+func (a *App) askPassphrase(keyPath string) ([]byte, error) {
+	a.mu.Lock()
+	cached, ok := a.passphrases[keyPath]
+	a.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	type result struct {
+		passphrase []byte
+		ok         bool
+	}
+	answer := make(chan result, 1)
+
+	fyne.Do(func() {
+		entry := widget.NewPasswordEntry()
+		items := []*widget.FormItem{widget.NewFormItem("Passphrase", entry)}
+		title := "Key Passphrase"
+		if keyPath != "" {
+			title = fmt.Sprintf("Passphrase for %s", keyPath)
+		}
+		dialog.ShowForm(title, "Unlock", "Cancel", items, func(ok bool) {
+			answer <- result{passphrase: []byte(entry.Text), ok: ok}
+		}, a.mainWindow)
+	})
+
+	res := <-answer
+	if !res.ok {
+		return nil, fmt.Errorf("passphrase entry cancelled")
+	}
+	if keyPath != "" {
+		if err := ssh.CheckPassphrase(keyPath, res.passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	a.mu.Lock()
+	a.passphrases[keyPath] = res.passphrase
+	a.mu.Unlock()
+	return res.passphrase, nil
 }
 
 func (a *App) updatePingStatus(host string, label *widget.Label) {
@@ -319,9 +445,12 @@ func runLocalCommand(cmd string) (string, error) {
 	return string(out), err
 }
 
+// statusTimeout bounds the status queries of one server, so an unresponsive
+// server does not hold up the refresh of the others
+const statusTimeout = 30 * time.Second
+
 func (a *App) createStatusTab() fyne.CanvasObject {
-	server1Status := widget.NewLabel("Server 1: Not connected")
-	server2Status := widget.NewLabel("Server 2: Not connected")
+	serversStatus := container.NewVBox(widget.NewLabel("Servers: Not connected"))
 	tunnelStatus := widget.NewLabel("Tunnel: Unknown")
 	clientsStatus := widget.NewLabel("Active clients: 0")
 
@@ -329,40 +458,48 @@ func (a *App) createStatusTab() fyne.CanvasObject {
 		go func() {
 			a.Log("Refreshing status...")
 
-			if a.client1 == nil {
-				a.client1 = ssh.NewClient(a.server1Config)
-			}
-			// vpn.GetStatus handles connection internally if needed
-			status, err := vpn.GetStatus(a.client1)
-			fyne.Do(func() {
-				if err != nil {
-					server1Status.SetText(fmt.Sprintf("Server 1: Error - %v", err))
-				} else if status.Connected {
-					server1Status.SetText(fmt.Sprintf("Server 1: Running (IP: %s)", status.ServerIP))
-					clientsStatus.SetText(fmt.Sprintf("Active clients: %d", status.ActiveClients))
-					if status.TunnelActive {
-						tunnelStatus.SetText("Tunnel: Active")
-					} else {
-						tunnelStatus.SetText("Tunnel: Not active")
+			var labels []fyne.CanvasObject
+			for i := 0; i < a.hopCount(); i++ {
+				name := a.serverName(i)
+				// vpn.GetStatus handles connection internally if needed
+				ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+				status, err := vpn.GetStatusContext(ctx, a.client(i))
+				cancel()
+
+				var text string
+				switch {
+				case err != nil:
+					text = fmt.Sprintf("%s: Error - %v", name, err)
+				case status.Connected:
+					text = fmt.Sprintf("%s: Running (IP: %s)", name, status.ServerIP)
+					if status.ServerIPv6 != "" {
+						text = fmt.Sprintf("%s: Running (IP: %s, %s)", name, status.ServerIP, status.ServerIPv6)
 					}
-				} else {
-					server1Status.SetText("Server 1: StrongSwan not running")
+				default:
+					text = fmt.Sprintf("%s: StrongSwan not running", name)
+				}
+				labels = append(labels, widget.NewLabel(text))
+				if err == nil && len(status.RoutingDrift) > 0 {
+					labels = append(labels, widget.NewLabel(fmt.Sprintf("⚠️ %s: policy routing differs from the deployed rules: %s. Run Setup again or restart ikev2tm-routing.service",
+						name, strings.Join(status.RoutingDrift, ", "))))
 				}
-			})
 
-			if a.client2 == nil {
-				a.client2 = ssh.NewClient(a.server2Config)
+				// Clients and the tunnel are reported by the entry point
+				if i == 0 && err == nil && status.Connected {
+					fyne.Do(func() {
+						clientsStatus.SetText(fmt.Sprintf("Active clients: %d", status.ActiveClients))
+						if status.TunnelActive {
+							tunnelStatus.SetText("Tunnel: Active")
+						} else {
+							tunnelStatus.SetText("Tunnel: Not active")
+						}
+					})
+				}
 			}
-			// vpn.GetStatus handles connection internally if needed
-			status2, err2 := vpn.GetStatus(a.client2)
+
 			fyne.Do(func() {
-				if err2 != nil {
-					server2Status.SetText(fmt.Sprintf("Server 2: Error - %v", err2))
-				} else if status2.Connected {
-					server2Status.SetText(fmt.Sprintf("Server 2: Running (IP: %s)", status2.ServerIP))
-				} else {
-					server2Status.SetText("Server 2: StrongSwan not running")
-				}
+				serversStatus.Objects = labels
+				serversStatus.Refresh()
 			})
 
 			a.Log("Status refreshed")
@@ -371,12 +508,11 @@ func (a *App) createStatusTab() fyne.CanvasObject {
 
 	restartBtn := widget.NewButton("Restart Tunnel", func() {
 		go func() {
-			a.Log("Restarting tunnel on both servers...")
-			if a.client1 != nil {
-				vpn.RestartVPN(a.client1)
-			}
-			if a.client2 != nil {
-				vpn.RestartVPN(a.client2)
+			a.Log("Restarting tunnel on all servers...")
+			for i := a.hopCount() - 1; i >= 0; i-- {
+				if err := vpn.RestartVPN(a.client(i)); err != nil {
+					a.Errorf("Failed to restart %s: %v", a.serverName(i), err)
+				}
 			}
 			a.Log("Tunnel restarted")
 		}()
@@ -386,8 +522,7 @@ func (a *App) createStatusTab() fyne.CanvasObject {
 	return container.NewVBox(
 		widget.NewLabel("Tunnel Status"),
 		widget.NewSeparator(),
-		server1Status,
-		server2Status,
+		serversStatus,
 		tunnelStatus,
 		clientsStatus,
 		widget.NewSeparator(),
@@ -402,17 +537,15 @@ func (a *App) createUsersTab() fyne.CanvasObject {
 
 	var refreshList func()
 	refreshList = func() {
-		if a.client1 == nil {
-			a.client1 = ssh.NewClient(a.server1Config)
-		}
-		if !a.client1.IsConnected() {
-			a.Log("Connecting to Server 1 to list users...")
-			if err := a.client1.Connect(); err != nil {
-				a.Errorf("Failed to connect to Server 1: %v", err)
+		client := a.client(0)
+		if !client.IsConnected() {
+			a.Logf("Connecting to %s to list users...", a.serverName(0))
+			if err := client.Connect(); err != nil {
+				a.Errorf("Failed to connect to %s: %v", a.serverName(0), err)
 				return
 			}
 		}
-		um := vpn.NewUserManager(a.client1, a)
+		um := vpn.NewUserManager(client, a)
 		var err error
 		users, err = um.ListUsers()
 		fyne.Do(func() {
@@ -439,17 +572,15 @@ func (a *App) createUsersTab() fyne.CanvasObject {
 
 	addBtn := widget.NewButton("Add User", func() {
 		go func() {
-			if a.client1 == nil {
-				a.client1 = ssh.NewClient(a.server1Config)
-			}
-			if !a.client1.IsConnected() {
-				a.Log("Connecting to Server 1 to add user...")
-				if err := a.client1.Connect(); err != nil {
-					a.Errorf("Failed to connect to Server 1: %v", err)
+			client := a.client(0)
+			if !client.IsConnected() {
+				a.Logf("Connecting to %s to add user...", a.serverName(0))
+				if err := client.Connect(); err != nil {
+					a.Errorf("Failed to connect to %s: %v", a.serverName(0), err)
 					return
 				}
 			}
-			um := vpn.NewUserManager(a.client1, a)
+			um := vpn.NewUserManager(client, a)
 			_, err := um.AddUser(usernameEntry.Text, passwordEntry.Text)
 			if err != nil {
 				a.Errorf("Failed to add user: %v", err)
@@ -468,7 +599,7 @@ func (a *App) createUsersTab() fyne.CanvasObject {
 			return
 		}
 		go func() {
-			um := vpn.NewUserManager(a.client1, a)
+			um := vpn.NewUserManager(a.client(0), a)
 			if err := um.RemoveUser(selectedUser); err != nil {
 				a.Errorf("Failed to delete user: %v", err)
 				return
@@ -525,12 +656,13 @@ func (a *App) createUserRow(username string, selectedUser *string, refreshList f
 }
 
 func (a *App) downloadMobileConfig(username string) {
-	if a.client1 == nil || !a.client1.IsConnected() {
-		a.Log("Not connected to Server 1")
+	client := a.client(0)
+	if !client.IsConnected() {
+		a.Logf("Not connected to %s", a.serverName(0))
 		return
 	}
 
-	um := vpn.NewUserManager(a.client1, a)
+	um := vpn.NewUserManager(client, a)
 	password, err := um.GetUserPassword(username)
 	if err != nil {
 		a.Errorf("Failed to get user password: %v", err)
@@ -538,16 +670,16 @@ func (a *App) downloadMobileConfig(username string) {
 	}
 
 	// Get CA certificate from server
-	caCert, err := a.client1.ReadFile("/etc/ipsec.d/cacerts/ca-cert.pem")
+	caCert, err := client.ReadFile(vpn.CACertPath)
 	if err != nil {
 		a.Errorf("Failed to read CA certificate: %v", err)
 		return
 	}
 
 	// Get server IP
-	serverIP := a.server1Config.Host
+	serverIP := a.servers[0].Host
 
-	config := vpn.GenerateMobileConfig(username, password, serverIP, string(caCert))
+	config := vpn.GenerateMobileConfig(username, password, serverIP, string(caCert), a.networkConfig().Proposals)
 
 	// Save file dialog
 	fyne.Do(func() {
@@ -569,22 +701,24 @@ func (a *App) downloadMobileConfig(username string) {
 }
 
 func (a *App) showInstructions(username string) {
-	if a.client1 == nil || !a.client1.IsConnected() {
-		a.Log("Not connected to Server 1")
+	client := a.client(0)
+	if !client.IsConnected() {
+		a.Logf("Not connected to %s", a.serverName(0))
 		return
 	}
 
-	um := vpn.NewUserManager(a.client1, a)
+	um := vpn.NewUserManager(client, a)
 	password, err := um.GetUserPassword(username)
 	if err != nil {
 		a.Errorf("Failed to get user password: %v", err)
 		return
 	}
 
-	serverIP := a.server1Config.Host
+	serverIP := a.servers[0].Host
 
-	windowsInstructions := vpn.GetWindowsInstructions(serverIP, username, password)
-	androidInstructions := vpn.GetAndroidInstructions(serverIP, username, password)
+	profile := a.networkConfig().Proposals
+	windowsInstructions := vpn.GetWindowsInstructions(serverIP, username, password, profile)
+	androidInstructions := vpn.GetAndroidInstructions(serverIP, username, password, profile)
 
 	windowsText := widget.NewMultiLineEntry()
 	windowsText.SetText(windowsInstructions)
@@ -687,41 +821,34 @@ func (a *App) createLogsTab() fyne.CanvasObject {
 		}
 	})
 
-	fetchServer1Logs := widget.NewButton("Fetch Server 1 Logs", func() {
-		go func() {
-			if a.client1 == nil || !a.client1.IsConnected() {
-				a.Log("Not connected to Server 1")
-				return
-			}
-			logs, err := vpn.GetDetailedLogs(a.client1, 50)
-			if err != nil {
-				a.Errorf("Failed to fetch logs: %v", err)
-				return
-			}
-			a.Log("=== Server 1 Logs ===")
-			a.Log(logs)
-		}()
-	})
+	a.logServerSelect = widget.NewSelect(nil, nil)
+	a.updateLogServerSelect()
 
-	fetchServer2Logs := widget.NewButton("Fetch Server 2 Logs", func() {
+	fetchLogs := widget.NewButton("Fetch Server Logs", func() {
+		i := a.logServerSelect.SelectedIndex()
+		if i < 0 {
+			a.Log("Select a server to fetch logs from")
+			return
+		}
 		go func() {
-			if a.client2 == nil || !a.client2.IsConnected() {
-				a.Log("Not connected to Server 2")
+			client := a.client(i)
+			if !client.IsConnected() {
+				a.Logf("Not connected to %s", a.serverName(i))
 				return
 			}
-			logs, err := vpn.GetDetailedLogs(a.client2, 50)
+			logs, err := vpn.GetDetailedLogs(client, 50)
 			if err != nil {
 				a.Errorf("Failed to fetch logs: %v", err)
 				return
 			}
-			a.Log("=== Server 2 Logs ===")
+			a.Logf("=== %s Logs ===", a.serverName(i))
 			a.Log(logs)
 		}()
 	})
 
 	buttons := container.NewVBox(
 		container.NewHBox(clearBtn, openLogsDirBtn),
-		container.NewHBox(fetchServer1Logs, fetchServer2Logs),
+		container.NewHBox(a.logServerSelect, fetchLogs),
 	)
 
 	// Wrap log widget in a container with a dark background for better contrast
@@ -743,30 +870,27 @@ func (a *App) createLogsTab() fyne.CanvasObject {
 
 func (a *App) testConnections() {
 	a.setStatus("Testing connections...")
-	a.Log("Testing connection to Server 1...")
 
-	client1 := ssh.NewClient(a.server1Config)
-	if err := client1.TestConnection(); err != nil {
-		a.Errorf("Server 1 connection failed: %v", err)
-		a.setStatus("Server 1 connection failed")
-		return
-	}
-	a.Log("Server 1: OK")
+	for i, cfg := range a.servers[:a.hopCount()] {
+		name := a.serverName(i)
+		a.Logf("Testing connection to %s...", name)
 
-	a.Log("Testing connection to Server 2...")
-	client2 := ssh.NewClient(a.server2Config)
-	if err := client2.TestConnection(); err != nil {
-		a.Errorf("Server 2 connection failed: %v", err)
-		a.setStatus("Server 2 connection failed")
-		return
+		client := ssh.NewClient(cfg)
+		if err := client.TestConnection(); err != nil {
+			a.Errorf("%s connection failed: %v", name, err)
+			a.setStatus(name + " connection failed")
+			return
+		}
+		a.Logf("%s: OK", name)
 	}
-	a.Log("Server 2: OK")
 
-	a.setStatus("Both connections successful!")
+	a.setStatus("All connections successful!")
 	a.Log("All connections tested successfully")
 }
 
-func (a *App) setupVPN() {
+// setupVPN runs the setup; with resume it continues the last failed run with
+// the step that failed
+func (a *App) setupVPN(resume bool) {
 	a.mu.Lock()
 	if a.isRunning {
 		a.mu.Unlock()
@@ -782,36 +906,235 @@ func (a *App) setupVPN() {
 		a.mu.Unlock()
 	}()
 
+	config := a.setupConfig()
+	manager := vpn.NewManager(config, a)
+	if resume {
+		state := a.storedSetupState()
+		if !saved.Resumable(state) {
+			a.Error("There is no unfinished setup to resume")
+			return
+		}
+		if state.Fingerprint != config.Fingerprint() {
+			a.Error("Servers or network settings changed since the unfinished setup, run the full setup instead")
+			return
+		}
+		manager.SkipSteps(saved.CompletedSteps(state))
+	}
+
+	ctx, done := a.cancellable()
+	defer done()
+
 	a.setStatus("Setting up IKEv2 tunnel...")
 	a.Log("Starting IKEv2 tunnel setup...")
 
-	config := &vpn.SetupConfig{
-		Server1:       a.server1Config,
-		Server2:       a.server2Config,
-		VPNSubnet:     "10.10.10.0/24",
-		TunnelSubnet:  "10.10.20.0/24",
-		Server1Domain: a.server1Config.Host,
-		Server2Domain: a.server2Config.Host,
+	// Record every step so a failed run can be resumed. The state is saved
+	// from the first step event on, so a run stopped by preflight keeps the
+	// previous one.
+	state := &storage.SetupState{Fingerprint: config.Fingerprint()}
+	for _, step := range manager.Steps() {
+		state.Set(saved.StepState(step))
 	}
+	a.showSetupState(state, true)
+	defer func() { a.showSetupState(a.storedSetupState(), false) }()
+	events := manager.Progress()
+	recorded := make(chan struct{})
+	go func() {
+		defer close(recorded)
+		a.recordSetup(state, events)
+	}()
 
-	manager := vpn.NewManager(config, a)
-
-	if err := manager.SetupAll(); err != nil {
+	err := manager.SetupAllContext(ctx)
+	<-recorded
+	if errors.Is(err, context.Canceled) {
+		a.Errorf("Setup cancelled: %v", err)
+		a.setStatus("Setup cancelled")
+		return
+	}
+	var preflightErr *vpn.PreflightError
+	if errors.As(err, &preflightErr) {
+		a.Errorf("Setup stopped before changing anything: %v", err)
+		a.setStatus("Preflight checks failed!")
+		a.showPreflight(preflightErr.Reports)
+		return
+	}
+	if err != nil {
 		a.Errorf("Setup failed: %v", err)
 		a.setStatus("Setup failed!")
 		return
 	}
 
 	// Store clients for later use
-	a.client1 = ssh.NewClient(a.server1Config)
-	a.client1.Connect()
-	a.client2 = ssh.NewClient(a.server2Config)
-	a.client2.Connect()
+	for i := 0; i < a.hopCount(); i++ {
+		a.client(i).Connect()
+	}
 
 	a.setStatus("IKEv2 tunnel setup completed!")
 	a.Log("IKEv2 tunnel is ready!")
 }
 
+// cancellable returns the context of a remote operation that the Cancel
+// button stops; the returned function releases it once the operation ends
+func (a *App) cancellable() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.mu.Lock()
+	a.cancel = cancel
+	a.mu.Unlock()
+	fyne.Do(a.cancelBtn.Enable)
+
+	return ctx, func() {
+		a.mu.Lock()
+		a.cancel = nil
+		a.mu.Unlock()
+		cancel()
+		fyne.Do(a.cancelBtn.Disable)
+	}
+}
+
+// cancelRun stops the running remote operation. The command running on the
+// server is killed; a cancelled setup can be resumed.
+func (a *App) cancelRun() {
+	a.mu.Lock()
+	cancel := a.cancel
+	a.mu.Unlock()
+	if cancel != nil {
+		a.Log("Cancelling...")
+		cancel()
+	}
+}
+
+func (a *App) setupConfig() *vpn.SetupConfig {
+	config := a.networkConfig()
+	config.Topology = vpn.Topology(a.config.Topology)
+	for i, cfg := range a.servers[:a.hopCount()] {
+		config.Hops = append(config.Hops, &vpn.Hop{Name: a.serverName(i), Server: cfg, Domain: cfg.Host})
+	}
+	return config
+}
+
+// previewSetup shows the commands and files setup would apply, without changing the servers
+func (a *App) previewSetup() {
+	a.mu.Lock()
+	if a.isRunning {
+		a.mu.Unlock()
+		a.Log("Setup is already running")
+		return
+	}
+	a.isRunning = true
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		a.isRunning = false
+		a.mu.Unlock()
+	}()
+
+	ctx, done := a.cancellable()
+	defer done()
+
+	a.setStatus("Building setup preview...")
+	a.Log("Building setup preview (no changes will be made)...")
+
+	plan, err := vpn.NewManager(a.setupConfig(), a).PlanContext(ctx)
+	if err != nil {
+		a.Errorf("Preview failed: %v", err)
+		a.setStatus("Preview failed!")
+		return
+	}
+	a.setStatus("Ready")
+
+	fyne.Do(func() {
+		tabs := container.NewAppTabs()
+		for _, sp := range plan.Servers {
+			script := widget.NewMultiLineEntry()
+			script.TextStyle = fyne.TextStyle{Monospace: true}
+			script.SetText(sp.Script())
+			script.Disable()
+			tabs.Append(container.NewTabItem(fmt.Sprintf("%s (%s)", sp.Name, sp.Host), container.NewScroll(script)))
+		}
+
+		previewWindow := a.fyneApp.NewWindow("Setup Preview")
+		previewWindow.SetContent(tabs)
+		previewWindow.Resize(fyne.NewSize(800, 600))
+		previewWindow.Show()
+	})
+}
+
+// confirmTeardown asks which parts to keep before removing the VPN from the servers
+func (a *App) confirmTeardown() {
+	keepCA := widget.NewCheck("Keep CA certificate (existing client profiles stay trusted after a new setup)", nil)
+	purge := widget.NewCheck("Uninstall StrongSwan packages", nil)
+	items := []*widget.FormItem{
+		widget.NewFormItem("", widget.NewLabel("StrongSwan is stopped and its configuration, certificates,\nfirewall rules and policy routing are removed from all servers.")),
+		widget.NewFormItem("", keepCA),
+		widget.NewFormItem("", purge),
+	}
+	dialog.ShowForm("Remove VPN", "Remove", "Cancel", items, func(ok bool) {
+		if ok {
+			go a.teardownVPN(vpn.TeardownOptions{KeepCA: keepCA.Checked, Purge: purge.Checked})
+		}
+	}, a.mainWindow)
+}
+
+// teardownVPN removes the VPN from the servers and shows what was removed
+func (a *App) teardownVPN(opts vpn.TeardownOptions) {
+	a.mu.Lock()
+	if a.isRunning {
+		a.mu.Unlock()
+		a.Log("Setup is already running")
+		return
+	}
+	a.isRunning = true
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		a.isRunning = false
+		a.mu.Unlock()
+	}()
+
+	ctx, done := a.cancellable()
+	defer done()
+
+	a.setStatus("Removing VPN...")
+	reports, err := vpn.NewManager(a.setupConfig(), a).TeardownContext(ctx, opts)
+	if err != nil {
+		a.Errorf("Teardown failed: %v", err)
+		a.setStatus("Teardown failed!")
+		if reports == nil {
+			return
+		}
+	} else {
+		a.setStatus("VPN removed")
+	}
+
+	var b strings.Builder
+	for _, r := range reports {
+		fmt.Fprintf(&b, "%s (%s):\n", r.Name, r.Host)
+		if len(r.Removed) == 0 && r.Error == "" {
+			b.WriteString("  nothing to remove\n")
+		}
+		for _, item := range r.Removed {
+			fmt.Fprintf(&b, "  • %s\n", item)
+		}
+		if r.Error != "" {
+			fmt.Fprintf(&b, "  ❌ %s\n", r.Error)
+		}
+		b.WriteString("\n")
+	}
+
+	fyne.Do(func() {
+		report := widget.NewMultiLineEntry()
+		report.TextStyle = fyne.TextStyle{Monospace: true}
+		report.SetText(b.String())
+		report.Disable()
+
+		reportWindow := a.fyneApp.NewWindow("Teardown Report")
+		reportWindow.SetContent(container.NewScroll(report))
+		reportWindow.Resize(fyne.NewSize(700, 500))
+		reportWindow.Show()
+	})
+}
+
 func (a *App) setStatus(status string) {
 	if a.statusWidget != nil {
 		fyne.Do(func() {
@@ -872,18 +1195,8 @@ func (a *App) saveConfig() {
 		return
 	}
 
-	if len(a.config.Servers) >= 2 {
-		a.config.Servers[0].Host = a.server1Config.Host
-		a.config.Servers[0].Port = a.server1Config.Port
-		a.config.Servers[0].User = a.server1Config.User
-		a.config.Servers[0].Password = a.server1Config.Password
-		a.config.Servers[0].KeyPath = a.server1Config.KeyPath
-
-		a.config.Servers[1].Host = a.server2Config.Host
-		a.config.Servers[1].Port = a.server2Config.Port
-		a.config.Servers[1].User = a.server2Config.User
-		a.config.Servers[1].Password = a.server2Config.Password
-		a.config.Servers[1].KeyPath = a.server2Config.KeyPath
+	for i, cfg := range a.servers {
+		saved.UpdateServer(&a.config.Servers[i], cfg)
 	}
 
 	if err := a.store.Save(a.config); err != nil {
@@ -891,37 +1204,78 @@ func (a *App) saveConfig() {
 	}
 }
 
-func (a *App) generateKey(path string) {
+// showKeyOptionsDialog asks for the key type, optional passphrase and comment
+func (a *App) showKeyOptionsDialog(title, confirm string, onSubmit func(ssh.KeyOptions)) {
+	typeLabels := make([]string, len(ssh.KeyTypes))
+	for i, t := range ssh.KeyTypes {
+		typeLabels[i] = string(t)
+	}
+	typeSelect := widget.NewSelect(typeLabels, nil)
+	typeSelect.SetSelected(string(ssh.KeyTypeEd25519))
+
+	passphraseEntry := widget.NewPasswordEntry()
+	passphraseEntry.SetPlaceHolder("Optional")
+
+	commentEntry := widget.NewEntry()
+	commentEntry.SetText("tunnelmanager")
+	if hostname, err := os.Hostname(); err == nil {
+		commentEntry.SetText("tunnelmanager@" + hostname)
+	}
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("Key type", typeSelect),
+		widget.NewFormItem("Passphrase", passphraseEntry),
+		widget.NewFormItem("Comment", commentEntry),
+	}
+
+	dialog.ShowForm(title, confirm, "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		onSubmit(ssh.KeyOptions{
+			Type:       ssh.KeyType(typeSelect.Selected),
+			Passphrase: []byte(passphraseEntry.Text),
+			Comment:    commentEntry.Text,
+		})
+	}, a.mainWindow)
+}
+
+func (a *App) generateKey(path string, opts ssh.KeyOptions) {
 	if path == "" {
 		a.Error("Please specify a path for the SSH key")
 		return
 	}
 
-	a.Log("Generating SSH key...")
+	a.Logf("Generating %s SSH key...", opts.Type)
 	keygen := ssh.NewKeyGenerator()
 
+	generate := func() {
+		if err := keygen.GenerateKey(path, opts); err != nil {
+			a.Errorf("Failed to generate key: %v", err)
+			return
+		}
+		a.mu.Lock()
+		if len(opts.Passphrase) > 0 {
+			a.passphrases[path] = opts.Passphrase
+		} else {
+			delete(a.passphrases, path)
+		}
+		a.mu.Unlock()
+		a.Log("SSH key generated successfully!")
+	}
+
 	if keygen.KeyExists(path) {
 		fyne.Do(func() {
 			dialog.ShowConfirm("Key already exists", "Overwrite existing key?", func(overwrite bool) {
 				if overwrite {
-					go func() {
-						if err := keygen.GenerateKey(path); err != nil {
-							a.Errorf("Failed to generate key: %v", err)
-						} else {
-							a.Log("SSH key generated successfully!")
-						}
-					}()
+					go generate()
 				} else {
 					a.Log("Key generation cancelled")
 				}
 			}, a.mainWindow)
 		})
 	} else {
-		if err := keygen.GenerateKey(path); err != nil {
-			a.Errorf("Failed to generate key: %v", err)
-		} else {
-			a.Log("SSH key generated successfully!")
-		}
+		generate()
 	}
 }
 
@@ -948,12 +1302,11 @@ func (a *App) copyKeyToAllServers(keyPath string) {
 		return
 	}
 
-	configs := []*ssh.ServerConfig{a.server1Config, a.server2Config}
 	successCount := 0
 	attemptCount := 0
 
-	for i, config := range configs {
-		serverName := fmt.Sprintf("Server %d", i+1)
+	for i, config := range a.servers[:a.hopCount()] {
+		serverName := a.serverName(i)
 		if config.Host == "" {
 			a.Logf("%s not configured, skipping key copy.", serverName)
 			continue
@@ -977,6 +1330,7 @@ func (a *App) copyKeyToAllServers(keyPath string) {
 
 		config.Password = "" // Clear password as we have key now
 		config.KeyPath = keyPath
+		config.AuthMethod = ssh.AuthKey
 		successCount++
 		a.Logf("Key installed on %s", serverName)
 	}
@@ -1001,3 +1355,73 @@ func (a *App) copyKeyToAllServers(keyPath string) {
 		})
 	}
 }
+
+// rotateKey replaces the login key on all configured servers and saves the new key path
+func (a *App) rotateKey(keyPathEntry *widget.Entry, opts ssh.KeyOptions) {
+	a.mu.Lock()
+	if a.isRunning {
+		a.mu.Unlock()
+		a.Log("Another operation is already running")
+		return
+	}
+	a.isRunning = true
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		a.isRunning = false
+		a.mu.Unlock()
+	}()
+
+	var targets []ssh.RotationTarget
+	for i, config := range a.servers[:a.hopCount()] {
+		if config.Host == "" {
+			continue
+		}
+		targets = append(targets, ssh.RotationTarget{Name: a.serverName(i), Config: config})
+	}
+	if len(targets) == 0 {
+		a.Log("No servers configured to rotate keys on.")
+		return
+	}
+
+	dir := filepath.Dir(keyPathEntry.Text)
+	if a.store != nil && keyPathEntry.Text == "" {
+		dir = a.store.GetSSHKeyDir()
+	}
+	newKeyPath := filepath.Join(dir, fmt.Sprintf("tunnelmanager_%s_%s", opts.Type, time.Now().Format("20060102-150405")))
+
+	a.setStatus("Rotating SSH key...")
+	keygen := ssh.NewKeyGenerator()
+	if err := keygen.RotateKey(targets, newKeyPath, opts, a.Logf); err != nil {
+		a.Errorf("Key rotation failed: %v", err)
+		a.setStatus("Key rotation failed, changes rolled back")
+		fyne.Do(func() {
+			dialog.ShowError(fmt.Errorf("key rotation failed and was rolled back: %w", err), a.mainWindow)
+		})
+		return
+	}
+
+	// Servers have switched over; only now persist the new key
+	for _, t := range targets {
+		t.Config.KeyPath = newKeyPath
+		t.Config.AuthMethod = ssh.AuthKey
+	}
+	a.mu.Lock()
+	if len(opts.Passphrase) > 0 {
+		a.passphrases[newKeyPath] = opts.Passphrase
+	}
+	a.mu.Unlock()
+	a.config.SSHKeyPath = newKeyPath
+	a.saveConfig()
+
+	// Reconnect cached clients with the new key on next use
+	a.closeClients()
+
+	a.Logf("SSH key rotated on %d servers, new key: %s", len(targets), newKeyPath)
+	a.setStatus("SSH key rotated")
+	fyne.Do(func() {
+		keyPathEntry.SetText(newKeyPath)
+		dialog.ShowInformation("Key Rotated", fmt.Sprintf("New key installed on %d servers:\n%s", len(targets), newKeyPath), a.mainWindow)
+	})
+}
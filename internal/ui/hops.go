@@ -0,0 +1,244 @@
+package ui
+
+import (
+	"fmt"
+	"slices"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/saved"
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/storage"
+)
+
+// minHops is the shortest chain: an entry point and an exit node
+const minHops = 2
+
+// serverName returns the display name of the i-th hop
+func (a *App) serverName(i int) string {
+	if i < len(a.config.Servers) && a.config.Servers[i].Name != "" {
+		return a.config.Servers[i].Name
+	}
+	return fmt.Sprintf("Server %d", i+1)
+}
+
+// hopCount returns how many servers the selected topology uses
+func (a *App) hopCount() int {
+	return a.config.ActiveServers()
+}
+
+// hopRole describes the position of the i-th hop in the chain
+func (a *App) hopRole(i int) string {
+	if a.config.Topology == storage.TopologySingle {
+		return "Single Server"
+	}
+	switch i {
+	case 0:
+		return "Entry Point"
+	case len(a.servers) - 1:
+		return "Exit Node"
+	default:
+		return "Relay"
+	}
+}
+
+// client returns the cached SSH client of the i-th hop, creating it if needed.
+// The client is not connected yet.
+func (a *App) client(i int) *ssh.Client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clients[i] == nil {
+		a.clients[i] = ssh.NewClient(a.servers[i])
+	}
+	return a.clients[i]
+}
+
+// closeClients drops all cached clients so they reconnect with current settings
+func (a *App) closeClients() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.clients {
+		if c != nil {
+			c.Close()
+		}
+	}
+	a.clients = make([]*ssh.Client, len(a.servers))
+}
+
+var topologyLabels = []string{"Chain (entry → exit)", "Single server"}
+
+var topologyByLabel = map[string]string{
+	"Chain (entry → exit)": storage.TopologyChain,
+	"Single server":        storage.TopologySingle,
+}
+
+// createTopologySelect switches between a chain of servers and a single road-warrior server
+func (a *App) createTopologySelect() *widget.Select {
+	sel := widget.NewSelect(topologyLabels, nil)
+	for label, topology := range topologyByLabel {
+		if topology == a.config.Topology {
+			sel.SetSelected(label)
+		}
+	}
+	sel.OnChanged = func(label string) {
+		a.config.Topology = topologyByLabel[label]
+		a.hopsChanged()
+	}
+	return sel
+}
+
+// refreshHops rebuilds the server forms after the chain changed
+func (a *App) refreshHops() {
+	single := a.config.Topology == storage.TopologySingle
+	if single {
+		a.addHopBtn.Hide()
+	} else {
+		a.addHopBtn.Show()
+	}
+
+	forms := make([]fyne.CanvasObject, 0, len(a.servers)*2)
+	for i := 0; i < a.hopCount(); i++ {
+		if i > 0 {
+			forms = append(forms, widget.NewSeparator())
+		}
+		forms = append(forms, a.createHopForm(i))
+	}
+	a.hopsBox.Objects = forms
+	a.hopsBox.Refresh()
+	a.updateLogServerSelect()
+}
+
+// hopsChanged renumbers the servers, resets connections and saves the chain
+func (a *App) hopsChanged() {
+	for i := range a.config.Servers {
+		a.config.Servers[i].Name = fmt.Sprintf("Server %d", i+1)
+	}
+	a.closeClients()
+	a.saveConfig()
+	a.refreshHops()
+}
+
+// addHop inserts a new relay in front of the exit node
+func (a *App) addHop() {
+	hop := storage.ServerConfig{Port: ssh.DefaultPort}
+	cfg := saved.SSHConfig(&hop)
+	a.applyPrompts(cfg)
+
+	at := len(a.servers) - 1
+	a.config.Servers = slices.Insert(a.config.Servers, at, hop)
+	a.servers = slices.Insert(a.servers, at, cfg)
+	a.hopsChanged()
+}
+
+func (a *App) removeHop(i int) {
+	if len(a.servers) <= minHops {
+		return
+	}
+	a.config.Servers = slices.Delete(a.config.Servers, i, i+1)
+	a.servers = slices.Delete(a.servers, i, i+1)
+	a.hopsChanged()
+}
+
+// moveHop swaps the i-th hop with its neighbour at i+delta
+func (a *App) moveHop(i, delta int) {
+	j := i + delta
+	if j < 0 || j >= len(a.servers) {
+		return
+	}
+	a.config.Servers[i], a.config.Servers[j] = a.config.Servers[j], a.config.Servers[i]
+	a.servers[i], a.servers[j] = a.servers[j], a.servers[i]
+	a.hopsChanged()
+}
+
+// createHopForm builds the SSH settings of the i-th hop with controls to reorder or remove it
+func (a *App) createHopForm(i int) fyne.CanvasObject {
+	cfg := a.servers[i]
+
+	title := widget.NewLabel(fmt.Sprintf("%s (%s)", a.serverName(i), a.hopRole(i)))
+	title.TextStyle = fyne.TextStyle{Bold: true}
+	pingLabel := widget.NewLabel("⚫ Not configured")
+
+	host := widget.NewEntry()
+	host.SetPlaceHolder("IP address or hostname")
+	host.SetText(cfg.Host)
+	host.OnChanged = func(s string) {
+		cfg.Host = s
+		a.saveConfig()
+		if s != "" {
+			go a.updatePingStatus(s, pingLabel)
+		} else {
+			pingLabel.SetText("⚫ Not configured")
+		}
+	}
+	// Initial ping if host is set
+	if cfg.Host != "" {
+		go a.updatePingStatus(cfg.Host, pingLabel)
+	}
+
+	user := widget.NewEntry()
+	user.SetPlaceHolder("root")
+	user.SetText(cfg.User)
+	user.OnChanged = func(s string) {
+		cfg.User = s
+		a.saveConfig()
+	}
+
+	pass := widget.NewPasswordEntry()
+	pass.SetPlaceHolder("Password (optional if using key)")
+	pass.SetText(cfg.Password)
+	pass.OnChanged = func(s string) {
+		cfg.Password = s
+		a.saveConfig()
+	}
+
+	auth, key := a.createAuthWidgets(cfg)
+
+	upBtn := widget.NewButtonWithIcon("", theme.MoveUpIcon(), func() { a.moveHop(i, -1) })
+	downBtn := widget.NewButtonWithIcon("", theme.MoveDownIcon(), func() { a.moveHop(i, 1) })
+	removeBtn := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() { a.removeHop(i) })
+	if i == 0 {
+		upBtn.Disable()
+	}
+	if i == len(a.servers)-1 {
+		downBtn.Disable()
+	}
+	if len(a.servers) <= minHops {
+		removeBtn.Disable()
+	}
+	controls := container.NewHBox(upBtn, downBtn, removeBtn)
+	if a.config.Topology == storage.TopologySingle {
+		controls.Hide()
+	}
+
+	return container.NewVBox(
+		container.NewBorder(nil, nil, container.NewHBox(title, pingLabel), controls),
+		container.NewGridWithColumns(2,
+			widget.NewLabel("Host:"), host,
+			widget.NewLabel("User:"), user,
+			widget.NewLabel("Password:"), pass,
+			widget.NewLabel("Auth:"), auth,
+			widget.NewLabel("Key:"), key,
+		),
+		a.createJumpHostForm(cfg),
+	)
+}
+
+// updateLogServerSelect lists the current servers in the Logs tab
+func (a *App) updateLogServerSelect() {
+	if a.logServerSelect == nil {
+		return
+	}
+	names := make([]string, a.hopCount())
+	for i := range names {
+		names[i] = a.serverName(i)
+	}
+	selected := a.logServerSelect.SelectedIndex()
+	a.logServerSelect.SetOptions(names)
+	if selected < 0 || selected >= len(names) {
+		selected = 0
+	}
+	a.logServerSelect.SetSelectedIndex(selected)
+}
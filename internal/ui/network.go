@@ -0,0 +1,135 @@
+package ui
+
+import (
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+// networkConfig returns the network settings of the deployment with defaults filled in
+func (a *App) networkConfig() *vpn.SetupConfig {
+	config := &vpn.SetupConfig{
+		VPNSubnet:    a.config.Network.VPNSubnet,
+		TunnelSubnet: a.config.Network.TunnelSubnet,
+		DNS:          a.config.Network.DNS,
+		VPNSubnet6:   a.config.Network.VPNSubnet6,
+		Proposals:    vpn.ProposalProfile(a.config.Network.Proposals),
+		Firewall:     vpn.FirewallBackend(a.config.Network.Firewall),
+	}
+	config.SetDefaults()
+	return config
+}
+
+// createNetworkSettings builds the collapsible panel for the VPN subnets, DNS servers,
+// proposal profile and firewall backend.
+// Valid values are saved as they are typed; overlaps with networks on the servers are
+// checked during setup and preview.
+func (a *App) createNetworkSettings() fyne.CanvasObject {
+	current := a.networkConfig()
+	problem := widget.NewLabel("")
+	problem.Wrapping = fyne.TextWrapWord
+	problem.Hide()
+
+	// showProblem reports settings that are valid on their own but not together
+	showProblem := func() {
+		if err := a.networkConfig().ValidateNetwork(); err != nil {
+			problem.SetText("⚠️ " + err.Error())
+			problem.Show()
+		} else {
+			problem.Hide()
+		}
+	}
+
+	vpnSubnet := widget.NewEntry()
+	vpnSubnet.SetPlaceHolder(vpn.DefaultVPNSubnet)
+	vpnSubnet.SetText(current.VPNSubnet)
+	vpnSubnet.Validator = vpn.ValidateSubnet
+	vpnSubnet.OnChanged = func(s string) {
+		if vpn.ValidateSubnet(s) == nil {
+			a.config.Network.VPNSubnet = strings.TrimSpace(s)
+			a.saveConfig()
+		}
+		showProblem()
+	}
+
+	tunnelSubnet := widget.NewEntry()
+	tunnelSubnet.SetPlaceHolder(vpn.DefaultTunnelSubnet)
+	tunnelSubnet.SetText(current.TunnelSubnet)
+	tunnelSubnet.Validator = vpn.ValidateSubnet
+	tunnelSubnet.OnChanged = func(s string) {
+		if vpn.ValidateSubnet(s) == nil {
+			a.config.Network.TunnelSubnet = strings.TrimSpace(s)
+			a.saveConfig()
+		}
+		showProblem()
+	}
+
+	// Empty keeps the VPN IPv4-only
+	vpnSubnet6 := widget.NewEntry()
+	vpnSubnet6.SetPlaceHolder(vpn.ExampleVPNSubnet6 + " (empty: IPv4 only)")
+	vpnSubnet6.SetText(current.VPNSubnet6)
+	vpnSubnet6.Validator = func(s string) error {
+		if strings.TrimSpace(s) == "" {
+			return nil
+		}
+		return vpn.ValidateSubnet(s)
+	}
+	vpnSubnet6.OnChanged = func(s string) {
+		if vpnSubnet6.Validator(s) == nil {
+			a.config.Network.VPNSubnet6 = strings.TrimSpace(s)
+			a.saveConfig()
+		}
+		showProblem()
+	}
+
+	dns := widget.NewEntry()
+	dns.SetPlaceHolder(strings.Join(vpn.DefaultDNS, ", "))
+	dns.SetText(strings.Join(current.DNS, ", "))
+	dns.Validator = func(s string) error { return vpn.ValidateDNS(vpn.SplitList(s)) }
+	dns.OnChanged = func(s string) {
+		if servers := vpn.SplitList(s); vpn.ValidateDNS(servers) == nil {
+			a.config.Network.DNS = servers
+			a.saveConfig()
+		}
+	}
+
+	var profiles []string
+	for _, p := range vpn.ProposalProfiles {
+		profiles = append(profiles, string(p))
+	}
+	proposals := widget.NewSelect(profiles, func(s string) {
+		a.config.Network.Proposals = s
+		a.saveConfig()
+	})
+	proposals.Selected = string(current.Proposals) // Set directly so opening the panel does not save
+
+	var backends []string
+	for _, b := range vpn.FirewallBackends {
+		backends = append(backends, string(b))
+	}
+	firewall := widget.NewSelect(backends, func(s string) {
+		a.config.Network.Firewall = s
+		a.saveConfig()
+	})
+	firewall.Selected = string(current.Firewall)
+
+	form := container.NewVBox(
+		container.NewGridWithColumns(2,
+			widget.NewLabel("VPN Client Subnet:"), vpnSubnet,
+			widget.NewLabel("Tunnel Subnet:"), tunnelSubnet,
+			widget.NewLabel("IPv6 Client Subnet:"), vpnSubnet6,
+			widget.NewLabel("DNS Servers:"), dns,
+			widget.NewLabel("Cipher Profile:"), proposals,
+			widget.NewLabel("Firewall:"), firewall,
+		),
+		widget.NewLabel("Client profiles use the same cipher profile; re-run setup and re-issue them after changing it."),
+		problem,
+	)
+	showProblem()
+
+	return widget.NewAccordion(widget.NewAccordionItem("VPN Network Settings", form))
+}
@@ -0,0 +1,74 @@
+package ui
+
+import (
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+// checkIcons marks the outcome of preflight checks in the checklist
+var checkIcons = map[vpn.CheckStatus]string{
+	vpn.CheckPass: "✅",
+	vpn.CheckWarn: "⚠️",
+	vpn.CheckFail: "❌",
+}
+
+// preflightCheck runs the preflight checks on all servers and shows the checklist
+func (a *App) preflightCheck() {
+	a.mu.Lock()
+	if a.isRunning {
+		a.mu.Unlock()
+		a.Log("Setup is already running")
+		return
+	}
+	a.isRunning = true
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		a.isRunning = false
+		a.mu.Unlock()
+	}()
+
+	ctx, done := a.cancellable()
+	defer done()
+
+	a.setStatus("Checking servers...")
+	reports, err := vpn.NewManager(a.setupConfig(), a).PreflightContext(ctx)
+	if err != nil {
+		a.Errorf("Preflight failed: %v", err)
+		a.setStatus("Preflight failed!")
+		return
+	}
+	a.setStatus("Ready")
+	a.showPreflight(reports)
+}
+
+// showPreflight opens a window with the pass/warn/fail checklist of every server
+func (a *App) showPreflight(reports []*vpn.PreflightReport) {
+	fyne.Do(func() {
+		tabs := container.NewAppTabs()
+		for _, r := range reports {
+			list := container.NewVBox()
+			for _, c := range r.Checks {
+				label := widget.NewLabel(fmt.Sprintf("%s %s: %s", checkIcons[c.Status], c.Name, c.Detail))
+				label.Wrapping = fyne.TextWrapWord
+				list.Add(label)
+			}
+			title := fmt.Sprintf("%s (%s)", r.Name, r.Host)
+			if len(r.Failed()) > 0 {
+				title = checkIcons[vpn.CheckFail] + " " + title
+			}
+			tabs.Append(container.NewTabItem(title, container.NewVScroll(list)))
+		}
+
+		preflightWindow := a.fyneApp.NewWindow("Preflight Checks")
+		preflightWindow.SetContent(tabs)
+		preflightWindow.Resize(fyne.NewSize(700, 450))
+		preflightWindow.Show()
+	})
+}
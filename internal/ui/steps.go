@@ -0,0 +1,106 @@
+package ui
+
+import (
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/saved"
+	"github.com/vailcody/IKEv2TunnelManager/internal/storage"
+	"github.com/vailcody/IKEv2TunnelManager/internal/vpn"
+)
+
+// stepIcons marks the status of setup steps in the step list
+var stepIcons = map[string]string{
+	string(vpn.StepPending): "⚪",
+	string(vpn.StepRunning): "⏳",
+	string(vpn.StepDone):    "✅",
+	string(vpn.StepFailed):  "❌",
+	string(vpn.StepSkipped): "⏭️",
+}
+
+// createSetupProgress builds the step list and progress bar of the Connection
+// tab, showing the last recorded setup run
+func (a *App) createSetupProgress() fyne.CanvasObject {
+	a.stepsBox = container.NewVBox()
+	a.progressBar = widget.NewProgressBar()
+	a.resumeBtn = widget.NewButton("Resume Setup", func() {
+		go a.setupVPN(true)
+	})
+
+	a.showSetupState(a.storedSetupState(), false)
+
+	return container.NewVBox(a.progressBar, a.stepsBox)
+}
+
+// showSetupState renders the steps of a setup run; nil hides the list. Resume
+// is offered for an unfinished run once it is no longer running.
+func (a *App) showSetupState(state *storage.SetupState, running bool) {
+	var lines []string
+	completed, total := 0, 0
+	resumable := false
+	if state != nil {
+		for _, step := range state.Steps {
+			line := fmt.Sprintf("%s %s", stepIcons[step.Status], step.ID)
+			if step.Error != "" {
+				line += ": " + step.Error
+			}
+			lines = append(lines, line)
+		}
+		completed, total = len(saved.CompletedSteps(state)), len(state.Steps)
+		resumable = saved.Resumable(state)
+	}
+
+	fyne.Do(func() {
+		var labels []fyne.CanvasObject
+		for _, line := range lines {
+			labels = append(labels, widget.NewLabel(line))
+		}
+		a.stepsBox.Objects = labels
+		a.stepsBox.Refresh()
+
+		if total == 0 {
+			a.progressBar.Hide()
+		} else {
+			a.progressBar.SetValue(float64(completed) / float64(total))
+			a.progressBar.Show()
+		}
+
+		if resumable && !running {
+			a.resumeBtn.Enable()
+		} else {
+			a.resumeBtn.Disable()
+		}
+	})
+}
+
+// recordSetup tracks the steps of a setup run in the step list and the setup
+// state file until the progress channel is closed
+func (a *App) recordSetup(state *storage.SetupState, events <-chan vpn.ProgressEvent) {
+	for ev := range events {
+		state.Set(saved.StepState(ev.Step))
+		a.saveSetupState(state)
+		a.showSetupState(state, true)
+	}
+}
+
+// storedSetupState returns the last saved setup run, nil if there is none
+func (a *App) storedSetupState() *storage.SetupState {
+	if a.store == nil {
+		return nil
+	}
+	state, _ := a.store.LoadSetupState()
+	return state
+}
+
+// saveSetupState writes the state file, logging failures
+func (a *App) saveSetupState(state *storage.SetupState) {
+	if a.store == nil {
+		return
+	}
+	if err := a.store.SaveSetupState(state); err != nil {
+		a.Errorf("Failed to save setup state: %v", err)
+	}
+}
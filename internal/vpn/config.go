@@ -7,8 +7,9 @@ import (
 	"github.com/google/uuid"
 )
 
-// GenerateMobileConfig creates an Apple .mobileconfig profile for IKEv2 VPN
-func GenerateMobileConfig(username, password, serverIP, caCertPEM string) []byte {
+// GenerateMobileConfig creates an Apple .mobileconfig profile for IKEv2 VPN.
+// profile must be the one the server was set up with.
+func GenerateMobileConfig(username, password, serverIP, caCertPEM string, profile ProposalProfile) []byte {
 	profileUUID := uuid.New().String()
 	payloadUUID := uuid.New().String()
 	certUUID := uuid.New().String()
@@ -16,6 +17,19 @@ func GenerateMobileConfig(username, password, serverIP, caCertPEM string) []byte
 	// Base64 encode the CA certificate (PEM format without headers)
 	caCertData := cleanPEMCert(caCertPEM)
 
+	// IKE and Child SA use the same algorithms; PFS reuses the DH group
+	apple := profile.suite().apple
+	saParams := fmt.Sprintf(`<dict>
+					<key>DiffieHellmanGroup</key>
+					<integer>%d</integer>
+					<key>EncryptionAlgorithm</key>
+					<string>%s</string>
+					<key>IntegrityAlgorithm</key>
+					<string>%s</string>
+					<key>LifeTimeInMinutes</key>
+					<integer>1440</integer>
+				</dict>`, apple.DHGroup, apple.Encryption, apple.Integrity)
+
 	config := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
 <plist version="1.0">
@@ -28,16 +42,7 @@ func GenerateMobileConfig(username, password, serverIP, caCertPEM string) []byte
 				<key>AuthenticationMethod</key>
 				<string>None</string>
 				<key>ChildSecurityAssociationParameters</key>
-				<dict>
-					<key>DiffieHellmanGroup</key>
-					<integer>14</integer>
-					<key>EncryptionAlgorithm</key>
-					<string>AES-256</string>
-					<key>IntegrityAlgorithm</key>
-					<string>SHA2-256</string>
-					<key>LifeTimeInMinutes</key>
-					<integer>1440</integer>
-				</dict>
+				%s
 				<key>DeadPeerDetectionRate</key>
 				<string>Medium</string>
 				<key>DisableMOBIKE</key>
@@ -51,16 +56,7 @@ func GenerateMobileConfig(username, password, serverIP, caCertPEM string) []byte
 				<key>ExtendedAuthEnabled</key>
 				<true/>
 				<key>IKESecurityAssociationParameters</key>
-				<dict>
-					<key>DiffieHellmanGroup</key>
-					<integer>14</integer>
-					<key>EncryptionAlgorithm</key>
-					<string>AES-256</string>
-					<key>IntegrityAlgorithm</key>
-					<string>SHA2-256</string>
-					<key>LifeTimeInMinutes</key>
-					<integer>1440</integer>
-				</dict>
+				%s
 				<key>LocalIdentifier</key>
 				<string>%s</string>
 				<key>RemoteAddress</key>
@@ -130,6 +126,7 @@ func GenerateMobileConfig(username, password, serverIP, caCertPEM string) []byte
 	<integer>1</integer>
 </dict>
 </plist>`,
+		saParams, saParams, // Child and IKE SA algorithms
 		username, serverIP, serverIP, username, password, // IKEv2 section with auth
 		serverIP, payloadUUID, payloadUUID, serverIP, // VPN payload metadata
 		caCertData, certUUID, certUUID, // Cert payload
@@ -146,8 +143,10 @@ func cleanPEMCert(pem string) string {
 	return strings.TrimSpace(pem)
 }
 
-// GetWindowsInstructions returns setup instructions for Windows
-func GetWindowsInstructions(serverIP, username, password string) string {
+// GetWindowsInstructions returns setup instructions for Windows.
+// profile must be the one the server was set up with.
+func GetWindowsInstructions(serverIP, username, password string, profile ProposalProfile) string {
+	w := profile.suite().windows
 	return fmt.Sprintf(`# Windows IKEv2 Tunnel Setup
 
 ## Шаги настройки:
@@ -167,17 +166,25 @@ func GetWindowsInstructions(serverIP, username, password string) string {
 
 3. **Нажмите "Сохранить"**
 
-4. **Подключитесь:**
+4. **Задайте алгоритмы шифрования сервера** (PowerShell от имени администратора):
+   `+"```"+`
+   Set-VpnConnectionIPsecConfiguration -ConnectionName "IKEv2 Tunnel %s" -EncryptionMethod %s -IntegrityCheckMethod %s -DHGroup %s -CipherTransformConstants %s -AuthenticationTransformConstants %s -PfsGroup %s -Force
+   `+"```"+`
+
+5. **Подключитесь:**
    - Выберите созданное подключение
    - Нажмите "Подключиться"
 
 ## Важно:
 Если подключение не работает, может потребоваться импорт CA сертификата.
-`, serverIP, serverIP, username, password)
+`, serverIP, serverIP, username, password,
+		serverIP, w.EncryptionMethod, w.IntegrityCheckMethod, w.DHGroup, w.CipherTransformConstants, w.AuthenticationTransformConstants, w.PfsGroup)
 }
 
-// GetAndroidInstructions returns setup instructions for Android
-func GetAndroidInstructions(serverIP, username, password string) string {
+// GetAndroidInstructions returns setup instructions for Android.
+// profile must be the one the server was set up with.
+func GetAndroidInstructions(serverIP, username, password string, profile ProposalProfile) string {
+	android := profile.suite().android
 	return fmt.Sprintf(`# Android IKEv2 Tunnel Setup
 
 ## Рекомендуемое приложение:
@@ -196,6 +203,8 @@ func GetAndroidInstructions(serverIP, username, password string) string {
    - Username: **%s**
    - Password: **%s**
    - CA Certificate: **Select automatically**
+   - Advanced settings → IKEv2 Algorithms: **%s**
+   - Advanced settings → IPsec/ESP Algorithms: **%s**
 
 4. **Сохраните и подключитесь**
 
@@ -203,5 +212,5 @@ func GetAndroidInstructions(serverIP, username, password string) string {
 Некоторые Android устройства поддерживают IKEv2 нативно:
 - Настройки → Сеть → Tunnel → Добавить Tunnel
 - Тип: IKEv2/IPSec PSK или IKEv2/IPSec MSCHAPv2
-`, serverIP, username, password)
+`, serverIP, username, password, strings.Join(android.IKE, ","), strings.Join(android.ESP, ","))
 }
@@ -0,0 +1,300 @@
+package vpn
+
+import (
+	_ "embed"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+)
+
+// FirewallBackend selects how the firewall rules are applied on the servers
+type FirewallBackend string
+
+const (
+	// FirewallAuto uses nftables when nft is installed and iptables is
+	// missing or itself backed by nf_tables, iptables otherwise
+	FirewallAuto FirewallBackend = "auto"
+	// FirewallIptables inserts the rules with iptables/ip6tables and saves them with netfilter-persistent
+	FirewallIptables FirewallBackend = "iptables"
+	// FirewallNftables keeps the rules in a dedicated nftables table loaded by nftables.service
+	FirewallNftables FirewallBackend = "nftables"
+)
+
+// DefaultFirewallBackend is used when none is configured
+const DefaultFirewallBackend = FirewallAuto
+
+// FirewallBackends lists the available backends
+var FirewallBackends = []FirewallBackend{FirewallAuto, FirewallIptables, FirewallNftables}
+
+// nftables table and the file it is persisted in; nftables.conf includes the file
+const (
+	nftTable       = "ikev2tm"
+	nftRulesPath   = "/etc/nftables.d/ikev2tm.nft"
+	nftMainPath    = "/etc/nftables.conf"
+	nftIncludeLine = `include "` + nftRulesPath + `"`
+)
+
+// iptables chains holding the rules; the built-in chains only jump to them
+const (
+	iptablesInputChain   = "IKEV2TM-INPUT"
+	iptablesForwardChain = "IKEV2TM-FORWARD"
+	iptablesNatChain     = "IKEV2TM-POSTROUTING"
+)
+
+// ValidateFirewallBackend checks that b names a known backend; empty selects the default
+func ValidateFirewallBackend(b FirewallBackend) error {
+	if b == "" {
+		return nil
+	}
+	for _, known := range FirewallBackends {
+		if b == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown firewall backend %q, expected auto, iptables or nftables", b)
+}
+
+//go:embed templates/nftables.conf.tmpl
+var nftTemplateText string
+
+var nftTemplates = template.Must(template.New("nftables").Funcs(template.FuncMap{
+	"family": func(p netip.Prefix) string {
+		if p.Addr().Is4() {
+			return "ip"
+		}
+		return "ip6"
+	},
+}).Parse(nftTemplateText))
+
+// natSubnet is a subnet whose traffic is forwarded and NATed on one hop
+type natSubnet struct {
+	Subnet netip.Prefix
+	Iface  string // Interface with the default route of the subnet's family
+}
+
+// firewallModel describes the rules of one hop independently of the backend
+type firewallModel struct {
+	Table   string      // nftables table name
+	SSHPort int         // Port the server's SSH daemon listens on
+	Subnets []natSubnet // VPN and tunnel subnets, IPv4 first
+	IPv6    bool        // Also accept IKE and SSH over IPv6; iptables needs ip6tables for that
+}
+
+// renderNftables renders the firewall as an nftables table
+func renderNftables(fw *firewallModel) (string, error) {
+	var b strings.Builder
+	if err := nftTemplates.ExecuteTemplate(&b, "nftables.conf", fw); err != nil {
+		return "", fmt.Errorf("failed to render nftables.conf: %w", err)
+	}
+	return b.String(), nil
+}
+
+// renderIptables renders the firewall as iptables and ip6tables commands. The
+// rules live in dedicated chains that iptables-restore replaces atomically, and
+// the built-in chains get a single jump to them, so re-runs do not add duplicates.
+func renderIptables(fw *firewallModel) string {
+	var script strings.Builder
+	families := []string{"iptables"}
+	if fw.IPv6 {
+		families = append(families, "ip6tables")
+	}
+	for _, cmd := range families {
+		var subnets []natSubnet
+		for _, s := range fw.Subnets {
+			if (cmd == "ip6tables") != s.Subnet.Addr().Is4() {
+				subnets = append(subnets, s)
+			}
+		}
+
+		// SSH first so the session survives whatever follows
+		var rules strings.Builder
+		fmt.Fprintf(&rules, "*filter\n:%[1]s - [0:0]\n:%[2]s - [0:0]\n", iptablesInputChain, iptablesForwardChain)
+		for _, rule := range []string{fmt.Sprintf("-p tcp --dport %d", fw.SSHPort), "-p udp --dport 500", "-p udp --dport 4500", "-p esp"} {
+			fmt.Fprintf(&rules, "-A %s %s -j ACCEPT\n", iptablesInputChain, rule)
+		}
+		fmt.Fprintf(&rules, "-A %s -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n", iptablesForwardChain)
+		for _, s := range subnets {
+			fmt.Fprintf(&rules, "-A %s -s %s -j ACCEPT\n", iptablesForwardChain, s.Subnet)
+		}
+		fmt.Fprintf(&rules, "COMMIT\n*nat\n:%s - [0:0]\n", iptablesNatChain)
+		for _, s := range subnets {
+			// Skip NAT for traffic going through an IPsec tunnel, NAT the rest
+			fmt.Fprintf(&rules, "-A %s -s %s -m policy --pol ipsec --dir out -j ACCEPT\n", iptablesNatChain, s.Subnet)
+			fmt.Fprintf(&rules, "-A %s -s %s -o %s -j MASQUERADE\n", iptablesNatChain, s.Subnet, s.Iface)
+		}
+		rules.WriteString("COMMIT\n")
+
+		fmt.Fprintf(&script, `
+		# Replace the contents of the dedicated chains
+		sudo %[1]s-restore --noflush <<'%[2]s'
+%[3]s%[2]s
+
+		# Jump to them ahead of other rules, once
+		sudo %[1]s -C INPUT -j %[4]s 2>/dev/null || sudo %[1]s -I INPUT 1 -j %[4]s
+		sudo %[1]s -C FORWARD -j %[5]s 2>/dev/null || sudo %[1]s -I FORWARD 1 -j %[5]s
+		sudo %[1]s -t nat -C POSTROUTING -j %[6]s 2>/dev/null || sudo %[1]s -t nat -I POSTROUTING 1 -j %[6]s
+`, cmd, iptablesHeredoc, rules.String(), iptablesInputChain, iptablesForwardChain, iptablesNatChain)
+
+		script.WriteString(iptablesLegacyCleanup(cmd, subnets))
+	}
+	return script.String()
+}
+
+// iptablesLegacyCleanup returns commands deleting every copy of the rules
+// earlier versions inserted into the built-in chains on every run
+func iptablesLegacyCleanup(cmd string, subnets []natSubnet) string {
+	var script strings.Builder
+	script.WriteString("\n\t\t# Remove rules earlier versions added to the built-in chains\n")
+	legacy := []string{
+		"INPUT -p tcp --dport 22 -j ACCEPT",
+		"INPUT -p udp --dport 500 -j ACCEPT",
+		"INPUT -p udp --dport 4500 -j ACCEPT",
+		"INPUT -p esp -j ACCEPT",
+		"FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+	}
+	for _, s := range subnets {
+		legacy = append(legacy,
+			fmt.Sprintf("FORWARD -s %s -j ACCEPT", s.Subnet),
+			fmt.Sprintf("-t nat -D POSTROUTING -s %s -m policy --pol ipsec --dir out -j ACCEPT", s.Subnet),
+			fmt.Sprintf("-t nat -D POSTROUTING -s %s -o %s -j MASQUERADE", s.Subnet, s.Iface))
+	}
+	for _, rule := range legacy {
+		if !strings.HasPrefix(rule, "-t nat") {
+			rule = "-D " + rule
+		}
+		fmt.Fprintf(&script, "\t\twhile sudo %s %s 2>/dev/null; do :; done\n", cmd, rule)
+	}
+	return script.String()
+}
+
+// iptablesHeredoc terminates the rules passed to iptables-restore
+const iptablesHeredoc = "IKEV2TM_RULES"
+
+// firewallBackend returns the configured backend or, for FirewallAuto, the one
+// detected on the server
+func (m *Manager) firewallBackend(n *node) FirewallBackend {
+	if b := m.config.Firewall; b != "" && b != FirewallAuto {
+		return b
+	}
+	out, _ := m.probe(n, `
+		command -v nft >/dev/null && echo nft
+		command -v iptables >/dev/null && iptables -V 2>/dev/null
+		grep -qs '^ENABLED=yes' /etc/ufw/ufw.conf && echo ufw
+		systemctl is-active --quiet docker 2>/dev/null && echo docker
+		sudo -n iptables -S 2>/dev/null | grep '^-P '
+		sudo -n ip6tables -S 2>/dev/null | grep '^-P '
+		true
+	`)
+	backend, reason := detectFirewallBackend(out)
+	if reason != "" {
+		m.note(n, "Using the iptables firewall backend: %s", reason)
+	}
+	return backend
+}
+
+// detectFirewallBackend picks the backend from the firewallBackend probe and
+// explains when nftables is available but iptables is chosen. An accept in the
+// inet ikev2tm table does not override a drop in another table's base chain,
+// so the rules go into the iptables chains whenever something else filters
+// there: ufw, Docker or a non-accepting INPUT or FORWARD policy.
+func detectFirewallBackend(out string) (FirewallBackend, string) {
+	lines := strings.Split(out, "\n")
+	hasNft := slices.Contains(lines, "nft")
+	hasIptables := strings.Contains(out, "iptables v")
+	if !hasNft || (hasIptables && !strings.Contains(out, "nf_tables")) {
+		return FirewallIptables, ""
+	}
+	for _, manager := range []string{"ufw", "docker"} {
+		if slices.Contains(lines, manager) {
+			return FirewallIptables, manager + " manages the iptables chains"
+		}
+	}
+	for _, line := range lines {
+		// -P FORWARD DROP
+		if f := strings.Fields(line); len(f) == 3 && f[0] == "-P" && (f[1] == "INPUT" || f[1] == "FORWARD") && f[2] != "ACCEPT" {
+			return FirewallIptables, fmt.Sprintf("the iptables %s policy is %s", f[1], f[2])
+		}
+	}
+	return FirewallNftables, ""
+}
+
+// firewallModel builds the rules for node n
+func (m *Manager) firewallModel(n *node) (*firewallModel, error) {
+	iface, _, err := m.defaultRoute(n, false)
+
+	fw := &firewallModel{Table: nftTable, SSHPort: n.config.Port, IPv6: m.config.dualStack() || isIPv6(n.config.Host)}
+	if fw.SSHPort == 0 {
+		fw.SSHPort = ssh.DefaultPort
+	}
+	if !fw.IPv6 && err != nil {
+		return nil, err
+	}
+	iface6 := iface
+	if fw.IPv6 {
+		if out, _, err := m.defaultRoute(n, true); err == nil {
+			iface6 = out
+		}
+		if iface == "" {
+			// IPv6-only server: the IPv4 subnets are only NATed if it gains an IPv4 route
+			iface = iface6
+		}
+	}
+
+	for _, subnet := range m.config.subnets() {
+		s := natSubnet{Subnet: subnet, Iface: iface}
+		if subnet.Addr().Is6() {
+			s.Iface = iface6
+		}
+		fw.Subnets = append(fw.Subnets, s)
+	}
+	return fw, nil
+}
+
+// configureFirewall applies the rules with the backend of the server and
+// makes them survive a reboot
+func (m *Manager) configureFirewall(n *node) error {
+	fw, err := m.firewallModel(n)
+	if err != nil {
+		return err
+	}
+
+	if m.firewallBackend(n) == FirewallNftables {
+		m.note(n, "Using the nftables backend (table inet %s)", nftTable)
+		conf, err := renderNftables(fw)
+		if err != nil {
+			return err
+		}
+		if _, err := m.run(n, "sudo mkdir -p /etc/nftables.d"); err != nil {
+			return err
+		}
+		if _, err := m.ensureFile(n, nftRulesPath, conf); err != nil {
+			return err
+		}
+		// nftables.service loads nftables.conf at boot; include the table from there
+		_, err = m.run(n, fmt.Sprintf(`
+		sudo nft -f %[1]s
+		grep -qsF '%[2]s' %[3]s || echo '%[2]s' | sudo tee -a %[3]s >/dev/null
+		sudo systemctl enable nftables
+	`, nftRulesPath, nftIncludeLine, nftMainPath))
+		return err
+	}
+
+	m.note(n, "Using the iptables backend")
+	script := renderIptables(fw) + `
+		# Persistent rules; iptables-persistent conflicts with ufw, which keeps its own rules
+		if ! command -v netfilter-persistent >/dev/null && ! command -v ufw >/dev/null; then
+			echo 'iptables-persistent iptables-persistent/autosave_v4 boolean false' | sudo debconf-set-selections
+			echo 'iptables-persistent iptables-persistent/autosave_v6 boolean false' | sudo debconf-set-selections
+			sudo DEBIAN_FRONTEND=noninteractive apt-get install -y iptables-persistent
+		fi
+		if command -v netfilter-persistent >/dev/null; then
+			sudo netfilter-persistent save
+		fi
+	`
+	_, err = m.run(n, script)
+	return err
+}
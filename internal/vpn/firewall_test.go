@@ -0,0 +1,174 @@
+package vpn
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+)
+
+var restorePattern = regexp.MustCompile(`(?s)(ip6?tables)-restore --noflush <<'` + iptablesHeredoc + `'\n(.*?)\n` + iptablesHeredoc + `\n`)
+
+// restoredRules returns the last input passed to iptables-restore and ip6tables-restore
+func restoredRules(t *testing.T, f *sshtest.Fake) map[string]string {
+	t.Helper()
+	rules := make(map[string]string)
+	for _, cmd := range f.Commands() {
+		for _, m := range restorePattern.FindAllStringSubmatch(cmd, -1) {
+			rules[m[1]] = m[2]
+		}
+	}
+	return rules
+}
+
+func TestNftablesGolden(t *testing.T) {
+	m, _ := newTestManager([]string{entryHost, exitHost}, nil, freshServer("203.0.113.1", "CA2"))
+	m.config.VPNSubnet6 = ExampleVPNSubnet6
+	if err := m.connectServers(); err != nil {
+		t.Fatalf("connectServers: %v", err)
+	}
+
+	fw, err := m.firewallModel(m.nodes[1])
+	if err != nil {
+		t.Fatalf("firewallModel: %v", err)
+	}
+	conf, err := renderNftables(fw)
+	if err != nil {
+		t.Fatalf("renderNftables: %v", err)
+	}
+	checkGolden(t, "nftables-dualstack.nft", conf)
+}
+
+func TestIptablesGolden(t *testing.T) {
+	m, _ := newTestManager([]string{entryHost, exitHost}, nil, freshServer("203.0.113.1", "CA2"))
+	m.config.VPNSubnet6 = ExampleVPNSubnet6
+	if err := m.connectServers(); err != nil {
+		t.Fatalf("connectServers: %v", err)
+	}
+
+	fw, err := m.firewallModel(m.nodes[1])
+	if err != nil {
+		t.Fatalf("firewallModel: %v", err)
+	}
+	checkGolden(t, "iptables-dualstack.sh", dedent(renderIptables(fw)))
+}
+
+func TestFirewallSSHPort(t *testing.T) {
+	m, _ := newTestManager([]string{entryHost}, freshServer("198.51.100.1", "CA1"))
+	m.config.Hops[0].Server.Port = 2222
+	if err := m.connectServers(); err != nil {
+		t.Fatalf("connectServers: %v", err)
+	}
+
+	fw, err := m.firewallModel(m.nodes[0])
+	if err != nil {
+		t.Fatalf("firewallModel: %v", err)
+	}
+	conf, err := renderNftables(fw)
+	if err != nil {
+		t.Fatalf("renderNftables: %v", err)
+	}
+	if !strings.Contains(conf, "tcp dport 2222 accept") || strings.Contains(conf, "dport 22 ") {
+		t.Errorf("nftables does not accept SSH on port 2222:\n%s", conf)
+	}
+	script := renderIptables(fw)
+	if !strings.Contains(script, "-A "+iptablesInputChain+" -p tcp --dport 2222 -j ACCEPT") || strings.Contains(script, "-A "+iptablesInputChain+" -p tcp --dport 22 ") {
+		t.Errorf("iptables does not accept SSH on port 2222:\n%s", script)
+	}
+	// Earlier versions always inserted port 22
+	if !strings.Contains(script, "iptables -D INPUT -p tcp --dport 22 -j ACCEPT") {
+		t.Errorf("legacy SSH rule not removed:\n%s", script)
+	}
+}
+
+func TestSetupAllConverges(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	server1.SetFile(sysctlConfPath, m.sysctlConf())
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	if _, ok := writtenFiles(t, server1)[sysctlConfPath]; ok {
+		t.Error("unchanged sysctl drop-in rewritten")
+	}
+	if server1.Ran("tee -a /etc/sysctl.conf") {
+		t.Error("sysctl.conf appended to")
+	}
+	if want := "iptables -C INPUT -j IKEV2TM-INPUT 2>/dev/null || sudo iptables -I INPUT 1 -j IKEV2TM-INPUT"; !server1.Ran(want) {
+		t.Errorf("missing guarded command %q", want)
+	}
+	// Policy rules are only added by the routing script when missing
+	routing := writtenFiles(t, server1)[routingScriptPath]
+	for _, want := range []string{
+		`grep -qF "from $3 lookup $4" || ip "$1" rule add`,
+		"add_rule -4 220 " + DefaultVPNSubnet + " 220",
+		"add_rule -4 100 " + entryHost + " main",
+	} {
+		if !strings.Contains(routing, want) {
+			t.Errorf("routing script missing %q:\n%s", want, routing)
+		}
+	}
+	if server1.Ran("iptables -A INPUT") || server1.Ran("iptables -I INPUT 1 -p") {
+		t.Error("rules added to the built-in chains")
+	}
+}
+
+func TestFirewallBackendDetection(t *testing.T) {
+	tests := []struct {
+		name, output string
+		configured   FirewallBackend
+		want         FirewallBackend
+	}{
+		{"nft only", "nft\n", FirewallAuto, FirewallNftables},
+		{"iptables-nft", "nft\niptables v1.8.9 (nf_tables)\n-P INPUT ACCEPT\n-P FORWARD ACCEPT\n", FirewallAuto, FirewallNftables},
+		{"iptables-nft with ufw", "nft\niptables v1.8.9 (nf_tables)\nufw\n", FirewallAuto, FirewallIptables},
+		{"iptables-nft with docker", "nft\niptables v1.8.9 (nf_tables)\ndocker\n-P FORWARD DROP\n", FirewallAuto, FirewallIptables},
+		{"iptables-nft dropping forward", "nft\niptables v1.8.10 (nf_tables)\n-P INPUT ACCEPT\n-P FORWARD DROP\n-P OUTPUT ACCEPT\n", FirewallAuto, FirewallIptables},
+		{"ip6tables-nft dropping input", "nft\niptables v1.8.9 (nf_tables)\n-P INPUT ACCEPT\n-P INPUT DROP\n", FirewallAuto, FirewallIptables},
+		{"dropping output only", "nft\niptables v1.8.9 (nf_tables)\n-P OUTPUT DROP\n", FirewallAuto, FirewallNftables},
+		{"iptables-legacy", "nft\niptables v1.8.7 (legacy)\n", FirewallAuto, FirewallIptables},
+		{"iptables only", "iptables v1.8.4 (legacy)\n", FirewallAuto, FirewallIptables},
+		{"nothing", "", FirewallAuto, FirewallIptables},
+		{"forced iptables", "nft\n", FirewallIptables, FirewallIptables},
+	}
+	for _, tt := range tests {
+		f := sshtest.NewFake().On("command -v nft", tt.output)
+		m, _ := newTestManager([]string{entryHost}, f)
+		m.config.Firewall = tt.configured
+		n := newNode("Server 1", m.config.Hops[0].Server, f)
+		if got := m.firewallBackend(n); got != tt.want {
+			t.Errorf("%s: firewallBackend = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetupAllNftables(t *testing.T) {
+	nftServer := func(gateway, caCert string) *sshtest.Fake {
+		return freshServer(gateway, caCert).On("command -v nft", "nft\niptables v1.8.9 (nf_tables)\n")
+	}
+	server1, server2 := nftServer("198.51.100.1", "CA1"), nftServer("203.0.113.1", "CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	for name, f := range map[string]*sshtest.Fake{"server1": server1, "server2": server2} {
+		if f.Ran("iptables -I INPUT") || f.Ran("netfilter-persistent") {
+			t.Errorf("%s: iptables used with the nftables backend", name)
+		}
+		conf := writtenFiles(t, f)[nftRulesPath]
+		if !strings.Contains(conf, "table inet ikev2tm {") || !strings.Contains(conf, `ip saddr 10.10.10.0/24 oifname "eth0" masquerade`) {
+			t.Errorf("%s: unexpected nftables table:\n%s", name, conf)
+		}
+		for _, step := range []string{"nft -f " + nftRulesPath, nftIncludeLine, "systemctl enable nftables"} {
+			if !f.Ran(step) {
+				t.Errorf("%s: missing step %q", name, step)
+			}
+		}
+	}
+}
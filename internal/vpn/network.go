@@ -0,0 +1,224 @@
+package vpn
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// DefaultDNS is pushed to VPN clients unless other servers are configured
+var DefaultDNS = []string{"8.8.8.8", "8.8.4.4"}
+
+// ExampleVPNSubnet6 is suggested for the IPv6 client pool, which is disabled by default
+const ExampleVPNSubnet6 = "fd10:10:10::/64"
+
+// ValidateSubnet checks that s is a network in CIDR notation, e.g. "10.10.10.0/24"
+func ValidateSubnet(s string) error {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: expected CIDR notation like 10.10.10.0/24", s)
+	}
+	if prefix != prefix.Masked() {
+		return fmt.Errorf("invalid subnet %q: host bits are set, did you mean %s?", s, prefix.Masked())
+	}
+	return nil
+}
+
+// ValidateDNS checks that every entry is an IP address
+func ValidateDNS(servers []string) error {
+	if len(servers) == 0 {
+		return fmt.Errorf("at least one DNS server is required")
+	}
+	for _, s := range servers {
+		if _, err := netip.ParseAddr(s); err != nil {
+			return fmt.Errorf("invalid DNS server %q: expected an IP address", s)
+		}
+	}
+	return nil
+}
+
+// SplitList splits a comma or space separated list, as entered in settings
+func SplitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// SetDefaults fills empty network, proposal and firewall settings with the defaults
+func (c *SetupConfig) SetDefaults() {
+	if c.VPNSubnet == "" {
+		c.VPNSubnet = DefaultVPNSubnet
+	}
+	if c.TunnelSubnet == "" {
+		c.TunnelSubnet = DefaultTunnelSubnet
+	}
+	if len(c.DNS) == 0 {
+		c.DNS = DefaultDNS
+	}
+	if c.Proposals == "" {
+		c.Proposals = DefaultProposalProfile
+	}
+	if c.Firewall == "" {
+		c.Firewall = DefaultFirewallBackend
+	}
+}
+
+// ValidateNetwork checks the subnets, DNS servers, proposal profile and firewall backend and that the two subnets do not overlap
+func (c *SetupConfig) ValidateNetwork() error {
+	if err := ValidateSubnet(c.VPNSubnet); err != nil {
+		return fmt.Errorf("VPN subnet: %w", err)
+	}
+	if err := ValidateSubnet(c.TunnelSubnet); err != nil {
+		return fmt.Errorf("tunnel subnet: %w", err)
+	}
+	if c.VPNSubnet6 != "" {
+		if err := ValidateSubnet(c.VPNSubnet6); err != nil {
+			return fmt.Errorf("IPv6 VPN subnet: %w", err)
+		}
+	}
+	if err := ValidateDNS(c.DNS); err != nil {
+		return err
+	}
+	if err := ValidateProposalProfile(c.Proposals); err != nil {
+		return err
+	}
+	if err := ValidateFirewallBackend(c.Firewall); err != nil {
+		return err
+	}
+
+	subnets := c.subnets()
+	if !subnets[0].Addr().Is4() {
+		return fmt.Errorf("VPN subnet %s must be IPv4, use the IPv6 subnet for IPv6 clients", subnets[0])
+	}
+	if !subnets[1].Addr().Is4() {
+		return fmt.Errorf("tunnel subnet %s must be IPv4", subnets[1])
+	}
+	if c.dualStack() && !subnets[2].Addr().Is6() {
+		return fmt.Errorf("IPv6 VPN subnet %s must be IPv6", subnets[2])
+	}
+	if subnets[0].Overlaps(subnets[1]) {
+		return fmt.Errorf("VPN subnet %s overlaps tunnel subnet %s", subnets[0], subnets[1])
+	}
+	return nil
+}
+
+// subnetKinds names the entries of subnets() in error messages
+var subnetKinds = []string{"VPN", "tunnel", "IPv6 VPN"}
+
+// subnets returns the VPN and tunnel subnets followed by the IPv6 VPN subnet
+// when dual-stack is enabled; they must have been validated
+func (c *SetupConfig) subnets() []netip.Prefix {
+	subnets := []netip.Prefix{
+		netip.MustParsePrefix(strings.TrimSpace(c.VPNSubnet)),
+		netip.MustParsePrefix(strings.TrimSpace(c.TunnelSubnet)),
+	}
+	if c.dualStack() {
+		subnets = append(subnets, netip.MustParsePrefix(strings.TrimSpace(c.VPNSubnet6)))
+	}
+	return subnets
+}
+
+// dualStack reports whether VPN clients also get IPv6 addresses
+func (c *SetupConfig) dualStack() bool {
+	return c.VPNSubnet6 != ""
+}
+
+// anyTS is the traffic selector for all destinations of the enabled families
+func (c *SetupConfig) anyTS() string {
+	if c.dualStack() {
+		return "0.0.0.0/0, ::/0"
+	}
+	return "0.0.0.0/0"
+}
+
+// clientTS is the traffic selector for the client addresses
+func (c *SetupConfig) clientTS() string {
+	if c.dualStack() {
+		return c.VPNSubnet + ", " + c.VPNSubnet6
+	}
+	return c.VPNSubnet
+}
+
+// isIPv6 reports whether host is an IPv6 address rather than an IPv4 address or name
+func isIPv6(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.Is6() && !addr.Is4In6()
+}
+
+// ipFamily returns the ip option selecting the address family of host
+func ipFamily(host string) string {
+	if isIPv6(host) {
+		return "-6"
+	}
+	return "-4"
+}
+
+// parseRoutes returns the destinations of "ip route show" output. Host
+// routes without a prefix length are returned as /32 (or /128).
+func parseRoutes(output string) []netip.Prefix {
+	var routes []netip.Prefix
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		dst := fields[0]
+		// Route types such as "unreachable 10.0.0.0/8" precede the destination
+		switch dst {
+		case "unicast", "local", "broadcast", "unreachable", "blackhole", "prohibit", "throw":
+			if len(fields) < 2 {
+				continue
+			}
+			dst = fields[1]
+		}
+		if prefix, err := netip.ParsePrefix(dst); err == nil {
+			routes = append(routes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(dst); err == nil {
+			routes = append(routes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return routes
+}
+
+// checkNetworks fails if the VPN or tunnel subnet overlaps a network the
+// server already routes, such as its LAN, a Docker bridge or another VPN
+func (m *Manager) checkNetworks(n *node) error {
+	output, err := m.probe(n, "ip -4 route show table main")
+	if err != nil {
+		return fmt.Errorf("failed to read routes: %w", err)
+	}
+	if m.config.dualStack() {
+		output6, err := m.probe(n, "ip -6 route show table main")
+		if err != nil {
+			return fmt.Errorf("failed to read IPv6 routes: %w", err)
+		}
+		output += "\n" + output6
+	}
+
+	for _, route := range parseRoutes(output) {
+		if route.Bits() == 0 {
+			continue // default route
+		}
+		for i, subnet := range m.config.subnets() {
+			if !subnet.Overlaps(route) {
+				continue
+			}
+			// Host routes to the neighbours are added by setupRouting
+			if route.IsSingleIP() && m.isHopAddress(route.Addr()) {
+				continue
+			}
+			return fmt.Errorf("%s subnet %s overlaps existing network %s on %s", subnetKinds[i], subnet, route, n.name)
+		}
+	}
+	return nil
+}
+
+// isHopAddress reports whether addr is the address of one of the servers
+func (m *Manager) isHopAddress(addr netip.Addr) bool {
+	for _, hop := range m.config.ActiveHops() {
+		if a, err := netip.ParseAddr(hop.Server.Host); err == nil && a == addr {
+			return true
+		}
+	}
+	return false
+}
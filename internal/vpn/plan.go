@@ -0,0 +1,141 @@
+package vpn
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+)
+
+// PlanStep is a single action the Manager performs on a server
+type PlanStep struct {
+	Comment string `json:"comment,omitempty"` // What the following steps do
+	Command string `json:"command,omitempty"` // Shell command run on the server
+	Path    string `json:"path,omitempty"`    // File written on the server
+	Content string `json:"content,omitempty"` // Content of the written file
+}
+
+// ServerPlan lists the actions for one server in execution order
+type ServerPlan struct {
+	Name  string     `json:"name"`
+	Host  string     `json:"host"`
+	Steps []PlanStep `json:"steps"`
+}
+
+// Plan holds the actions SetupAll would perform, per server
+type Plan struct {
+	Servers []*ServerPlan `json:"servers"`
+}
+
+// planHeredoc terminates file contents in rendered scripts
+const planHeredoc = "IKEV2TM_EOF"
+
+// Script renders the plan as a shell script that could be reviewed or run by hand
+func (p *ServerPlan) Script() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/bash\n# Setup plan for %s (%s)\nset -e\n", p.Name, p.Host)
+
+	for _, step := range p.Steps {
+		switch {
+		case step.Comment != "":
+			fmt.Fprintf(&b, "\n# %s\n", step.Comment)
+		case step.Path != "":
+			fmt.Fprintf(&b, "sudo tee %s >/dev/null <<'%s'\n%s", step.Path, planHeredoc, step.Content)
+			if !strings.HasSuffix(step.Content, "\n") {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "%s\n", planHeredoc)
+		default:
+			fmt.Fprintf(&b, "%s\n", strings.TrimSpace(dedent(step.Command)))
+		}
+	}
+	return b.String()
+}
+
+// node is one server taking part in the setup
+type node struct {
+	name   string
+	config *ssh.ServerConfig
+	client ssh.Executor
+	plan   *ServerPlan
+}
+
+// note logs progress for a node and records it as a comment in plan mode
+func (m *Manager) note(n *node, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	m.logger.Logf("[%s] %s", n.name, msg)
+	if m.planning {
+		n.plan.Steps = append(n.plan.Steps, PlanStep{Comment: msg})
+	}
+}
+
+// probe runs a read-only command; it is executed even in plan mode
+func (m *Manager) probe(n *node, command string) (string, error) {
+	return n.client.RunContext(m.ctx, command)
+}
+
+// run executes a command that changes the server; in plan mode it is only recorded
+func (m *Manager) run(n *node, command string) (string, error) {
+	if m.planning {
+		n.plan.Steps = append(n.plan.Steps, PlanStep{Command: command})
+		return "", nil
+	}
+	return n.client.RunContext(m.ctx, command)
+}
+
+// writeFile writes a root-owned file on the server; in plan mode it is only recorded
+func (m *Manager) writeFile(n *node, path, content string) error {
+	if m.planning {
+		n.plan.Steps = append(n.plan.Steps, PlanStep{Path: path, Content: content})
+		return nil
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	_, err := n.client.RunContext(m.ctx, fmt.Sprintf("echo '%s' | base64 -d | sudo tee %s >/dev/null", encoded, path))
+	return err
+}
+
+// ensureFile writes path unless it already has the given content and reports
+// whether it was written. In plan mode a changed file is recorded.
+func (m *Manager) ensureFile(n *node, path, content string) (bool, error) {
+	if current, err := n.client.ReadFileContext(m.ctx, path); err == nil && string(current) == content {
+		return false, nil
+	}
+	return true, m.writeFile(n, path, content)
+}
+
+// readFile reads a file from the server. In plan mode a file that does not exist
+// yet (because an earlier step would create it) is replaced by a placeholder.
+func (m *Manager) readFile(n *node, path string) (string, error) {
+	data, err := n.client.ReadFileContext(m.ctx, path)
+	if err != nil && m.planning && m.ctx.Err() == nil {
+		return fmt.Sprintf("<contents of %s on %s>\n", path, n.name), nil
+	}
+	return string(data), err
+}
+
+// dedent strips the common leading tabs of embedded multi-line scripts
+func dedent(script string) string {
+	lines := strings.Split(script, "\n")
+	indent := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, "\t"))
+		if indent == -1 || n < indent {
+			indent = n
+		}
+	}
+	if indent <= 0 {
+		return script
+	}
+	for i, line := range lines {
+		if len(line) >= indent {
+			lines[i] = line[indent:]
+		} else {
+			lines[i] = strings.TrimLeft(line, "\t")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,411 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckStatus is the outcome of a preflight check
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "pass"
+	CheckWarn CheckStatus = "warn" // Setup can run, but part of the VPN may not work
+	CheckFail CheckStatus = "fail" // Setup would fail or leave a broken VPN
+)
+
+// Check is the result of one preflight check
+type Check struct {
+	Name   string      `json:"name"`
+	Status CheckStatus `json:"status"`
+	Detail string      `json:"detail"`
+}
+
+// PreflightReport lists the preflight checks of one server
+type PreflightReport struct {
+	Name   string  `json:"name"`
+	Host   string  `json:"host"`
+	Checks []Check `json:"checks"`
+}
+
+// Failed returns the checks that failed
+func (r *PreflightReport) Failed() []Check {
+	var failed []Check
+	for _, c := range r.Checks {
+		if c.Status == CheckFail {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// PreflightError is returned by SetupAll when a preflight check fails; no
+// server has been changed
+type PreflightError struct {
+	Reports []*PreflightReport
+}
+
+func (e *PreflightError) Error() string {
+	var problems []string
+	for _, r := range e.Reports {
+		for _, c := range r.Failed() {
+			problems = append(problems, fmt.Sprintf("%s: %s: %s", r.Name, c.Name, c.Detail))
+		}
+	}
+	return "preflight checks failed: " + strings.Join(problems, "; ")
+}
+
+// Preflight checks that every server can run the VPN without changing
+// anything. SetupAll runs the same checks and stops if one fails.
+func (m *Manager) Preflight() ([]*PreflightReport, error) {
+	return m.PreflightContext(context.Background())
+}
+
+// PreflightContext is Preflight with the remote commands bound to ctx
+func (m *Manager) PreflightContext(ctx context.Context) ([]*PreflightReport, error) {
+	if err := m.config.Validate(); err != nil {
+		return nil, err
+	}
+	defer m.bind(ctx)()
+
+	if err := m.connectServers(); err != nil {
+		return nil, err
+	}
+	defer m.disconnectServers()
+
+	reports := m.preflight()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// preflight runs the checks on the connected servers, logging each result
+func (m *Manager) preflight() []*PreflightReport {
+	m.logger.Log("Running preflight checks...")
+
+	var reports []*PreflightReport
+	for _, n := range m.nodes {
+		report := &PreflightReport{Name: n.name, Host: n.config.Host}
+		for _, check := range []func(*node) Check{
+			m.checkOS, m.checkSudo, m.checkDiskSpace, m.checkPackageLock,
+			m.checkContainer, m.checkKernelIPsec, m.checkIKEPorts, m.checkDefaultRoute, m.checkClock,
+		} {
+			c := check(n)
+			switch c.Status {
+			case CheckFail:
+				m.logger.Errorf("[%s] %s: %s", n.name, c.Name, c.Detail)
+			case CheckWarn:
+				m.logger.Logf("[%s] Warning: %s: %s", n.name, c.Name, c.Detail)
+			default:
+				m.note(n, "%s: %s", c.Name, c.Detail)
+			}
+			report.Checks = append(report.Checks, c)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// Minimum releases shipping charon-systemd and swanctl with the features used
+var minOSVersions = map[string]float64{
+	"ubuntu": 20.04,
+	"debian": 11,
+}
+
+// checkOS requires an apt-based distribution and warns about untested ones
+func (m *Manager) checkOS(n *node) Check {
+	out, err := m.probe(n, `. /etc/os-release 2>/dev/null; echo "$ID|$VERSION_ID|$ID_LIKE|$PRETTY_NAME"; command -v apt-get >/dev/null && echo apt || true`)
+	if err != nil {
+		return Check{"Operating system", CheckFail, fmt.Sprintf("failed to read /etc/os-release: %v", err)}
+	}
+	return osCheck(out)
+}
+
+// osCheck evaluates the output of the checkOS probe
+func osCheck(out string) Check {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.SplitN(lines[0], "|", 4)
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	id, version, like, name := fields[0], fields[1], fields[2], fields[3]
+	if name == "" {
+		name = "unknown system"
+	}
+	c := Check{Name: "Operating system", Status: CheckPass, Detail: name}
+
+	if lines[len(lines)-1] != "apt" {
+		c.Status, c.Detail = CheckFail, name+" is not supported, setup installs StrongSwan with apt-get (Debian or Ubuntu)"
+		return c
+	}
+	minVersion, known := minOSVersions[id]
+	if !known {
+		c.Status = CheckWarn
+		if strings.Contains(like, "debian") || strings.Contains(like, "ubuntu") {
+			c.Detail = name + " is untested, only Debian and Ubuntu are supported"
+		} else {
+			c.Detail = name + " is not Debian or Ubuntu, package names may differ"
+		}
+		return c
+	}
+	if v, err := strconv.ParseFloat(version, 64); err != nil || v < minVersion {
+		c.Status = CheckWarn
+		c.Detail = fmt.Sprintf("%s is older than %s %g, its StrongSwan may lack swanctl features", name, id, minVersion)
+	}
+	return c
+}
+
+// checkSudo requires sudo without a password prompt, which every step uses
+func (m *Manager) checkSudo(n *node) Check {
+	if _, err := m.probe(n, "sudo -n true"); err != nil {
+		return Check{"Passwordless sudo", CheckFail, fmt.Sprintf("sudo needs a password for %s or is not installed: %v", n.config.User, err)}
+	}
+	return Check{"Passwordless sudo", CheckPass, "available"}
+}
+
+// Free space apt needs in /var for the StrongSwan packages
+const (
+	minFreeSpaceMB = 200
+	lowFreeSpaceMB = 1024
+	freeSpacePath  = "/var"
+)
+
+// checkDiskSpace makes sure the packages can be installed
+func (m *Manager) checkDiskSpace(n *node) Check {
+	out, err := m.probe(n, fmt.Sprintf("df -Pk %s | awk 'NR==2 {print $4}'", freeSpacePath))
+	kb, convErr := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil || convErr != nil {
+		return Check{"Disk space", CheckWarn, "could not read the free space in " + freeSpacePath}
+	}
+	mb := kb / 1024
+	detail := fmt.Sprintf("%d MB free in %s", mb, freeSpacePath)
+	switch {
+	case mb < minFreeSpaceMB:
+		return Check{"Disk space", CheckFail, fmt.Sprintf("%s, at least %d MB are needed", detail, minFreeSpaceMB)}
+	case mb < lowFreeSpaceMB:
+		return Check{"Disk space", CheckWarn, detail}
+	}
+	return Check{"Disk space", CheckPass, detail}
+}
+
+// packageLocks are the lock files apt-get needs
+var packageLocks = []string{"/var/lib/dpkg/lock-frontend", "/var/lib/dpkg/lock", "/var/lib/apt/lists/lock"}
+
+// checkPackageLock fails while another package manager run holds a dpkg or apt
+// lock, which makes apt-get fail; on a fresh VPS this is usually
+// unattended-upgrades running after the first boot. The locks themselves are
+// checked: process names cannot tell an upgrade from the idle
+// unattended-upgrade-shutdown helper, which stock Ubuntu always runs.
+func (m *Manager) checkPackageLock(n *node) Check {
+	out, _ := m.probe(n, "sudo -n lslocks -n -o PID,COMMAND,PATH 2>/dev/null || true")
+	holders := lockHolders(out, packageLocks)
+	if len(holders) > 0 {
+		return Check{"Package manager lock", CheckFail, fmt.Sprintf("held by %s, wait for it to finish", strings.Join(holders, ", "))}
+	}
+	return Check{"Package manager lock", CheckPass, "free"}
+}
+
+// lockHolders returns the processes in "lslocks -o PID,COMMAND,PATH" output
+// that hold one of paths
+func lockHolders(out string, paths []string) []string {
+	var holders []string
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || !slices.Contains(paths, f[len(f)-1]) {
+			continue
+		}
+		holder := fmt.Sprintf("%s (pid %s)", strings.Join(f[1:len(f)-1], " "), f[0])
+		if !slices.Contains(holders, holder) {
+			holders = append(holders, holder)
+		}
+	}
+	return holders
+}
+
+// checkContainer detects containers sharing the host kernel. OpenVZ never
+// supports kernel IPsec; in other containers it depends on the host.
+func (m *Manager) checkContainer(n *node) Check {
+	out, _ := m.probe(n, `v=$(systemd-detect-virt --container 2>/dev/null); if [ -d /proc/vz ] && [ ! -d /proc/bc ]; then v=openvz; fi; echo "${v:-none}"`)
+	switch virt := strings.TrimSpace(out); virt {
+	case "", "none":
+		return Check{"Container", CheckPass, "not a container"}
+	case "openvz":
+		return Check{"Container", CheckFail, "OpenVZ containers cannot run kernel IPsec, use a KVM or dedicated server"}
+	default:
+		return Check{"Container", CheckWarn, fmt.Sprintf("%s container, kernel IPsec only works if the host allows it", virt)}
+	}
+}
+
+// checkKernelIPsec looks for XFRM support and the modules charon needs, loaded
+// or loadable
+func (m *Manager) checkKernelIPsec(n *node) Check {
+	modules := []string{"xfrm_user", "esp4"}
+	if m.config.dualStack() {
+		modules = append(modules, "esp6")
+	}
+	out, err := m.probe(n, fmt.Sprintf(`
+		test -e /proc/sys/net/core/xfrm_acq_expires || echo xfrm
+		for m in %s; do
+			grep -q "^$m " /proc/modules || modinfo "$m" >/dev/null 2>&1 || echo "$m"
+		done
+	`, strings.Join(modules, " ")))
+	if err != nil {
+		return Check{"Kernel IPsec", CheckWarn, fmt.Sprintf("could not check the kernel modules: %v", err)}
+	}
+	if missing := strings.Fields(out); len(missing) > 0 {
+		return Check{"Kernel IPsec", CheckFail, "missing " + strings.Join(missing, ", ")}
+	}
+	return Check{"Kernel IPsec", CheckPass, strings.Join(modules, ", ") + " available"}
+}
+
+// ipsecDaemons are IKE daemons other than StrongSwan that would hold the ports
+var ipsecDaemons = map[string]string{
+	"pluto":   "Libreswan",
+	"racoon":  "ipsec-tools",
+	"iked":    "OpenIKED",
+	"isakmpd": "isakmpd",
+}
+
+// checkIKEPorts makes sure UDP 500 and 4500 are free or held by StrongSwan
+func (m *Manager) checkIKEPorts(n *node) Check {
+	out, _ := m.probe(n, "sudo -n ss -Hlunp '( sport = :500 or sport = :4500 )' 2>/dev/null || true")
+	var conflicts []string
+	strongswan := false
+	for port, procs := range parseUDPListeners(out) {
+		for _, proc := range procs {
+			switch {
+			case strings.HasPrefix(proc, "charon"):
+				strongswan = true
+			case ipsecDaemons[proc] != "":
+				conflicts = append(conflicts, fmt.Sprintf("UDP %s is used by %s (%s)", port, proc, ipsecDaemons[proc]))
+			default:
+				conflicts = append(conflicts, fmt.Sprintf("UDP %s is used by %s", port, proc))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		slices.Sort(conflicts)
+		return Check{"IKE ports", CheckFail, strings.Join(conflicts, ", ") + ", stop it before setup"}
+	}
+	if strongswan {
+		return Check{"IKE ports", CheckPass, "UDP 500 and 4500 are used by StrongSwan"}
+	}
+	return Check{"IKE ports", CheckPass, "UDP 500 and 4500 are free"}
+}
+
+// parseUDPListeners reads "ss -Hlunp" output into the process names listening
+// on each port; sockets without process information are listed as "unknown"
+func parseUDPListeners(out string) map[string][]string {
+	listeners := make(map[string][]string)
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 {
+			continue
+		}
+		addr := f[3]
+		port := addr[strings.LastIndex(addr, ":")+1:]
+		if port != "500" && port != "4500" {
+			continue
+		}
+		// users:(("charon",pid=812,fd=12),("other",pid=901,fd=3))
+		var procs []string
+		rest := strings.Join(f[4:], " ")
+		for {
+			i := strings.Index(rest, `("`)
+			if i < 0 {
+				break
+			}
+			rest = rest[i+2:]
+			j := strings.IndexByte(rest, '"')
+			if j < 0 {
+				break
+			}
+			procs = append(procs, rest[:j])
+			rest = rest[j:]
+		}
+		if len(procs) == 0 {
+			procs = []string{"unknown"}
+		}
+		for _, p := range procs {
+			if !slices.Contains(listeners[port], p) {
+				listeners[port] = append(listeners[port], p)
+			}
+		}
+	}
+	return listeners
+}
+
+// checkDefaultRoute requires a default route for the VPN traffic; servers
+// with only one address family get a warning
+func (m *Manager) checkDefaultRoute(n *node) Check {
+	out4, _ := m.probe(n, "ip -4 route show default")
+	out6, _ := m.probe(n, "ip -6 route show default 2>/dev/null || true")
+	out4, out6 = strings.TrimSpace(out4), strings.TrimSpace(out6)
+	switch {
+	case out4 == "" && out6 == "":
+		return Check{"Default route", CheckFail, "no default route"}
+	case out4 == "":
+		return Check{"Default route", CheckWarn, describeRoute(out6) + ", no IPv4 default route for IPv4 VPN traffic"}
+	case out6 == "" && m.config.dualStack():
+		return Check{"Default route", CheckWarn, describeRoute(out4) + ", no IPv6 default route for the IPv6 VPN subnet"}
+	}
+	return Check{"Default route", CheckPass, describeRoute(out4)}
+}
+
+// describeRoute summarises the first route of "ip route show" output
+func describeRoute(out string) string {
+	f := strings.Fields(strings.SplitN(strings.TrimSpace(out), "\n", 2)[0])
+	var via, dev string
+	for i := 0; i+1 < len(f); i++ {
+		switch f[i] {
+		case "via":
+			via = f[i+1]
+		case "dev":
+			dev = f[i+1]
+		}
+	}
+	if via == "" {
+		return "dev " + dev
+	}
+	return fmt.Sprintf("via %s dev %s", via, dev)
+}
+
+// Clock differences from this machine; certificates are issued with the
+// server's clock and peers reject those that are not valid yet
+const (
+	clockSkewWarn = 30 * time.Second
+	clockSkewFail = 10 * time.Minute
+)
+
+// checkClock compares the server clock with the local one
+func (m *Manager) checkClock(n *node) Check {
+	before := time.Now()
+	out, err := m.probe(n, "date +%s")
+	after := time.Now()
+	remote, convErr := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil || convErr != nil {
+		return Check{"Clock", CheckWarn, "could not read the server clock"}
+	}
+	return clockCheck(time.Unix(remote, 0).Sub(before.Add(after.Sub(before) / 2)).Round(time.Second))
+}
+
+// clockCheck evaluates the difference between the server and local clocks
+func clockCheck(skew time.Duration) Check {
+	abs, dir := skew, "ahead"
+	if skew < 0 {
+		abs, dir = -skew, "behind"
+	}
+	detail := fmt.Sprintf("%s %s of this computer", abs, dir)
+	switch {
+	case abs > clockSkewFail:
+		return Check{"Clock", CheckFail, detail + ", enable NTP (timedatectl set-ntp true)"}
+	case abs > clockSkewWarn:
+		return Check{"Clock", CheckWarn, detail + ", enable NTP (timedatectl set-ntp true)"}
+	}
+	return Check{"Clock", CheckPass, "in sync"}
+}
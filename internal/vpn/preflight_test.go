@@ -0,0 +1,177 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+)
+
+// preflightOK scripts the answers of a server passing every preflight check
+func preflightOK(f *sshtest.Fake) *sshtest.Fake {
+	return f.
+		On("/etc/os-release", "ubuntu|24.04|debian|Ubuntu 24.04.1 LTS\napt\n").
+		On("df -Pk", "10485760\n").
+		On("systemd-detect-virt", "none\n").
+		On("ip -4 route show default", "default via 192.0.2.254 dev eth0 proto dhcp metric 100\n").
+		On("date +%s", fmt.Sprintf("%d\n", time.Now().Unix()))
+}
+
+// checkStatuses maps check names to their status
+func checkStatuses(r *PreflightReport) map[string]CheckStatus {
+	statuses := make(map[string]CheckStatus)
+	for _, c := range r.Checks {
+		statuses[c.Name] = c.Status
+	}
+	return statuses
+}
+
+func TestPreflight(t *testing.T) {
+	healthy := preflightOK(sshtest.NewFake())
+	broken := preflightOK(sshtest.NewFake()).
+		On("/etc/os-release", "debian|10|||Debian GNU/Linux 10 (buster)\napt\n").
+		Fail("sudo -n true", fmt.Errorf("sudo: a password is required")).
+		On("df -Pk", "512000\n").
+		On("lslocks", "1234 unattended-upgr /var/lib/dpkg/lock-frontend\n1234 unattended-upgr /var/lib/dpkg/lock\n").
+		On("systemd-detect-virt", "openvz\n").
+		On("xfrm_acq_expires", "xfrm\nxfrm_user\n").
+		On("ss -Hlunp", "UNCONN 0 0 0.0.0.0:500 0.0.0.0:* users:((\"pluto\",pid=77,fd=20))\n").
+		On("ip -4 route show default", "").
+		On("date +%s", fmt.Sprintf("%d\n", time.Now().Add(-time.Hour).Unix()))
+	m, _ := newTestManager([]string{entryHost, exitHost}, healthy, broken)
+
+	reports, err := m.Preflight()
+	if err != nil {
+		t.Fatalf("Preflight: %v", err)
+	}
+	if len(reports) != 2 || reports[1].Name != "Server 2" {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	for _, c := range reports[0].Checks {
+		if c.Status != CheckPass {
+			t.Errorf("healthy server: %s is %s: %s", c.Name, c.Status, c.Detail)
+		}
+	}
+
+	want := map[string]CheckStatus{
+		"Operating system":     CheckWarn,
+		"Passwordless sudo":    CheckFail,
+		"Disk space":           CheckWarn,
+		"Package manager lock": CheckFail,
+		"Container":            CheckFail,
+		"Kernel IPsec":         CheckFail,
+		"IKE ports":            CheckFail,
+		"Default route":        CheckFail,
+		"Clock":                CheckFail,
+	}
+	if got := checkStatuses(reports[1]); !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	for _, c := range reports[1].Checks {
+		if c.Name == "IKE ports" && !strings.Contains(c.Detail, "UDP 500 is used by pluto (Libreswan)") {
+			t.Errorf("IKE ports detail = %q", c.Detail)
+		}
+	}
+	for _, f := range []*sshtest.Fake{healthy, broken} {
+		if f.Ran("apt-get install") {
+			t.Error("preflight changed a server")
+		}
+	}
+}
+
+func TestSetupAllStopsOnPreflightFailure(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").Fail("sudo -n true", fmt.Errorf("sudo: a password is required"))
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	err := m.SetupAll()
+	var preflightErr *PreflightError
+	if !errors.As(err, &preflightErr) {
+		t.Fatalf("SetupAll error = %v, want a PreflightError", err)
+	}
+	if !strings.Contains(err.Error(), "Server 2: Passwordless sudo") {
+		t.Errorf("error does not name the failed check: %v", err)
+	}
+	if server1.Ran("apt-get install") || server2.Ran("apt-get install") {
+		t.Error("setup started despite the failed check")
+	}
+}
+
+func TestCheckPackageLock(t *testing.T) {
+	tests := []struct {
+		name   string
+		locks  string
+		want   CheckStatus
+		detail string
+	}{
+		{"no locks", "", CheckPass, "free"},
+		{"idle shutdown helper", "812 unattended-upgr /run/unattended-upgrades.lock\n455 cron /run/crond.pid\n", CheckPass, "free"},
+		{"upgrade running", "1234 unattended-upgr /var/lib/dpkg/lock-frontend\n1234 unattended-upgr /var/lib/dpkg/lock\n", CheckFail,
+			"held by unattended-upgr (pid 1234), wait for it to finish"},
+		{"apt update", "2001 apt-get /var/lib/apt/lists/lock\n", CheckFail, "held by apt-get (pid 2001), wait for it to finish"},
+	}
+	for _, tt := range tests {
+		server := preflightOK(sshtest.NewFake()).On("lslocks", tt.locks)
+		m, _ := newTestManager([]string{entryHost}, server)
+		if err := m.connectServers(); err != nil {
+			t.Fatalf("connectServers: %v", err)
+		}
+		if got := m.checkPackageLock(m.nodes[0]); got.Status != tt.want || got.Detail != tt.detail {
+			t.Errorf("%s: got %s (%s), want %s (%s)", tt.name, got.Status, got.Detail, tt.want, tt.detail)
+		}
+	}
+}
+
+func TestOSCheck(t *testing.T) {
+	tests := []struct {
+		output string
+		want   CheckStatus
+	}{
+		{"ubuntu|22.04|debian|Ubuntu 22.04.4 LTS\napt\n", CheckPass},
+		{"debian|12|||Debian GNU/Linux 12 (bookworm)\napt\n", CheckPass},
+		{"ubuntu|18.04|debian|Ubuntu 18.04.6 LTS\napt\n", CheckWarn},
+		{"linuxmint|21.3|ubuntu debian|Linux Mint 21.3\napt\n", CheckWarn},
+		{"rocky|9.3|rhel centos fedora|Rocky Linux 9.3\n", CheckFail},
+		{"", CheckFail},
+	}
+	for _, tt := range tests {
+		if got := osCheck(tt.output); got.Status != tt.want {
+			t.Errorf("osCheck(%q) = %s (%s), want %s", tt.output, got.Status, got.Detail, tt.want)
+		}
+	}
+}
+
+func TestParseUDPListeners(t *testing.T) {
+	output := `UNCONN 0      0            0.0.0.0:4500      0.0.0.0:*    users:(("charon-systemd",pid=812,fd=14))
+UNCONN 0      0               [::]:500          [::]:*    users:(("charon-systemd",pid=812,fd=13),("racoon",pid=90,fd=3))
+UNCONN 0      0            0.0.0.0:5000      0.0.0.0:*    users:(("other",pid=1,fd=3))
+UNCONN 0      0          127.0.0.1:500       0.0.0.0:*
+`
+	want := map[string][]string{
+		"4500": {"charon-systemd"},
+		"500":  {"charon-systemd", "racoon", "unknown"},
+	}
+	if got := parseUDPListeners(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseUDPListeners = %v, want %v", got, want)
+	}
+}
+
+func TestClockCheck(t *testing.T) {
+	tests := []struct {
+		skew time.Duration
+		want CheckStatus
+	}{
+		{2 * time.Second, CheckPass},
+		{-time.Minute, CheckWarn},
+		{time.Hour, CheckFail},
+	}
+	for _, tt := range tests {
+		if got := clockCheck(tt.skew); got.Status != tt.want {
+			t.Errorf("clockCheck(%s) = %s (%s), want %s", tt.skew, got.Status, got.Detail, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package vpn
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProposalProfile names the IKE and ESP algorithms used by the servers and
+// by every generated client profile, so both sides always agree
+type ProposalProfile string
+
+const (
+	// ProfileCompatible accepts AES-CBC with SHA-2 and MODP groups, which
+	// every client including older Windows and Android versions supports
+	ProfileCompatible ProposalProfile = "compatible"
+	// ProfileModern uses AES-GCM with Curve25519 or NIST ECP groups
+	ProfileModern ProposalProfile = "modern"
+	// ProfileCNSA follows the Commercial National Security Algorithm suite:
+	// AES-256-GCM, SHA-384 and ECP-384
+	ProfileCNSA ProposalProfile = "cnsa"
+)
+
+// DefaultProposalProfile is used when none is configured
+const DefaultProposalProfile = ProfileCompatible
+
+// ProposalProfiles lists the available profiles, most compatible first
+var ProposalProfiles = []ProposalProfile{ProfileCompatible, ProfileModern, ProfileCNSA}
+
+// appleSuite is the algorithm set written to .mobileconfig profiles
+type appleSuite struct {
+	Encryption string // EncryptionAlgorithm, e.g. "AES-256-GCM"
+	Integrity  string // IntegrityAlgorithm, also the PRF for AEAD ciphers
+	DHGroup    int    // DiffieHellmanGroup, also used for PFS
+}
+
+// windowsSuite holds the parameters of Set-VpnConnectionIPsecConfiguration
+type windowsSuite struct {
+	EncryptionMethod                 string
+	IntegrityCheckMethod             string
+	DHGroup                          string
+	CipherTransformConstants         string
+	AuthenticationTransformConstants string
+	PfsGroup                         string
+}
+
+// cipherSuite describes one profile for the server and each client type
+type cipherSuite struct {
+	ike     []string // swanctl IKE proposals, in order of preference
+	esp     []string // swanctl ESP proposals, in order of preference
+	apple   appleSuite
+	windows windowsSuite
+	android proposals // Proposals for the strongSwan Android app
+}
+
+var cipherSuites = map[ProposalProfile]cipherSuite{
+	ProfileCompatible: {
+		ike: []string{"aes256-sha256-modp2048", "aes128-sha256-modp2048", "aes256-sha1-modp1024"},
+		esp: []string{"aes256-sha256-modp2048", "aes256-sha256", "aes128-sha256", "aes256-sha1"},
+		apple: appleSuite{
+			Encryption: "AES-256",
+			Integrity:  "SHA2-256",
+			DHGroup:    14,
+		},
+		windows: windowsSuite{
+			EncryptionMethod:                 "AES256",
+			IntegrityCheckMethod:             "SHA256",
+			DHGroup:                          "Group14",
+			CipherTransformConstants:         "AES256",
+			AuthenticationTransformConstants: "SHA256128",
+			PfsGroup:                         "PFS2048",
+		},
+		android: proposals{
+			IKE: []string{"aes256-sha256-modp2048"},
+			ESP: []string{"aes256-sha256-modp2048"},
+		},
+	},
+	ProfileModern: {
+		ike: []string{"aes256gcm16-prfsha256-curve25519", "aes256gcm16-prfsha256-ecp256", "aes256gcm16-prfsha384-ecp384"},
+		esp: []string{"aes256gcm16-curve25519", "aes256gcm16-ecp256", "aes256gcm16-ecp384"},
+		apple: appleSuite{
+			Encryption: "AES-256-GCM",
+			Integrity:  "SHA2-256",
+			DHGroup:    19,
+		},
+		windows: windowsSuite{
+			EncryptionMethod:                 "GCMAES256",
+			IntegrityCheckMethod:             "SHA256",
+			DHGroup:                          "ECP256",
+			CipherTransformConstants:         "GCMAES256",
+			AuthenticationTransformConstants: "GCMAES256",
+			PfsGroup:                         "ECP256",
+		},
+		android: proposals{
+			IKE: []string{"aes256gcm16-prfsha256-curve25519"},
+			ESP: []string{"aes256gcm16-curve25519"},
+		},
+	},
+	ProfileCNSA: {
+		ike: []string{"aes256gcm16-prfsha384-ecp384"},
+		esp: []string{"aes256gcm16-ecp384"},
+		apple: appleSuite{
+			Encryption: "AES-256-GCM",
+			Integrity:  "SHA2-384",
+			DHGroup:    20,
+		},
+		windows: windowsSuite{
+			EncryptionMethod:                 "GCMAES256",
+			IntegrityCheckMethod:             "SHA384",
+			DHGroup:                          "ECP384",
+			CipherTransformConstants:         "GCMAES256",
+			AuthenticationTransformConstants: "GCMAES256",
+			PfsGroup:                         "ECP384",
+		},
+		android: proposals{
+			IKE: []string{"aes256gcm16-prfsha384-ecp384"},
+			ESP: []string{"aes256gcm16-ecp384"},
+		},
+	},
+}
+
+// ValidateProposalProfile checks that p names a known profile; empty selects the default
+func ValidateProposalProfile(p ProposalProfile) error {
+	if p == "" {
+		return nil
+	}
+	if _, ok := cipherSuites[p]; !ok {
+		names := make([]string, len(ProposalProfiles))
+		for i, known := range ProposalProfiles {
+			names[i] = string(known)
+		}
+		return fmt.Errorf("unknown proposal profile %q, expected one of: %s", p, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// suite returns the cipher suite of p, falling back to the default profile
+func (p ProposalProfile) suite() cipherSuite {
+	if s, ok := cipherSuites[p]; ok {
+		return s
+	}
+	return cipherSuites[DefaultProposalProfile]
+}
+
+// serverProposals returns the swanctl proposals of p
+func (p ProposalProfile) serverProposals() proposals {
+	s := p.suite()
+	return proposals{IKE: s.ike, ESP: s.esp}
+}
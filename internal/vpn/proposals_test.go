@@ -0,0 +1,91 @@
+package vpn
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// appleProposals translates the .mobileconfig algorithms into swanctl syntax
+func appleProposals(a appleSuite) (ike, esp string) {
+	enc := map[string]string{"AES-256": "aes256", "AES-256-GCM": "aes256gcm16"}[a.Encryption]
+	hash := map[string]string{"SHA2-256": "sha256", "SHA2-384": "sha384"}[a.Integrity]
+	group := map[int]string{14: "modp2048", 19: "ecp256", 20: "ecp384"}[a.DHGroup]
+	if strings.HasSuffix(enc, "gcm16") {
+		return fmt.Sprintf("%s-prf%s-%s", enc, hash, group), fmt.Sprintf("%s-%s", enc, group)
+	}
+	return fmt.Sprintf("%s-%s-%s", enc, hash, group), fmt.Sprintf("%s-%s-%s", enc, hash, group)
+}
+
+// windowsProposals translates the Set-VpnConnectionIPsecConfiguration parameters into swanctl syntax
+func windowsProposals(w windowsSuite) (ike, esp string) {
+	enc := map[string]string{"AES256": "aes256", "GCMAES256": "aes256gcm16"}
+	hash := map[string]string{"SHA256": "sha256", "SHA384": "sha384", "SHA256128": "sha256"}
+	group := map[string]string{"Group14": "modp2048", "ECP256": "ecp256", "ECP384": "ecp384",
+		"PFS2048": "modp2048"}
+	if w.EncryptionMethod == "GCMAES256" {
+		ike = fmt.Sprintf("%s-prf%s-%s", enc[w.EncryptionMethod], hash[w.IntegrityCheckMethod], group[w.DHGroup])
+	} else {
+		ike = fmt.Sprintf("%s-%s-%s", enc[w.EncryptionMethod], hash[w.IntegrityCheckMethod], group[w.DHGroup])
+	}
+	if w.CipherTransformConstants == "GCMAES256" {
+		esp = fmt.Sprintf("%s-%s", enc[w.CipherTransformConstants], group[w.PfsGroup])
+	} else {
+		esp = fmt.Sprintf("%s-%s-%s", enc[w.CipherTransformConstants], hash[w.AuthenticationTransformConstants], group[w.PfsGroup])
+	}
+	return ike, esp
+}
+
+func TestProposalProfilesMatchClients(t *testing.T) {
+	for _, p := range ProposalProfiles {
+		s := p.suite()
+		clients := map[string][2]string{}
+		ike, esp := appleProposals(s.apple)
+		clients["apple"] = [2]string{ike, esp}
+		ike, esp = windowsProposals(s.windows)
+		clients["windows"] = [2]string{ike, esp}
+		for _, a := range s.android.IKE {
+			clients["android "+a] = [2]string{a, s.android.ESP[0]}
+		}
+
+		for client, got := range clients {
+			if !slices.Contains(s.ike, got[0]) {
+				t.Errorf("%s: %s IKE proposal %s not accepted by the server (%v)", p, client, got[0], s.ike)
+			}
+			if !slices.Contains(s.esp, got[1]) {
+				t.Errorf("%s: %s ESP proposal %s not accepted by the server (%v)", p, client, got[1], s.esp)
+			}
+		}
+	}
+}
+
+func TestClientProfilesUseProposals(t *testing.T) {
+	mobileconfig := string(GenerateMobileConfig("alice", "pass", "192.0.2.10", "", ProfileCNSA))
+	for _, want := range []string{"<string>AES-256-GCM</string>", "<string>SHA2-384</string>", "<integer>20</integer>"} {
+		if strings.Count(mobileconfig, want) != 2 {
+			t.Errorf(".mobileconfig should contain %s in both SA parameters", want)
+		}
+	}
+
+	windows := GetWindowsInstructions("192.0.2.10", "alice", "pass", ProfileModern)
+	if !strings.Contains(windows, "-EncryptionMethod GCMAES256") || !strings.Contains(windows, "-DHGroup ECP256") {
+		t.Errorf("Windows instructions do not set the modern proposals:\n%s", windows)
+	}
+
+	android := GetAndroidInstructions("192.0.2.10", "alice", "pass", ProfileModern)
+	if !strings.Contains(android, "aes256gcm16-prfsha256-curve25519") {
+		t.Errorf("Android instructions do not list the modern proposals:\n%s", android)
+	}
+}
+
+func TestValidateProposalProfile(t *testing.T) {
+	for _, p := range []ProposalProfile{"", ProfileCompatible, ProfileModern, ProfileCNSA} {
+		if err := ValidateProposalProfile(p); err != nil {
+			t.Errorf("ValidateProposalProfile(%q): %v", p, err)
+		}
+	}
+	if err := ValidateProposalProfile("suite-b"); err == nil {
+		t.Errorf("expected an error for an unknown profile")
+	}
+}
@@ -0,0 +1,148 @@
+package vpn
+
+import (
+	"fmt"
+	"time"
+)
+
+// Firewall and routing changes are applied to the server we are connected to,
+// so a mistake can cut off SSH. Before such a step the Manager snapshots the
+// live state and arms a timer on the server that restores it; the timer is
+// only stopped once a fresh SSH connection succeeds after the change.
+const (
+	rollbackScriptPath = "/etc/ikev2tm/rollback.sh"
+	rollbackStateDir   = "/var/lib/ikev2tm/rollback"
+	rollbackUnitName   = "ikev2tm-rollback"
+)
+
+// rollbackTimeout is how long a locked-out server waits before reverting;
+// it covers the guarded step, which may install iptables-persistent
+const rollbackTimeout = 5 * time.Minute
+
+// rollbackScript saves ("save") or restores ("restore") the firewall, the
+// policy rules, table 220 and the persisted firewall and routing unit. Routes
+// are restored on top of the current ones; "ip route restore" skips existing
+// routes, so only the routes the step deleted come back.
+var rollbackScript = fmt.Sprintf(`#!/bin/sh
+# Generated by IKEv2TunnelManager, changes will be overwritten
+# Snapshot and restore of the state changed by risky setup steps
+dir=%[1]s
+
+case "$1" in
+save)
+    rm -rf "$dir" && mkdir -p "$dir"
+    if command -v iptables-save >/dev/null; then iptables-save > "$dir/iptables"; fi
+    if command -v ip6tables-save >/dev/null; then ip6tables-save > "$dir/ip6tables"; fi
+    if command -v nft >/dev/null; then nft list ruleset > "$dir/nftables"; fi
+    for f in 4 6; do
+        ip -$f rule save > "$dir/rules$f" 2>/dev/null || rm -f "$dir/rules$f"
+        ip -$f route save table all > "$dir/routes$f" 2>/dev/null || rm -f "$dir/routes$f"
+    done
+    if [ -f %[2]s ]; then cp %[2]s "$dir/nft-rules"; fi
+    systemctl is-enabled %[3]s > "$dir/routing-unit" 2>/dev/null || true
+    ;;
+restore)
+    [ -d "$dir" ] || exit 0
+    logger -t ikev2tm "SSH access was not confirmed, restoring the state from before the change"
+    if [ -f "$dir/nftables" ]; then nft flush ruleset && nft -f "$dir/nftables"; fi
+    if [ -f "$dir/iptables" ]; then iptables-restore < "$dir/iptables"; fi
+    if [ -f "$dir/ip6tables" ]; then ip6tables-restore < "$dir/ip6tables"; fi
+    for f in 4 6; do
+        if [ -f "$dir/rules$f" ]; then ip -$f rule flush && ip -$f rule restore < "$dir/rules$f"; fi
+        ip -$f route flush table 220 2>/dev/null || true
+        if [ -f "$dir/routes$f" ]; then ip -$f route restore < "$dir/routes$f" 2>/dev/null || true; fi
+    done
+
+    # Keep a reboot from bringing the change back
+    if [ -f "$dir/nft-rules" ]; then
+        cp "$dir/nft-rules" %[2]s
+    else
+        rm -f %[2]s
+        sed -i '\|^%[4]s$|d' %[5]s 2>/dev/null || true
+    fi
+    if command -v netfilter-persistent >/dev/null; then netfilter-persistent save; fi
+    if [ "$(cat "$dir/routing-unit")" != enabled ]; then systemctl disable %[3]s 2>/dev/null || true; fi
+    rm -rf "$dir"
+    ;;
+esac
+`, rollbackStateDir, nftRulesPath, routingUnitName, nftIncludeLine, nftMainPath)
+
+// withRollback runs a step that may lock us out of n behind a dead-man switch.
+// If n cannot be reached over a new SSH connection afterwards, the timer stays
+// armed and the server reverts the change on its own. A change that failed is
+// reverted over the new connection right away, so it is not left half-applied.
+func (m *Manager) withRollback(n *node, step string, change func() error) error {
+	if err := m.armRollback(n); err != nil {
+		return fmt.Errorf("failed to arm automatic rollback: %w", err)
+	}
+	changeErr := change()
+	if err := m.ctx.Err(); err != nil {
+		// Without a connection to disarm it, the timer reverts the partial change
+		return fmt.Errorf("%s interrupted, the server reverts it within %s: %w", step, rollbackTimeout, err)
+	}
+	if err := m.confirmAccess(n, changeErr != nil); err != nil {
+		if changeErr != nil {
+			m.logger.Errorf("[%s] Failed to revert %s: %v", n.name, step, err)
+			return fmt.Errorf("%s failed, the server reverts it within %s: %w", step, rollbackTimeout, changeErr)
+		}
+		return fmt.Errorf("lost SSH access after %s, the server reverts it within %s: %w", step, rollbackTimeout, err)
+	}
+	return changeErr
+}
+
+// armRollback snapshots the state and schedules its restore
+func (m *Manager) armRollback(n *node) error {
+	m.note(n, "Arming automatic rollback in case SSH access is lost...")
+	if _, err := m.run(n, "sudo mkdir -p /etc/ikev2tm"); err != nil {
+		return err
+	}
+	if _, err := m.ensureFile(n, rollbackScriptPath, rollbackScript); err != nil {
+		return err
+	}
+	// A failed snapshot must not arm a restore of it
+	if _, err := m.run(n, "sudo sh "+rollbackScriptPath+" save"); err != nil {
+		return fmt.Errorf("failed to snapshot the current state: %w", err)
+	}
+	_, err := m.run(n, fmt.Sprintf(`
+		sudo systemctl stop %[2]s.timer 2>/dev/null || true
+		sudo systemctl reset-failed %[2]s.service %[2]s.timer 2>/dev/null || true
+		sudo systemd-run --collect --unit %[2]s --on-active=%[3]d sh %[1]s restore
+	`, rollbackScriptPath, rollbackUnitName, int(rollbackTimeout.Seconds())))
+	return err
+}
+
+// confirmAccess opens a new SSH connection to n and disarms the rollback
+// through it, restoring the snapshot first when restore is set. The existing
+// connection does not prove anything: conntrack keeps established sessions
+// alive through rule changes that block new ones.
+func (m *Manager) confirmAccess(n *node, restore bool) error {
+	revert := "sudo sh " + rollbackScriptPath + " restore"
+	disarm := fmt.Sprintf("sudo systemctl stop %s.timer && sudo rm -rf %s", rollbackUnitName, rollbackStateDir)
+	if m.planning {
+		if restore {
+			if _, err := m.run(n, revert); err != nil {
+				return err
+			}
+		}
+		_, err := m.run(n, disarm)
+		return err
+	}
+
+	client, err := m.connect(n.config)
+	if err != nil {
+		return err
+	}
+	defer closeExecutor(client)
+	// A failed restore leaves the timer armed to try again
+	if restore {
+		if _, err := client.RunContext(m.ctx, revert); err != nil {
+			return fmt.Errorf("failed to restore the state from before the change: %w", err)
+		}
+		m.note(n, "Change failed, restored the state from before it.")
+	}
+	if _, err := client.RunContext(m.ctx, disarm); err != nil {
+		return fmt.Errorf("failed to disarm rollback: %w", err)
+	}
+	m.note(n, "SSH access confirmed, rollback disarmed.")
+	return nil
+}
@@ -0,0 +1,148 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+)
+
+const disarmCommand = "sudo systemctl stop " + rollbackUnitName + ".timer && sudo rm -rf " + rollbackStateDir
+
+func TestSetupAllGuardsRiskySteps(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	connects := make(map[string]int)
+	connect := m.connect
+	m.connect = func(cfg *ssh.ServerConfig) (ssh.Executor, error) {
+		connects[cfg.Host]++
+		return connect(cfg)
+	}
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	// Firewall and routing on the entry point, firewall only on the exit node
+	if connects[entryHost] != 3 || connects[exitHost] != 2 {
+		t.Errorf("connections = %v, want a fresh one after every guarded step", connects)
+	}
+	if script := writtenFiles(t, server1)[rollbackScriptPath]; !strings.Contains(script, "iptables-save") {
+		t.Errorf("rollback script does not snapshot the firewall:\n%s", script)
+	}
+
+	armed := server1.Index("systemd-run --collect --unit " + rollbackUnitName)
+	changed := server1.Index("iptables-restore --noflush")
+	disarmed := server1.Index(disarmCommand)
+	if armed < 0 || changed < armed || disarmed < changed {
+		t.Errorf("rollback armed at %d, firewall changed at %d, disarmed at %d", armed, changed, disarmed)
+	}
+	if snapshot := server1.Index("sudo sh " + rollbackScriptPath + " save"); snapshot < 0 || snapshot >= armed {
+		t.Errorf("snapshot taken at %d, rollback armed at %d", snapshot, armed)
+	}
+}
+
+func TestSetupAllSnapshotFailure(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").Fail(rollbackScriptPath+" save", fmt.Errorf("exit status 1"))
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	err := m.SetupAll()
+	if err == nil || !strings.Contains(err.Error(), "failed to snapshot the current state") {
+		t.Fatalf("SetupAll error = %v, want a snapshot error", err)
+	}
+	if server2.Ran("systemd-run") || server2.Ran("iptables-restore --noflush") {
+		t.Error("firewall changed or rollback armed without a snapshot")
+	}
+}
+
+func TestSetupAllLockedOut(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	connects := 0
+	connect := m.connect
+	m.connect = func(cfg *ssh.ServerConfig) (ssh.Executor, error) {
+		if cfg.Host == entryHost {
+			if connects++; connects > 1 {
+				return nil, fmt.Errorf("i/o timeout")
+			}
+		}
+		return connect(cfg)
+	}
+
+	err := m.SetupAll()
+	if err == nil || !strings.Contains(err.Error(), "lost SSH access after configuring the firewall") {
+		t.Fatalf("SetupAll error = %v, want lost SSH access", err)
+	}
+	if server1.Ran(disarmCommand) {
+		t.Error("rollback disarmed without a working connection")
+	}
+	if server1.Ran("ikev2tm-routing") {
+		t.Error("setup continued after losing access")
+	}
+	if !server2.Ran(disarmCommand) {
+		t.Error("rollback on the reachable exit node not disarmed")
+	}
+}
+
+func TestSetupAllInterruptedGuardedStep(t *testing.T) {
+	setStepTimeout(t, StepFirewall, 50*time.Millisecond)
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").Hang("iptables-restore --noflush")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	err := m.SetupAll()
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "configuring the firewall interrupted") {
+		t.Fatalf("SetupAll error = %v, want an interrupted firewall step", err)
+	}
+	// The armed timer reverts the half-applied rules
+	if !server2.Ran("systemd-run --collect --unit "+rollbackUnitName) || server2.Ran(disarmCommand) {
+		t.Error("rollback not left armed")
+	}
+}
+
+func TestSetupAllRevertsFailedGuardedStep(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").Fail("iptables-restore --noflush", fmt.Errorf("line 12 failed"))
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	err := m.SetupAll()
+	if err == nil || !strings.Contains(err.Error(), "line 12 failed") {
+		t.Fatalf("SetupAll error = %v, want the firewall error", err)
+	}
+	// The half-applied rules are restored before the timer is stopped
+	changed := server2.Index("iptables-restore --noflush")
+	restored := server2.Index("sudo sh " + rollbackScriptPath + " restore")
+	disarmed := server2.Index(disarmCommand)
+	if changed < 0 || restored < changed || disarmed < restored {
+		t.Errorf("firewall changed at %d, restored at %d, disarmed at %d", changed, restored, disarmed)
+	}
+	if server1.Ran("systemd-run") {
+		t.Error("setup continued after the failed step")
+	}
+}
+
+func TestSetupAllFailedRevert(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").
+		Fail("iptables-restore --noflush", fmt.Errorf("line 12 failed")).
+		Fail("sudo sh "+rollbackScriptPath+" restore", fmt.Errorf("exit status 1"))
+	m, logger := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	err := m.SetupAll()
+	if err == nil || !strings.Contains(err.Error(), "configuring the firewall failed, the server reverts it within") {
+		t.Fatalf("SetupAll error = %v, want the firewall error", err)
+	}
+	if server2.Ran(disarmCommand) {
+		t.Error("rollback disarmed although the restore failed")
+	}
+	if logger.index("Failed to revert configuring the firewall") < 0 {
+		t.Error("failed restore not logged")
+	}
+}
@@ -0,0 +1,355 @@
+package vpn
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"net/netip"
+	"strings"
+	"text/template"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+)
+
+// Policy routing is kept in a script that a oneshot unit runs at boot, so the
+// rules survive reboots. The script doubles as the record of what was deployed
+// for the drift check in GetStatus.
+const (
+	routingScriptPath = "/etc/ikev2tm/routing.sh"
+	routingUnitName   = "ikev2tm-routing.service"
+	routingUnitPath   = "/etc/systemd/system/" + routingUnitName
+)
+
+// routingUnit runs the routing script once the network is up and before
+// StrongSwan starts the tunnels
+var routingUnit = fmt.Sprintf(`# Generated by IKEv2TunnelManager, changes will be overwritten
+[Unit]
+Description=IKEv2TunnelManager policy routing
+Wants=network-online.target
+After=network-online.target
+Before=%s.service
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=%s
+
+[Install]
+WantedBy=multi-user.target
+`, serviceName, routingScriptPath)
+
+//go:embed templates/routing.sh.tmpl
+var routingTemplateText string
+
+var routingTemplates = template.Must(template.New("routing").Parse(routingTemplateText))
+
+// policyRule is an "ip rule" sending traffic from a source to a routing table
+type policyRule struct {
+	Comment string
+	Family  string // -4 or -6
+	Pref    int
+	From    string
+	Table   string
+}
+
+// staticRoute is a route the hop needs in addition to the ones from DHCP or netplan
+type staticRoute struct {
+	Comment string
+	Family  string // -4 or -6
+	Dst     string
+	Via     string // Gateway; empty for routes straight to the interface
+	Dev     string
+	Table   string // Empty for the main table
+}
+
+// routingConfig is the model rendered into the routing script of one hop
+type routingConfig struct {
+	Name   string
+	Unit   string
+	Rules  []policyRule
+	Routes []staticRoute
+}
+
+// renderRouting renders the routing script from the model
+func renderRouting(cfg *routingConfig) (string, error) {
+	var b strings.Builder
+	if err := routingTemplates.ExecuteTemplate(&b, "routing.sh", cfg); err != nil {
+		return "", fmt.Errorf("failed to render routing.sh: %w", err)
+	}
+	return b.String(), nil
+}
+
+// routingModel describes the policy routing of hop i, which forwards client
+// traffic into the tunnel to the next hop. The script aborts on the first
+// command that fails, so every value is resolved and checked here.
+func (m *Manager) routingModel(i int) (*routingConfig, error) {
+	n := m.nodes[i]
+	host, err := m.resolveHost(n, m.config.Hops[i].Server.Host)
+	if err != nil {
+		return nil, err
+	}
+	next, err := m.resolveHost(n, m.config.Hops[i+1].Server.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Detect default interface and gateway of the family used to reach the next hop
+	iface, gw, err := m.defaultRoute(n, isIPv6(next))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &routingConfig{
+		Name: n.name,
+		Unit: routingUnitName,
+		Rules: []policyRule{
+			{Comment: "Prevent lockout: traffic from the server's own address always uses the main table",
+				Family: ipFamily(host), Pref: 100, From: host, Table: "main"},
+			{Comment: "Only traffic from VPN clients follows the IPsec table 220",
+				Family: "-4", Pref: 220, From: m.config.VPNSubnet, Table: "220"},
+		},
+		Routes: []staticRoute{
+			{Comment: "Keep the next hop reachable through the direct gateway",
+				Family: ipFamily(next), Dst: next, Via: gw, Dev: iface},
+			// kernel-libipsec is disabled, so the route goes to the real interface
+			{Comment: "Table 220 needs a default route for the IPsec policies to match",
+				Family: "-4", Dst: "default", Dev: iface, Table: "220"},
+		},
+	}
+
+	if m.config.dualStack() {
+		iface6, _, err := m.defaultRoute(n, true)
+		if err != nil {
+			iface6 = iface
+		}
+		cfg.Rules = append(cfg.Rules, policyRule{Comment: "Same for IPv6 clients",
+			Family: "-6", Pref: 220, From: m.config.VPNSubnet6, Table: "220"})
+		cfg.Routes = append(cfg.Routes, staticRoute{Comment: "Same for IPv6 clients",
+			Family: "-6", Dst: "default", Dev: iface6, Table: "220"})
+	}
+	return cfg, nil
+}
+
+// setupRouting sends client traffic on hop i into the tunnel to the next hop
+// while keeping the server's own traffic (and SSH) on the main table. The rules
+// are installed as a boot-time unit and applied right away.
+func (m *Manager) setupRouting(i int) error {
+	n := m.nodes[i]
+	m.note(n, "Configuring policy routing and fixing potential lockouts...")
+
+	cfg, err := m.routingModel(i)
+	if err != nil {
+		return err
+	}
+	script, err := renderRouting(cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := m.run(n, "sudo mkdir -p /etc/ikev2tm"); err != nil {
+		return err
+	}
+	if _, err := m.ensureFile(n, routingScriptPath, script); err != nil {
+		return err
+	}
+	unitChanged, err := m.ensureFile(n, routingUnitPath, routingUnit)
+	if err != nil {
+		return err
+	}
+
+	cmds := []string{"sudo chmod 755 " + routingScriptPath}
+	if unitChanged {
+		cmds = append(cmds, "sudo systemctl daemon-reload")
+	}
+	cmds = append(cmds,
+		"sudo systemctl enable "+routingUnitName,
+		// The script is idempotent; restarting the oneshot unit applies it now
+		"sudo systemctl restart "+routingUnitName)
+	_, err = m.run(n, strings.Join(cmds, " && "))
+	return err
+}
+
+// defaultRoute returns the interface and gateway of the IPv4 or IPv6 default
+// route; gw is empty for routes straight to the interface
+func (m *Manager) defaultRoute(n *node, v6 bool) (iface, gw string, err error) {
+	family := "IPv4"
+	cmd := "ip -4 route show default"
+	if v6 {
+		family, cmd = "IPv6", "ip -6 route show default"
+	}
+	out, err := m.probe(n, cmd)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read the %s default route: %w", family, err)
+	}
+	iface, gw = parseDefaultRoute(out)
+	if iface == "" {
+		return "", "", fmt.Errorf("no %s default route on %s", family, n.name)
+	}
+	return iface, gw, nil
+}
+
+// parseDefaultRoute reads the interface and gateway of the first route in
+// "ip route show default" output. Routes without a gateway, such as
+// "default dev venet0 scope link", return an empty gw.
+func parseDefaultRoute(out string) (iface, gw string) {
+	line, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(line)
+	for j := 0; j+1 < len(fields); j++ {
+		switch fields[j] {
+		case "via":
+			if addr, err := netip.ParseAddr(fields[j+1]); err == nil {
+				gw = addr.String()
+			}
+		case "dev":
+			iface = fields[j+1]
+		}
+	}
+	return iface, gw
+}
+
+// resolveHost returns host as an IP address, resolving names on the server
+// the way charon does when it connects
+func (m *Manager) resolveHost(n *node, host string) (string, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.String(), nil
+	}
+	invalid := func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-')
+	}
+	if host == "" || strings.ContainsFunc(host, invalid) {
+		return "", fmt.Errorf("invalid host name %q", host)
+	}
+	out, err := m.probe(n, fmt.Sprintf("getent ahosts %s || true", host))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	// The first address is the one connections use
+	if fields := strings.Fields(out); len(fields) > 0 {
+		if addr, err := netip.ParseAddr(fields[0]); err == nil {
+			return addr.String(), nil
+		}
+	}
+	return "", fmt.Errorf("failed to resolve %s on %s", host, n.name)
+}
+
+// parseRoutingScript reads the rules and routes back from a deployed routing script
+func parseRoutingScript(script string) ([]policyRule, []staticRoute) {
+	var rules []policyRule
+	var routes []staticRoute
+	for _, line := range strings.Split(script, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 5 && fields[0] == "add_rule":
+			var pref int
+			if _, err := fmt.Sscan(fields[2], &pref); err != nil {
+				continue
+			}
+			rules = append(rules, policyRule{Family: fields[1], Pref: pref, From: fields[3], Table: fields[4]})
+		case len(fields) >= 6 && fields[0] == "ip" && fields[2] == "route" && fields[3] == "replace":
+			r := staticRoute{Family: fields[1], Dst: fields[4]}
+			for j := 5; j+1 < len(fields); j += 2 {
+				switch fields[j] {
+				case "via":
+					r.Via = fields[j+1]
+				case "dev":
+					r.Dev = fields[j+1]
+				case "table":
+					r.Table = fields[j+1]
+				}
+			}
+			routes = append(routes, r)
+		}
+	}
+	return rules, routes
+}
+
+// routingDrift describes every deployed rule or route missing from the live
+// "ip rule show" and "ip route show table all" output of the same family
+func routingDrift(rules []policyRule, routes []staticRoute, liveRules, liveRoutes map[string]string) []string {
+	var drift []string
+	for _, r := range rules {
+		want := fmt.Sprintf("from %s lookup %s", r.From, r.Table)
+		found := false
+		for _, line := range strings.Split(liveRules[r.Family], "\n") {
+			pref, rest, ok := strings.Cut(strings.TrimSpace(line), ":")
+			rest = " " + strings.Join(strings.Fields(rest), " ") + " "
+			if ok && pref == fmt.Sprint(r.Pref) && strings.Contains(rest, " "+want+" ") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			drift = append(drift, fmt.Sprintf("missing rule %q (pref %d)", want, r.Pref))
+		}
+	}
+
+	for _, r := range routes {
+		found := false
+		for _, line := range strings.Split(liveRoutes[r.Family], "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || fields[0] != r.Dst {
+				continue
+			}
+			padded := " " + strings.Join(fields, " ") + " "
+			if r.Via != "" && !strings.Contains(padded, " via "+r.Via+" ") {
+				continue
+			}
+			if !strings.Contains(padded, " dev "+r.Dev+" ") {
+				continue
+			}
+			if r.Table == "" && strings.Contains(padded, " table ") && !strings.Contains(padded, " table main ") {
+				continue
+			}
+			if r.Table != "" && !strings.Contains(padded, " table "+r.Table+" ") {
+				continue
+			}
+			found = true
+			break
+		}
+		if !found {
+			desc := r.Dst
+			if r.Via != "" {
+				desc += " via " + r.Via
+			}
+			desc += " dev " + r.Dev
+			if r.Table != "" {
+				desc += " table " + r.Table
+			}
+			drift = append(drift, fmt.Sprintf("missing route %q", desc))
+		}
+	}
+	return drift
+}
+
+// checkRouting compares the live policy routing with the deployed routing
+// script; it returns nil when the server has no routing script
+func checkRouting(ctx context.Context, client ssh.Executor) ([]string, error) {
+	script, err := client.RunContext(ctx, "cat "+routingScriptPath+" 2>/dev/null || true")
+	if err != nil {
+		return nil, err
+	}
+	rules, routes := parseRoutingScript(script)
+	if len(rules) == 0 && len(routes) == 0 {
+		return nil, nil
+	}
+
+	// Only query the families in use; "ip -6" fails where IPv6 is disabled
+	families := make(map[string]bool)
+	for _, r := range rules {
+		families[r.Family] = true
+	}
+	for _, r := range routes {
+		families[r.Family] = true
+	}
+
+	liveRules := make(map[string]string)
+	liveRoutes := make(map[string]string)
+	for family := range families {
+		if liveRules[family], err = client.RunContext(ctx, "ip "+family+" rule show"); err != nil {
+			return nil, fmt.Errorf("failed to read rules: %w", err)
+		}
+		if liveRoutes[family], err = client.RunContext(ctx, "ip "+family+" route show table all"); err != nil {
+			return nil, fmt.Errorf("failed to read routes: %w", err)
+		}
+	}
+	return routingDrift(rules, routes, liveRules, liveRoutes), nil
+}
@@ -0,0 +1,142 @@
+package vpn
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+)
+
+func TestRoutingGolden(t *testing.T) {
+	entry := freshServer("198.51.100.1", "CA1").
+		On("ip -6 route show default", defaultRouteVia("fe80::1", "ens3"))
+	m, _ := newTestManager([]string{entryHost, exitHost}, entry, nil)
+	m.config.VPNSubnet6 = ExampleVPNSubnet6
+	if err := m.connectServers(); err != nil {
+		t.Fatalf("connectServers: %v", err)
+	}
+
+	cfg, err := m.routingModel(0)
+	if err != nil {
+		t.Fatalf("routingModel: %v", err)
+	}
+	script, err := renderRouting(cfg)
+	if err != nil {
+		t.Fatalf("renderRouting: %v", err)
+	}
+	checkGolden(t, "routing-dualstack-entry.sh", script)
+
+	// The drift check reads the deployed script back
+	rules, routes := parseRoutingScript(script)
+	want := []policyRule{
+		{Family: "-4", Pref: 100, From: entryHost, Table: "main"},
+		{Family: "-4", Pref: 220, From: DefaultVPNSubnet, Table: "220"},
+		{Family: "-6", Pref: 220, From: ExampleVPNSubnet6, Table: "220"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("parsed rules = %+v, want %+v", rules, want)
+	}
+	if len(routes) != 3 || routes[0] != (staticRoute{Family: "-4", Dst: exitHost, Via: "198.51.100.1", Dev: "eth0"}) {
+		t.Errorf("unexpected parsed routes: %+v", routes)
+	}
+}
+
+func TestRoutingModelResolvesHostNames(t *testing.T) {
+	entry := freshServer("198.51.100.1", "CA1").
+		On("getent ahosts vpn.example.com", entryHost+"    STREAM vpn.example.com\n"+entryHost+"    DGRAM\n").
+		On("getent ahosts exit.example.com", "2001:db8:1::20 STREAM exit.example.com\n").
+		On("ip -6 route show default", defaultRouteVia("fe80::1", "eth0"))
+	m, _ := newTestManager([]string{"vpn.example.com", "exit.example.com"}, entry, nil)
+	if err := m.connectServers(); err != nil {
+		t.Fatalf("connectServers: %v", err)
+	}
+
+	cfg, err := m.routingModel(0)
+	if err != nil {
+		t.Fatalf("routingModel: %v", err)
+	}
+	if r := cfg.Rules[0]; r.Family != "-4" || r.From != entryHost {
+		t.Errorf("lockout rule = %+v, want the resolved entry address", r)
+	}
+	if r := cfg.Routes[0]; r != (staticRoute{Comment: r.Comment, Family: "-6", Dst: "2001:db8:1::20", Via: "fe80::1", Dev: "eth0"}) {
+		t.Errorf("next hop route = %+v, want the resolved IPv6 exit address", r)
+	}
+
+	entry.On("getent ahosts exit.example.com", "")
+	if _, err := m.routingModel(0); err == nil || !strings.Contains(err.Error(), "failed to resolve exit.example.com") {
+		t.Errorf("routingModel error = %v, want a resolution error", err)
+	}
+}
+
+func TestRoutingModelDefaultRoute(t *testing.T) {
+	entry := freshServer("", "CA1").On("ip -4 route show default", defaultRouteVia("", "venet0"))
+	m, _ := newTestManager([]string{entryHost, exitHost}, entry, nil)
+	if err := m.connectServers(); err != nil {
+		t.Fatalf("connectServers: %v", err)
+	}
+
+	// A gateway-less default route has no "via"; "scope link" must not become one
+	cfg, err := m.routingModel(0)
+	if err != nil {
+		t.Fatalf("routingModel: %v", err)
+	}
+	script, err := renderRouting(cfg)
+	if err != nil {
+		t.Fatalf("renderRouting: %v", err)
+	}
+	if !strings.Contains(script, "ip -4 route replace "+exitHost+" dev venet0\n") {
+		t.Errorf("next hop route not straight to the interface:\n%s", script)
+	}
+
+	entry.Fail("ip -4 route show default", fmt.Errorf("exit status 1"))
+	if _, err := m.routingModel(0); err == nil || !strings.Contains(err.Error(), "failed to read the IPv4 default route") {
+		t.Errorf("routingModel error = %v, want the probe error", err)
+	}
+	entry.On("ip -4 route show default", "")
+	if _, err := m.routingModel(0); err == nil || !strings.Contains(err.Error(), "no IPv4 default route") {
+		t.Errorf("routingModel error = %v, want a missing route error", err)
+	}
+}
+
+const testRoutingScript = `#!/bin/sh
+add_rule -4 100 198.51.100.10 main
+add_rule -4 220 10.10.10.0/24 220
+ip -4 route replace 203.0.113.20 via 198.51.100.1 dev eth0
+ip -4 route replace default dev eth0 table 220
+`
+
+func TestGetStatusRoutingDrift(t *testing.T) {
+	f := sshtest.NewFake().
+		On("systemctl is-active", "stopped\n").
+		On("cat "+routingScriptPath, testRoutingScript).
+		On("ip -4 rule show", "0:\tfrom all lookup local\n100:\tfrom 198.51.100.10 lookup main\n32766:\tfrom all lookup main\n").
+		On("ip -4 route show table all", "default dev eth0 table 220 scope link\n"+
+			"default via 198.51.100.1 dev eth0 proto dhcp\n"+
+			"203.0.113.20 via 198.51.100.1 dev eth0\n")
+
+	status, err := GetStatus(f)
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	want := []string{`missing rule "from 10.10.10.0/24 lookup 220" (pref 220)`}
+	if !reflect.DeepEqual(status.RoutingDrift, want) {
+		t.Errorf("RoutingDrift = %q, want %q", status.RoutingDrift, want)
+	}
+	if f.Ran("ip -6") {
+		t.Error("IPv6 routing queried without IPv6 rules")
+	}
+}
+
+func TestGetStatusNoRoutingScript(t *testing.T) {
+	f := sshtest.NewFake().On("systemctl is-active", "stopped\n")
+
+	status, err := GetStatus(f)
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	if status.RoutingDrift != nil || f.Ran("rule show") {
+		t.Errorf("routing checked without a deployed script: %v", status.RoutingDrift)
+	}
+}
@@ -1,7 +1,9 @@
 package vpn
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
@@ -15,512 +17,674 @@ type Logger interface {
 	Errorf(format string, args ...interface{})
 }
 
+// Default network settings
+const (
+	DefaultVPNSubnet    = "10.10.10.0/24"
+	DefaultTunnelSubnet = "10.10.20.0/24"
+)
+
+// CACertPath is the CA certificate clients need to trust the server
+const CACertPath = "/etc/swanctl/x509ca/ca-cert.pem"
+
+// Role is the position of a hop in the chain
+type Role string
+
+const (
+	// RoleEntry accepts VPN clients and forwards their traffic into the chain
+	RoleEntry Role = "entry"
+	// RoleRelay forwards client traffic from the previous hop to the next one
+	RoleRelay Role = "relay"
+	// RoleExit receives client traffic from the chain and sends it to the internet
+	RoleExit Role = "exit"
+	// RoleSingle accepts VPN clients and sends their traffic straight to the internet
+	RoleSingle Role = "single"
+)
+
+// Topology selects how the servers are combined
+type Topology string
+
+const (
+	// TopologyChain tunnels client traffic from the entry point through any relays to the exit node
+	TopologyChain Topology = ""
+	// TopologySingle runs a plain road-warrior server on the first hop; no tunnels between servers
+	TopologySingle Topology = "single"
+)
+
+// Hop is one server in the chain
+type Hop struct {
+	Name   string            // Display name, e.g. "Server 1"
+	Server *ssh.ServerConfig // SSH connection to the server
+	Domain string            // Domain/hostname for the server certificate
+}
+
 // SetupConfig holds configuration for VPN setup
 type SetupConfig struct {
-	Server1 *ssh.ServerConfig
-	Server2 *ssh.ServerConfig
+	// Hops is the chain in traffic order: clients connect to the first hop
+	// (entry), traffic leaves through the last one (exit), any hops in
+	// between are relays
+	Hops []*Hop
+
+	// Topology is TopologyChain by default; TopologySingle only uses Hops[0]
+	Topology Topology
+
+	// VPN network settings; SetDefaults fills empty ones
+	VPNSubnet    string   // e.g., "10.10.10.0/24" for client connections
+	TunnelSubnet string   // e.g., "10.10.20.0/24" for tunnel between servers
+	DNS          []string // DNS servers pushed to VPN clients
 
-	// VPN network settings
-	VPNSubnet     string // e.g., "10.10.10.0/24" for client connections
-	TunnelSubnet  string // e.g., "10.10.20.0/24" for tunnel between servers
-	Server1Domain string // Domain/hostname for Server 1
-	Server2Domain string // Domain/hostname for Server 2
+	// VPNSubnet6 is the IPv6 client pool, e.g. "fd10:10:10::/64"; empty keeps the VPN IPv4-only
+	VPNSubnet6 string
+
+	// Proposals selects the IKE/ESP algorithms; client profiles must be generated with the same one
+	Proposals ProposalProfile
+
+	// Firewall selects iptables or nftables; FirewallAuto detects it on each server
+	Firewall FirewallBackend
+}
+
+// ActiveHops returns the hops the topology uses
+func (c *SetupConfig) ActiveHops() []*Hop {
+	if c.Topology == TopologySingle && len(c.Hops) > 0 {
+		return c.Hops[:1]
+	}
+	return c.Hops
+}
+
+// Role returns the role of the i-th hop
+func (c *SetupConfig) Role(i int) Role {
+	if c.Topology == TopologySingle {
+		return RoleSingle
+	}
+	switch i {
+	case 0:
+		return RoleEntry
+	case len(c.Hops) - 1:
+		return RoleExit
+	default:
+		return RoleRelay
+	}
+}
+
+// Validate checks that the chain can be set up
+func (c *SetupConfig) Validate() error {
+	switch c.Topology {
+	case TopologySingle:
+		if len(c.Hops) == 0 {
+			return fmt.Errorf("no server configured")
+		}
+	case TopologyChain:
+		if len(c.Hops) < 2 {
+			return fmt.Errorf("a chain needs at least 2 servers, got %d", len(c.Hops))
+		}
+	default:
+		return fmt.Errorf("unknown topology: %s", c.Topology)
+	}
+	for i, hop := range c.ActiveHops() {
+		if hop.Server == nil || hop.Server.Host == "" {
+			return fmt.Errorf("%s has no host configured", hopName(hop, i))
+		}
+	}
+	return c.ValidateNetwork()
+}
+
+func hopName(hop *Hop, i int) string {
+	if hop.Name != "" {
+		return hop.Name
+	}
+	return fmt.Sprintf("Server %d", i+1)
 }
 
 // Manager handles VPN setup and management
 type Manager struct {
-	config  *SetupConfig
-	logger  Logger
-	client1 *ssh.Client
-	client2 *ssh.Client
+	config *SetupConfig
+	logger Logger
+	nodes  []*node // One per hop, in chain order
+
+	// planning records mutating commands instead of running them
+	planning bool
+	// ctx bounds the remote commands of the running operation; during setup
+	// it is the context of the current step
+	ctx context.Context
+
+	// skip holds the IDs of steps completed in an earlier run
+	skip map[string]bool
+	// progress receives step events; nil unless Progress was called
+	progress chan ProgressEvent
+
+	// connect opens the executor for a server; tests replace it with fakes
+	connect func(config *ssh.ServerConfig) (ssh.Executor, error)
 }
 
 // NewManager creates a new VPN manager
 func NewManager(config *SetupConfig, logger Logger) *Manager {
 	return &Manager{
-		config: config,
-		logger: logger,
+		config:  config,
+		logger:  logger,
+		ctx:     context.Background(),
+		connect: ssh.Dial,
 	}
 }
 
-// SetupAll configures both servers
+// SetupAll configures every server in the chain
 func (m *Manager) SetupAll() error {
-	m.logger.Log("Starting VPN chain setup...")
+	return m.SetupAllContext(context.Background())
+}
+
+// SetupAllContext is SetupAll stopping at the first remote command running
+// when ctx is cancelled; the interrupted step is reported as failed and can
+// be resumed
+func (m *Manager) SetupAllContext(ctx context.Context) error {
+	if m.progress != nil {
+		defer func() {
+			close(m.progress)
+			m.progress = nil
+		}()
+	}
+	if err := m.config.Validate(); err != nil {
+		return err
+	}
+	defer m.bind(ctx)()
+	if m.config.Topology == TopologySingle {
+		m.logger.Log("Starting single-server VPN setup...")
+	} else {
+		m.logger.Logf("Starting VPN chain setup (%d servers)...", len(m.config.Hops))
+	}
 
-	// Connect to both servers
 	if err := m.connectServers(); err != nil {
 		return err
 	}
 	defer m.disconnectServers()
 
-	// Step 1: Setup VPN server on Server 2 (exit node)
-	m.logger.Log("Setting up Server 2 (exit node)...")
-	if err := m.setupServer2(); err != nil {
-		return fmt.Errorf("failed to setup Server 2: %w", err)
+	// Nothing is changed on any server unless all of them pass
+	reports := m.preflight()
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("setup cancelled: %w", err)
+	}
+	for _, r := range reports {
+		if len(r.Failed()) > 0 {
+			return &PreflightError{Reports: reports}
+		}
+	}
+
+	if err := m.setup(); err != nil {
+		return err
+	}
+
+	m.logger.Log("VPN chain setup completed successfully!")
+	return nil
+}
+
+// Plan records every command and file write SetupAll would perform on each
+// server without running anything that changes them. Read-only checks (such as
+// whether StrongSwan is installed or which interface is the default route)
+// still run so the plan matches what SetupAll would do right now.
+func (m *Manager) Plan() (*Plan, error) {
+	return m.PlanContext(context.Background())
+}
+
+// PlanContext is Plan with the read-only checks bound to ctx
+func (m *Manager) PlanContext(ctx context.Context) (*Plan, error) {
+	if err := m.config.Validate(); err != nil {
+		return nil, err
+	}
+	defer m.bind(ctx)()
+	m.logger.Log("Planning VPN chain setup (no changes will be made)...")
+
+	if err := m.connectServers(); err != nil {
+		return nil, err
 	}
+	defer m.disconnectServers()
+
+	m.planning = true
+	defer func() { m.planning = false }()
 
-	// Step 2: Setup VPN server + client on Server 1
-	m.logger.Log("Setting up Server 1 (entry point + tunnel client)...")
-	if err := m.setupServer1(); err != nil {
-		return fmt.Errorf("failed to setup Server 1: %w", err)
+	if err := m.setup(); err != nil {
+		return nil, err
 	}
 
-	// Step 3: Configure tunnel between servers
-	m.logger.Log("Configuring tunnel between servers...")
-	if err := m.setupTunnel(); err != nil {
-		return fmt.Errorf("failed to setup tunnel: %w", err)
+	m.logger.Log("Setup plan ready")
+	plan := &Plan{}
+	for _, n := range m.nodes {
+		plan.Servers = append(plan.Servers, n.plan)
 	}
+	return plan, nil
+}
 
-	// Step 4: Configure routing
-	m.logger.Log("Configuring routing...")
-	if err := m.setupRouting(); err != nil {
-		return fmt.Errorf("failed to setup routing: %w", err)
+// bind makes ctx the context of remote commands until the returned function
+// is called
+func (m *Manager) bind(ctx context.Context) func() {
+	m.ctx = ctx
+	return func() { m.ctx = context.Background() }
+}
+
+// setup runs the setup steps on connected servers
+func (m *Manager) setup() error {
+	// Make sure the VPN subnets do not collide with networks on any server
+	// before anything is changed
+	m.logger.Log("Checking VPN subnets against server networks...")
+	for _, n := range m.nodes {
+		if err := m.checkNetworks(n); err != nil {
+			return err
+		}
 	}
 
-	m.logger.Log("VPN chain setup completed successfully!")
+	parent := m.ctx
+	defer func() { m.ctx = parent }()
+
+	steps := m.setupSteps()
+	for i, s := range steps {
+		if err := parent.Err(); err != nil {
+			return fmt.Errorf("setup cancelled: %w", err)
+		}
+		if m.skip[s.ID] && !m.planning {
+			m.logger.Logf("Skipping %s, it completed in an earlier run", s.ID)
+			m.report(s, i, len(steps), StepSkipped, nil)
+			continue
+		}
+		m.report(s, i, len(steps), StepRunning, nil)
+		if err := m.runStep(parent, s); err != nil {
+			m.report(s, i, len(steps), StepFailed, err)
+			if s.Server == "" {
+				return fmt.Errorf("failed to setup %s: %w", s.Name, err)
+			}
+			return fmt.Errorf("failed to setup %s on %s: %w", s.Name, s.Server, err)
+		}
+		m.report(s, i, len(steps), StepDone, nil)
+	}
 	return nil
 }
 
+func roleDescription(role Role) string {
+	switch role {
+	case RoleEntry:
+		return "entry point + tunnel client"
+	case RoleRelay:
+		return "relay"
+	case RoleSingle:
+		return "single server"
+	default:
+		return "exit node"
+	}
+}
+
 func (m *Manager) connectServers() error {
 	m.logger.Log("Connecting to servers...")
 
-	m.client1 = ssh.NewClient(m.config.Server1)
-	if err := m.client1.Connect(); err != nil {
-		return fmt.Errorf("failed to connect to Server 1: %w", err)
-	}
-	m.logger.Logf("Connected to Server 1: %s", m.config.Server1.Host)
-
-	m.client2 = ssh.NewClient(m.config.Server2)
-	if err := m.client2.Connect(); err != nil {
-		m.client1.Close()
-		return fmt.Errorf("failed to connect to Server 2: %w", err)
+	m.nodes = nil
+	for i, hop := range m.config.ActiveHops() {
+		name := hopName(hop, i)
+		client, err := m.connect(hop.Server)
+		if err != nil {
+			m.disconnectServers()
+			return fmt.Errorf("failed to connect to %s: %w", name, err)
+		}
+		m.nodes = append(m.nodes, newNode(name, hop.Server, client))
+		m.logger.Logf("Connected to %s: %s", name, hop.Server.Host)
 	}
-	m.logger.Logf("Connected to Server 2: %s", m.config.Server2.Host)
 
 	return nil
 }
 
+func newNode(name string, config *ssh.ServerConfig, client ssh.Executor) *node {
+	return &node{
+		name:   name,
+		config: config,
+		client: client,
+		plan:   &ServerPlan{Name: name, Host: config.Host},
+	}
+}
+
 func (m *Manager) disconnectServers() {
-	if m.client1 != nil {
-		m.client1.Close()
+	for _, n := range m.nodes {
+		closeExecutor(n.client)
 	}
-	if m.client2 != nil {
-		m.client2.Close()
+}
+
+// closeExecutor closes executors that hold a connection
+func closeExecutor(exec ssh.Executor) {
+	if c, ok := exec.(io.Closer); ok {
+		c.Close()
 	}
 }
 
-func (m *Manager) setupServer2() error {
-	// Install StrongSwan
-	m.logger.Log("[Server 2] Checking StrongSwan installation...")
-	_, err := m.client2.Run("which ipsec")
+// installStrongSwan installs StrongSwan with swanctl and the charon-systemd
+// daemon on hop i and converts configuration left by older versions
+func (m *Manager) installStrongSwan(i int) error {
+	n := m.nodes[i]
+	m.logger.Logf("Setting up %s (%s)...", n.name, roleDescription(m.config.Role(i)))
+
+	m.note(n, "Checking StrongSwan installation...")
+	_, err := m.probe(n, "test -x /usr/sbin/swanctl && test -x /usr/sbin/charon-systemd && command -v pki")
 	if err == nil {
-		m.logger.Log("[Server 2] StrongSwan already installed.")
+		m.note(n, "StrongSwan already installed.")
 	} else {
-		m.logger.Log("[Server 2] Installing StrongSwan...")
-		_, err := m.client2.Run("sudo apt-get update && sudo DEBIAN_FRONTEND=noninteractive apt-get install -y strongswan strongswan-pki libcharon-extra-plugins libcharon-extauth-plugins")
-		if err != nil {
+		m.note(n, "Installing StrongSwan...")
+		installScript := `
+		export DEBIAN_FRONTEND=noninteractive
+		sudo apt-get update
+		sudo apt-get install -y ` + strongswanPackages + `
+		`
+		if _, err := m.run(n, installScript); err != nil {
 			return fmt.Errorf("failed to install StrongSwan: %w", err)
 		}
 	}
 
-	// Disable kernel-libipsec on Server 2 (Native kernel IPsec is preferred)
-	_, _ = m.client2.Run(`echo 'kernel-libipsec { load = no }' | sudo tee /etc/strongswan.d/charon/kernel-libipsec.conf`)
-
-	// Enable IP forwarding
-	m.logger.Log("[Server 2] Enabling IP forwarding...")
-	_, err = m.client2.Run(`
-		sudo sysctl -w net.ipv4.ip_forward=1
-		sudo sysctl -w net.ipv4.conf.all.accept_redirects=0
-		sudo sysctl -w net.ipv4.conf.all.send_redirects=0
-		echo 'net.ipv4.ip_forward=1' | sudo tee -a /etc/sysctl.conf
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to enable IP forwarding: %w", err)
+	// Convert servers set up by older versions with ipsec.conf
+	if err := m.migrateLegacyConfig(n); err != nil {
+		return fmt.Errorf("failed to migrate legacy configuration: %w", err)
 	}
 
-	// Generate certificates
-	m.logger.Log("[Server 2] Checking certificates...")
-	checkCertCmd := "test -f /etc/ipsec.d/certs/server-cert.pem && test -f /etc/ipsec.d/private/server-key.pem"
-	if _, err := m.client2.Run(checkCertCmd); err == nil {
-		m.logger.Log("[Server 2] Certificates already exist.")
-	} else {
-		m.logger.Log("[Server 2] Generating certificates...")
-		if err := m.generateCertificates(m.client2, m.config.Server2Domain, m.config.Server2.Host, "VPN CA Server 2"); err != nil {
-			return fmt.Errorf("failed to generate certificates: %w", err)
-		}
+	// Disable kernel-libipsec - native kernel IPsec is better to avoid routing lockouts
+	if err := m.writeFile(n, "/etc/strongswan.d/charon/kernel-libipsec.conf", "kernel-libipsec { load = no }\n"); err != nil {
+		return fmt.Errorf("failed to disable kernel-libipsec: %w", err)
 	}
+	return nil
+}
 
-	// Configure IPsec
-	m.logger.Log("[Server 2] Configuring IPsec...")
-	if err := m.configureIPsec(m.client2, m.config.Server2.Host, m.config.TunnelSubnet, true); err != nil {
-		return fmt.Errorf("failed to configure IPsec: %w", err)
+// setupCertificates issues the CA and server certificate of hop i unless it has them
+func (m *Manager) setupCertificates(i int) error {
+	n := m.nodes[i]
+	hop := m.config.Hops[i]
+
+	m.note(n, "Checking certificates...")
+	// The private key directory is root-only; the certificate is issued together with the key
+	if _, err := m.probe(n, "test -f "+serverCertPath); err == nil {
+		m.note(n, "Certificates already exist.")
+		return nil
 	}
+	m.note(n, "Generating certificates...")
+	if err := m.generateCertificates(n, hop.Domain, hop.Server.Host, "VPN CA "+n.name); err != nil {
+		return fmt.Errorf("failed to generate certificates: %w", err)
+	}
+	return nil
+}
 
-	// Configure firewall
-	m.logger.Log("[Server 2] Configuring firewall...")
-	if err := m.configureFirewall(m.client2, true); err != nil {
-		return fmt.Errorf("failed to configure firewall: %w", err)
+// startIPsec writes the IPsec configuration of hop i, without tunnels to its
+// neighbours (they follow in setupTunnel), and restarts StrongSwan
+func (m *Manager) startIPsec(i int) error {
+	n := m.nodes[i]
+	m.note(n, "Configuring IPsec...")
+	if err := m.configureIPsec(n, i); err != nil {
+		return fmt.Errorf("failed to configure IPsec: %w", err)
 	}
 
-	// Restart StrongSwan
-	m.logger.Log("[Server 2] Restarting StrongSwan...")
-	_, err = m.client2.Run("sudo systemctl restart strongswan-starter")
+	m.note(n, "Restarting StrongSwan...")
+	_, err := m.run(n, fmt.Sprintf(`
+		sudo systemctl disable --now %s 2>/dev/null || true
+		sudo systemctl enable %s
+		sudo systemctl restart %s
+	`, legacyServiceName, serviceName, serviceName))
 	if err != nil {
 		return fmt.Errorf("failed to restart StrongSwan: %w", err)
 	}
-
 	return nil
 }
 
-func (m *Manager) setupServer1() error {
-	// Install StrongSwan
-	m.logger.Log("[Server 1] Checking StrongSwan installation...")
-	_, err := m.client1.Run("which ipsec")
-	if err == nil {
-		m.logger.Log("[Server 1] StrongSwan already installed.")
-	} else {
-		m.logger.Log("[Server 1] Installing StrongSwan...")
-		installScript := `
-		export DEBIAN_FRONTEND=noninteractive
-		sudo apt-get update
-		sudo apt-get install -y strongswan strongswan-pki libcharon-extra-plugins libcharon-extauth-plugins
-		
-		# Disable kernel-libipsec - native kernel IPsec is better to avoid routing lockouts
-		echo 'kernel-libipsec { load = no }' | sudo tee /etc/strongswan.d/charon/kernel-libipsec.conf
-	`
-		if _, err := m.client1.Run(installScript); err != nil {
-			return fmt.Errorf("failed to install StrongSwan: %w", err)
-		}
+// migrateLegacyConfig converts a deployment made with ipsec.conf and the
+// stroke starter: certificates and EAP users move to the swanctl layout,
+// the starter is disabled and ipsec.conf is kept as a backup. The CA stays
+// the same, so existing client profiles keep working.
+func (m *Manager) migrateLegacyConfig(n *node) error {
+	detectCmd := fmt.Sprintf("grep -qsE '^conn (ikev2-vpn|ikev2-tunnel|tunnel-)' %s && echo legacy || true", legacyConfPath)
+	out, err := m.probe(n, detectCmd)
+	if err != nil || strings.TrimSpace(out) != "legacy" {
+		return nil
 	}
-
-	// Enable IP forwarding
-	m.logger.Log("[Server 1] Enabling IP forwarding...")
-	_, err = m.client1.Run(`
-		sudo sysctl -w net.ipv4.ip_forward=1
-		sudo sysctl -w net.ipv4.conf.all.accept_redirects=0
-		sudo sysctl -w net.ipv4.conf.all.send_redirects=0
-		echo 'net.ipv4.ip_forward=1' | sudo tee -a /etc/sysctl.conf
-	`)
+	m.note(n, "Found a legacy ipsec.conf deployment, migrating to swanctl...")
+
+	_, err = m.run(n, fmt.Sprintf(`
+		sudo mkdir -p /etc/swanctl/x509ca /etc/swanctl/x509 /etc/swanctl/private
+		sudo cp -n /etc/ipsec.d/cacerts/*.pem /etc/swanctl/x509ca/ 2>/dev/null || true
+		sudo cp -n /etc/ipsec.d/certs/server-cert.pem %s
+		sudo cp -n /etc/ipsec.d/private/server-key.pem %s
+		sudo cp -n /etc/ipsec.d/private/ca-key.pem %s 2>/dev/null || true
+		sudo chmod 600 /etc/swanctl/private/*.pem
+	`, serverCertPath, serverKeyPath, caKeyPath))
 	if err != nil {
-		return fmt.Errorf("failed to enable IP forwarding: %w", err)
+		return fmt.Errorf("failed to copy certificates: %w", err)
 	}
 
-	// Generate certificates
-	m.logger.Log("[Server 1] Checking certificates...")
-	checkCertCmd := "test -f /etc/ipsec.d/certs/server-cert.pem && test -f /etc/ipsec.d/private/server-key.pem"
-	if _, err := m.client1.Run(checkCertCmd); err == nil {
-		m.logger.Log("[Server 1] Certificates already exist.")
+	// EAP users move from ipsec.secrets into the swanctl secrets file
+	var users string
+	if m.planning {
+		users = fmt.Sprintf("# <EAP users converted from %s>\n", legacySecretsPath)
 	} else {
-		m.logger.Log("[Server 1] Generating certificates...")
-		if err := m.generateCertificates(m.client1, m.config.Server1Domain, m.config.Server1.Host, "VPN CA Server 1"); err != nil {
-			return fmt.Errorf("failed to generate certificates: %w", err)
+		secrets, err := n.client.RunContext(m.ctx, "sudo cat "+legacySecretsPath)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", legacySecretsPath, err)
 		}
+		converted := parseLegacySecrets(secrets)
+		if users, err = renderSwanctlUsers(converted); err != nil {
+			return err
+		}
+		m.note(n, "Converted %d VPN users.", len(converted))
 	}
-
-	// Configure IPsec for VPN server (for clients)
-	m.logger.Log("[Server 1] Configuring IPsec...")
-	if err := m.configureIPsec(m.client1, m.config.Server1.Host, m.config.VPNSubnet, false); err != nil {
-		return fmt.Errorf("failed to configure IPsec: %w", err)
+	if err := m.writeFile(n, swanctlUsersPath, users); err != nil {
+		return fmt.Errorf("failed to write VPN users: %w", err)
 	}
 
-	// Configure firewall
-	m.logger.Log("[Server 1] Configuring firewall...")
-	if err := m.configureFirewall(m.client1, false); err != nil {
-		return fmt.Errorf("failed to configure firewall: %w", err)
+	_, err = m.run(n, fmt.Sprintf(`
+		sudo chmod 600 %s
+		sudo systemctl disable --now %s 2>/dev/null || true
+		sudo mv %s %s
+	`, swanctlUsersPath, legacyServiceName, legacyConfPath, legacyBackupPath))
+	return err
+}
+
+// sysctlConfPath holds the kernel settings; a drop-in is rewritten instead of appending to sysctl.conf
+const sysctlConfPath = "/etc/sysctl.d/99-ikev2tm.conf"
+
+// sysctlConf returns the kernel settings for forwarding VPN traffic
+func (m *Manager) sysctlConf() string {
+	conf := `# Generated by IKEv2TunnelManager, changes will be overwritten
+net.ipv4.ip_forward = 1
+net.ipv4.conf.all.accept_redirects = 0
+net.ipv4.conf.all.send_redirects = 0
+`
+	if m.config.dualStack() {
+		// Forwarding turns off router advertisements on interfaces using
+		// SLAAC; accept_ra=2 keeps them so the server keeps its IPv6 route
+		conf += `net.ipv6.conf.default.accept_ra = 2
+net.ipv6.conf.all.forwarding = 1
+net.ipv6.conf.all.accept_redirects = 0
+`
 	}
+	return conf
+}
 
-	// Restart StrongSwan
-	m.logger.Log("[Server 1] Restarting StrongSwan...")
-	_, err = m.client1.Run("sudo systemctl restart strongswan-starter")
-	if err != nil {
-		return fmt.Errorf("failed to restart StrongSwan: %w", err)
+func (m *Manager) enableForwarding(n *node) error {
+	if _, err := m.ensureFile(n, sysctlConfPath, m.sysctlConf()); err != nil {
+		return err
 	}
 
-	return nil
+	script := `
+		# Earlier versions appended these to sysctl.conf on every run
+		sudo sed -i -e '/^net.ipv4.ip_forward=1$/d' -e '/^net.ipv6.conf.default.accept_ra=2$/d' -e '/^net.ipv6.conf.all.forwarding=1$/d' /etc/sysctl.conf
+	`
+	if m.config.dualStack() {
+		// The drop-in only changes the default for new interfaces
+		script += `
+		for f in /proc/sys/net/ipv6/conf/*/accept_ra; do
+			if [ "$(cat $f)" = 1 ]; then echo 2 | sudo tee $f >/dev/null; fi
+		done
+	`
+	}
+	script += "\t\tsudo sysctl -p " + sysctlConfPath + "\n"
+	_, err := m.run(n, script)
+	return err
 }
 
-func (m *Manager) generateCertificates(client *ssh.Client, domain, ip string, caName string) error {
+func (m *Manager) generateCertificates(n *node, domain, ip string, caName string) error {
 	script := fmt.Sprintf(`
-		sudo mkdir -p /etc/ipsec.d/{cacerts,certs,private}
+		sudo mkdir -p /etc/swanctl/x509ca /etc/swanctl/x509 /etc/swanctl/private
+		sudo chmod 700 /etc/swanctl/private
 		
 		# Generate CA key and certificate
-		if [ ! -f /etc/ipsec.d/private/ca-key.pem ]; then
-			sudo ipsec pki --gen --type rsa --size 4096 --outform pem > /tmp/ca-key.pem
-			sudo mv /tmp/ca-key.pem /etc/ipsec.d/private/ca-key.pem
+		if ! sudo test -f %[1]s; then
+			sudo pki --gen --type rsa --size 4096 --outform pem > /tmp/ca-key.pem
+			sudo mv /tmp/ca-key.pem %[1]s
 			
-			sudo ipsec pki --self --ca --lifetime 3650 \
-				--in /etc/ipsec.d/private/ca-key.pem \
-				--type rsa --dn "CN=%s" \
+			sudo pki --self --ca --lifetime 3650 \
+				--in %[1]s \
+				--type rsa --dn "CN=%[2]s" \
 				--outform pem > /tmp/ca-cert.pem
-			sudo mv /tmp/ca-cert.pem /etc/ipsec.d/cacerts/ca-cert.pem
+			sudo mv /tmp/ca-cert.pem %[3]s
 		fi
 		
 		# Generate server key and certificate
-		sudo ipsec pki --gen --type rsa --size 4096 --outform pem > /tmp/server-key.pem
-		sudo mv /tmp/server-key.pem /etc/ipsec.d/private/server-key.pem
+		sudo pki --gen --type rsa --size 4096 --outform pem > /tmp/server-key.pem
+		sudo mv /tmp/server-key.pem %[4]s
 		
-		sudo ipsec pki --pub --in /etc/ipsec.d/private/server-key.pem --type rsa \
-			| sudo ipsec pki --issue --lifetime 1825 \
-			--cacert /etc/ipsec.d/cacerts/ca-cert.pem \
-			--cakey /etc/ipsec.d/private/ca-key.pem \
-			--dn "CN=%s" --san "%s" \
+		sudo pki --pub --in %[4]s --type rsa \
+			| sudo pki --issue --lifetime 1825 \
+			--cacert %[3]s \
+			--cakey %[1]s \
+			--dn "CN=%[5]s" --san "%[5]s" \
 			--flag serverAuth --flag ikeIntermediate \
 			--outform pem > /tmp/server-cert.pem
-		sudo mv /tmp/server-cert.pem /etc/ipsec.d/certs/server-cert.pem
-
-		# Add server key to ipsec.secrets if not present
-		grep -q ": RSA server-key.pem" /etc/ipsec.secrets || echo ": RSA server-key.pem" | sudo tee -a /etc/ipsec.secrets
-	`, caName, ip, ip)
+		sudo mv /tmp/server-cert.pem %[6]s
+		sudo chmod 600 /etc/swanctl/private/*.pem
+	`, caKeyPath, caName, CACertPath, serverKeyPath, ip, serverCertPath)
 
-	_, err := client.Run(script)
+	_, err := m.run(n, script)
 	return err
 }
 
-func (m *Manager) configureIPsec(client *ssh.Client, serverIP, subnet string, isExitNode bool) error {
-	var ipsecConf string
-
-	if isExitNode {
-		ipsecConf = fmt.Sprintf(`
-config setup
-    charondebug="ike 1, knl 1, cfg 0"
-    uniqueids=no
-
-conn ikev2-tunnel
-    auto=add
-    compress=no
-    type=tunnel
-    keyexchange=ikev2
-    fragmentation=yes
-    forceencaps=yes
-    dpdaction=clear
-    dpddelay=300s
-    rekey=no
-    left=%%any
-    leftid=%s
-    leftcert=server-cert.pem
-    leftsendcert=always
-    leftsubnet=0.0.0.0/0
-    right=%%any
-    rightid=%%any
-    rightauth=eap-mschapv2
-    rightsourceip=%s
-    rightdns=8.8.8.8,8.8.4.4
-    rightsendcert=never
-    eap_identity=%%identity
-`, serverIP, subnet)
-	} else {
-		ipsecConf = fmt.Sprintf(`
-config setup
-    charondebug="ike 1, knl 1, cfg 0"
-    uniqueids=no
-
-conn ikev2-vpn
-    auto=add
-    compress=no
-    type=tunnel
-    keyexchange=ikev2
-    fragmentation=yes
-    forceencaps=yes
-    dpdaction=clear
-    dpddelay=300s
-    rekey=no
-    left=%%any
-    leftid=%s
-    leftcert=server-cert.pem
-    leftsendcert=always
-    leftsubnet=0.0.0.0/0
-    right=%%any
-    rightid=%%any
-    rightauth=eap-mschapv2
-    rightsourceip=%s
-    rightdns=8.8.8.8,8.8.4.4
-    rightsendcert=never
-    eap_identity=%%identity
-`, serverIP, subnet)
-	}
-
-	// Write ipsec.conf (overwrite to avoid duplicates)
-	cmd := fmt.Sprintf(`echo '%s' | sudo tee /etc/ipsec.conf`, strings.ReplaceAll(ipsecConf, "'", "'\\''"))
-	if _, err := client.Run(cmd); err != nil {
+// configureIPsec writes swanctl.conf for hop i without the tunnels to its
+// neighbours and makes sure the EAP secrets file exists
+func (m *Manager) configureIPsec(n *node, i int) error {
+	if err := m.writeSwanctlConf(i, false); err != nil {
+		return err
+	}
+	if _, err := m.run(n, fmt.Sprintf("sudo touch %[1]s && sudo chmod 600 %[1]s", swanctlUsersPath)); err != nil {
 		return err
 	}
 
 	// DISABLE automatic route installation to prevent SSH lockout
 	// We will handle routing manually for vpn clients only.
-	charon_conf := `
+	charonConf := `
 charon {
     install_routes = no
     fragment_size = 1200
 }
 `
-	_, _ = client.Run(fmt.Sprintf(`echo '%s' | sudo tee /etc/strongswan.d/charon-prio.conf`, charon_conf))
+	if err := m.writeFile(n, charonPrioConfPath, charonConf); err != nil {
+		return fmt.Errorf("failed to disable route installation: %w", err)
+	}
 
 	return nil
 }
 
-func (m *Manager) configureFirewall(client *ssh.Client, isExitNode bool) error {
-	ifaceCmd := "ip route | grep default | awk '{print $5}' | head -1"
-	iface, err := client.Run(ifaceCmd)
-	if err != nil {
-		return err
-	}
-	iface = strings.TrimSpace(iface)
-
-	script := fmt.Sprintf(`
-		# Always ensure SSH is allowed first
-		sudo iptables -I INPUT 1 -p tcp --dport 22 -j ACCEPT
-		sudo iptables -I INPUT 1 -p udp --dport 500 -j ACCEPT
-		sudo iptables -I INPUT 1 -p udp --dport 4500 -j ACCEPT
-		sudo iptables -I INPUT 1 -p esp -j ACCEPT
-
-		# Skip NAT for traffic going through IPsec tunnel (critical for VPN chain)
-		sudo iptables -t nat -I POSTROUTING -s 10.10.0.0/16 -m policy --pol ipsec --dir out -j ACCEPT
-		
-		# Enable NAT for traffic NOT going through IPsec (fallback)
-		sudo iptables -t nat -A POSTROUTING -s 10.10.0.0/16 -o %s -j MASQUERADE
-		
-		# Allow forwarding
-		sudo iptables -A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
-		sudo iptables -A FORWARD -s 10.10.0.0/16 -j ACCEPT
-		
-		# Persistent rules
-		if command -v netfilter-persistent >/dev/null; then
-			sudo netfilter-persistent save
-		fi
-	`, iface)
-
-	_, err = client.Run(script)
-	return err
+// tunnelID names hop i in tunnel connection and CA file names ("server1", "server2", ...)
+func tunnelID(i int) string {
+	return fmt.Sprintf("server%d", i+1)
 }
 
 func (m *Manager) setupTunnel() error {
-	// Sync CA certs
-	caCert2, err := m.client2.ReadFile("/etc/ipsec.d/cacerts/ca-cert.pem")
-	if err != nil {
-		return fmt.Errorf("failed to read CA cert from Server 2: %w", err)
+	// Sync CA certs between neighbouring hops
+	for i := 0; i < len(m.nodes)-1; i++ {
+		prev, next := m.nodes[i], m.nodes[i+1]
+
+		caNext, err := m.readFile(next, CACertPath)
+		if err != nil {
+			return fmt.Errorf("failed to read CA cert from %s: %w", next.name, err)
+		}
+		if err := m.writeFile(prev, neighbourCAPath(tunnelID(i+1)), caNext); err != nil {
+			return fmt.Errorf("failed to copy CA cert of %s to %s: %w", next.name, prev.name, err)
+		}
+
+		caPrev, err := m.readFile(prev, CACertPath)
+		if err != nil {
+			return fmt.Errorf("failed to read CA cert from %s: %w", prev.name, err)
+		}
+		if err := m.writeFile(next, neighbourCAPath(tunnelID(i)), caPrev); err != nil {
+			return fmt.Errorf("failed to copy CA cert of %s to %s: %w", prev.name, next.name, err)
+		}
 	}
-	_, _ = m.client1.Run(fmt.Sprintf(`echo '%s' | sudo tee /etc/ipsec.d/cacerts/server2-ca.pem`, string(caCert2)))
 
-	caCert1, err := m.client1.ReadFile("/etc/ipsec.d/cacerts/ca-cert.pem")
-	if err != nil {
-		return fmt.Errorf("failed to read CA cert from Server 1: %w", err)
-	}
-	_, _ = m.client2.Run(fmt.Sprintf(`echo '%s' | sudo tee /etc/ipsec.d/cacerts/server1-ca.pem`, string(caCert1)))
-
-	// Server 1 ipsec.conf (VPN for clients + Tunnel to Server 2)
-	ipsecConf1 := fmt.Sprintf(`
-config setup
-    charondebug="ike 1, knl 1, cfg 0"
-    uniqueids=no
-
-conn ikev2-vpn
-    auto=add
-    compress=no
-    type=tunnel
-    keyexchange=ikev2
-    fragmentation=yes
-    forceencaps=yes
-    dpdaction=clear
-    dpddelay=300s
-    rekey=no
-    left=%%any
-    leftid=%s
-    leftcert=server-cert.pem
-    leftsendcert=always
-    leftsubnet=0.0.0.0/0
-    right=%%any
-    rightid=%%any
-    rightauth=eap-mschapv2
-    rightsourceip=%s
-    rightdns=8.8.8.8,8.8.4.4
-    rightsendcert=never
-    eap_identity=%%identity
-
-conn tunnel-to-server2
-    auto=start
-    type=tunnel
-    keyexchange=ikev2
-    left=%%defaultroute
-    leftid=%s
-    leftauth=pubkey
-    leftsendcert=always
-    leftcert=server-cert.pem
-    leftsubnet=%s
-    right=%s
-    rightid=%s
-    rightauth=pubkey
-    rightsubnet=0.0.0.0/0
-`, m.config.Server1.Host, m.config.VPNSubnet, m.config.Server1.Host, m.config.VPNSubnet, m.config.Server2.Host, m.config.Server2.Host)
-
-	_, _ = m.client1.Run(fmt.Sprintf(`echo '%s' | sudo tee /etc/ipsec.conf`, strings.ReplaceAll(ipsecConf1, "'", "'\\''")))
-
-	// Server 2 ipsec.conf (Receiving tunnel from Server 1)
-	ipsecConf2 := fmt.Sprintf(`
-config setup
-    charondebug="ike 1, knl 1, cfg 0"
-    uniqueids=no
-
-conn tunnel-from-server1
-    auto=add
-    type=tunnel
-    keyexchange=ikev2
-    left=%%defaultroute
-    leftid=%s
-    leftauth=pubkey
-    leftsendcert=always
-    leftcert=server-cert.pem
-    leftsubnet=0.0.0.0/0
-    right=%s
-    rightid=%s
-    rightauth=pubkey
-    rightsubnet=%s
-    rightsendcert=never
-`, m.config.Server2.Host, m.config.Server1.Host, m.config.Server1.Host, m.config.VPNSubnet)
-
-	_, _ = m.client2.Run(fmt.Sprintf(`echo '%s' | sudo tee /etc/ipsec.conf`, strings.ReplaceAll(ipsecConf2, "'", "'\\''")))
-
-	// Restart
-	m.client1.Run("sudo systemctl restart strongswan-starter")
-	m.client2.Run("sudo systemctl restart strongswan-starter")
+	for i, n := range m.nodes {
+		if err := m.writeSwanctlConf(i, true); err != nil {
+			return fmt.Errorf("failed to write swanctl.conf on %s: %w", n.name, err)
+		}
+	}
+
+	// Restart from the exit node back so responders are up before initiators
+	for i := len(m.nodes) - 1; i >= 0; i-- {
+		if _, err := m.run(m.nodes[i], "sudo systemctl restart "+serviceName); err != nil {
+			return fmt.Errorf("failed to restart StrongSwan on %s: %w", m.nodes[i].name, err)
+		}
+	}
 
 	return nil
 }
 
-func (m *Manager) setupRouting() error {
-	m.logger.Log("Configuring policy routing and fixing potential lockouts...")
-
-	// Detect default interface and gateway on Server 1
-	ifaceCmd := "ip route | grep default | awk '{print $5}' | head -1"
-	iface, _ := m.client1.Run(ifaceCmd)
-	iface = strings.TrimSpace(iface)
+// swanctlModel describes swanctl.conf for hop i: the client connection on
+// the hop serving clients and, with tunnels, a tunnel from the previous hop
+// and a tunnel to the next one
+func (m *Manager) swanctlModel(i int, tunnels bool) *swanctlConfig {
+	host := m.config.Hops[i].Server.Host
+	role := m.config.Role(i)
+	cfg := &swanctlConfig{UsersPath: swanctlUsersPath}
+
+	if role == RoleEntry || role == RoleSingle {
+		cfg.Client = &clientConfig{
+			Name:      "ikev2-vpn",
+			LocalID:   host,
+			Cert:      "server-cert.pem",
+			LocalTS:   m.config.anyTS(),
+			Pools:     []poolConfig{{Name: clientPool, Addrs: m.config.VPNSubnet, DNS: m.config.DNS}},
+			Proposals: m.config.Proposals.serverProposals(),
+			DPD:       dpdSettings{Delay: "300s", Action: "clear"},
+		}
+		if m.config.dualStack() {
+			cfg.Client.Pools = append(cfg.Client.Pools, poolConfig{Name: clientPool6, Addrs: m.config.VPNSubnet6})
+		}
+	}
 
-	gwCmd := fmt.Sprintf("ip route show default dev %s | awk '{print $3}' | head -1", iface)
-	gw, _ := m.client1.Run(gwCmd)
-	gw = strings.TrimSpace(gw)
+	if !tunnels {
+		return cfg
+	}
 
-	script := fmt.Sprintf(`
-		# 1. Prevent lockout: Traffic FROM server IP always goes via main table
-		sudo ip rule add from %s lookup main pref 100 2>/dev/null || true
+	// The tunnel from the previous hop answers for the client subnet
+	if i > 0 {
+		prev := m.config.Hops[i-1].Server.Host
+		cfg.Tunnels = append(cfg.Tunnels, tunnelConfig{
+			Name:        "tunnel-from-" + tunnelID(i-1),
+			LocalID:     host,
+			RemoteID:    prev,
+			RemoteAddr:  prev,
+			Cert:        "server-cert.pem",
+			LocalTS:     m.config.anyTS(),
+			RemoteTS:    m.config.clientTS(),
+			StartAction: "none",
+			Proposals:   m.config.Proposals.serverProposals(),
+		})
+	}
 
-		# 2. Ensure route to Server 2 is always via direct gateway
-		sudo ip route add %s via %s dev %s 2>/dev/null || true
+	// The tunnel to the next hop is initiated here and carries the client subnet
+	if i < len(m.config.Hops)-1 {
+		next := m.config.Hops[i+1].Server.Host
+		cfg.Tunnels = append(cfg.Tunnels, tunnelConfig{
+			Name:        "tunnel-to-" + tunnelID(i+1),
+			LocalID:     host,
+			RemoteID:    next,
+			RemoteAddr:  next,
+			Cert:        "server-cert.pem",
+			LocalTS:     m.config.clientTS(),
+			RemoteTS:    m.config.anyTS(),
+			StartAction: "start",
+			Proposals:   m.config.Proposals.serverProposals(),
+		})
+	}
 
-		# 3. Handle VPN client routing: ONLY traffic from VPNSubnet follows IPsec table 220
-		# First, remove existing generic 'from all' rule if any
-		sudo ip rule del from all lookup 220 2>/dev/null || true
-		
-		# Add specific rule for our clients
-		sudo ip rule add from %s lookup 220 pref 220 2>/dev/null || true
-
-		# Ensure table 220 has a default route to trigger the SPD (even if dummy)
-		# If kernel-libipsec created ipsec0, use it. Otherwise use eth0.
-		if ip link show ipsec0 >/dev/null 2>&1; then
-			sudo ip route add default dev ipsec0 table 220 2>/dev/null || true
-		else
-			sudo ip route add default dev %s table 220 2>/dev/null || true
-		fi
-	`, m.config.Server1.Host, m.config.Server2.Host, gw, iface, m.config.VPNSubnet, iface)
+	return cfg
+}
 
-	_, err := m.client1.Run(script)
-	return err
+// writeSwanctlConf renders and writes swanctl.conf for hop i
+func (m *Manager) writeSwanctlConf(i int, tunnels bool) error {
+	conf, err := renderSwanctl(m.swanctlModel(i, tunnels))
+	if err != nil {
+		return err
+	}
+	return m.writeFile(m.nodes[i], SwanctlConfPath, conf)
 }
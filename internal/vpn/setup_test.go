@@ -0,0 +1,613 @@
+package vpn
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+)
+
+const (
+	entryHost = "198.51.100.10"
+	exitHost  = "203.0.113.20"
+)
+
+// newTestManager returns a Manager for a chain of the given fakes, one per
+// host in hosts
+func newTestManager(hosts []string, fakes ...*sshtest.Fake) (*Manager, *testLogger) {
+	logger := &testLogger{}
+	config := &SetupConfig{}
+	config.SetDefaults()
+	byHost := make(map[string]*sshtest.Fake)
+	for i, host := range hosts {
+		config.Hops = append(config.Hops, &Hop{
+			Name:   fmt.Sprintf("Server %d", i+1),
+			Server: &ssh.ServerConfig{Host: host, Port: 22, User: "root"},
+			Domain: host,
+		})
+		byHost[host] = fakes[i]
+	}
+	m := NewManager(config, logger)
+	m.connect = func(cfg *ssh.ServerConfig) (ssh.Executor, error) {
+		return byHost[cfg.Host], nil
+	}
+	return m, logger
+}
+
+// freshServer scripts a server without StrongSwan or certificates
+func freshServer(gateway, caCert string) *sshtest.Fake {
+	return preflightOK(sshtest.NewFake()).
+		Fail("test -x /usr/sbin/swanctl", fmt.Errorf("exit status 1")).
+		Fail("test -f "+serverCertPath, fmt.Errorf("exit status 1")).
+		On("ip -4 route show default", defaultRouteVia(gateway, "eth0")).
+		SetFile(CACertPath, caCert)
+}
+
+// defaultRouteVia is "ip route show default" output for a gateway, or for a
+// route straight to the interface when gateway is empty
+func defaultRouteVia(gateway, iface string) string {
+	if gateway == "" {
+		return "default dev " + iface + " scope link\n"
+	}
+	return "default via " + gateway + " dev " + iface + " proto dhcp metric 100\n"
+}
+
+// testLogger collects log lines for assertions
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Log(message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, message)
+}
+
+func (l *testLogger) Logf(format string, args ...interface{}) { l.Log(fmt.Sprintf(format, args...)) }
+func (l *testLogger) Error(message string)                    { l.Log("ERROR: " + message) }
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.Error(fmt.Sprintf(format, args...))
+}
+
+// index returns the position of the first line containing s, or -1
+func (l *testLogger) index(s string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, line := range l.lines {
+		if strings.Contains(line, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+var writePattern = regexp.MustCompile(`^echo '([A-Za-z0-9+/=]*)' \| base64 -d \| sudo tee (\S+) >/dev/null$`)
+
+// writtenFiles decodes the files written through Manager.writeFile; later writes win
+func writtenFiles(t *testing.T, f *sshtest.Fake) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	for _, cmd := range f.Commands() {
+		m := writePattern.FindStringSubmatch(cmd)
+		if m == nil {
+			continue
+		}
+		content, err := base64.StdEncoding.DecodeString(m[1])
+		if err != nil {
+			t.Fatalf("invalid base64 in %q: %v", cmd, err)
+		}
+		files[m[2]] = string(content)
+	}
+	return files
+}
+
+func TestSetupAllFreshServers(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2")
+	m, logger := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	// The exit node is prepared before the entry point
+	exit, entry := logger.index("Setting up Server 2"), logger.index("Setting up Server 1")
+	if exit < 0 || entry < 0 || exit > entry {
+		t.Errorf("expected Server 2 to be set up before Server 1, log: %v", logger.lines)
+	}
+
+	for name, f := range map[string]*sshtest.Fake{"server1": server1, "server2": server2} {
+		steps := []string{
+			"apt-get install -y charon-systemd strongswan-swanctl",
+			"sysctl -p " + sysctlConfPath,
+			"pki --gen",
+			"-A IKEV2TM-INPUT -p udp --dport 500 -j ACCEPT",
+			"systemctl restart strongswan",
+		}
+		last := -1
+		for _, step := range steps {
+			i := f.Index(step)
+			if i < 0 {
+				t.Errorf("%s: missing step %q", name, step)
+				continue
+			}
+			if i < last {
+				t.Errorf("%s: step %q ran out of order", name, step)
+			}
+			last = i
+		}
+		if !f.Ran("MASQUERADE") || !f.Ran("-o eth0") {
+			t.Errorf("%s: NAT not configured on the default interface", name)
+		}
+		if !f.Ran("systemctl disable --now strongswan-starter") {
+			t.Errorf("%s: legacy starter not disabled", name)
+		}
+		if f.Ran("mv /etc/ipsec.conf") {
+			t.Errorf("%s: fresh server should not be migrated", name)
+		}
+		if !strings.Contains(writtenFiles(t, f)[sysctlConfPath], "net.ipv4.ip_forward = 1") {
+			t.Errorf("%s: forwarding not persisted in %s", name, sysctlConfPath)
+		}
+	}
+
+	files1 := writtenFiles(t, server1)
+	files2 := writtenFiles(t, server2)
+
+	// CA certificates are exchanged between the servers
+	if files1[neighbourCAPath("server2")] != "CA2" {
+		t.Errorf("Server 1 did not receive the CA of Server 2")
+	}
+	if files2[neighbourCAPath("server1")] != "CA1" {
+		t.Errorf("Server 2 did not receive the CA of Server 1")
+	}
+
+	conf1 := files1[SwanctlConfPath]
+	for _, want := range []string{"ikev2-vpn {", "tunnel-to-server2 {", "remote_addrs = " + exitHost, "addrs = " + DefaultVPNSubnet, "start_action = start", "include " + swanctlUsersPath} {
+		if !strings.Contains(conf1, want) {
+			t.Errorf("Server 1 swanctl.conf missing %q:\n%s", want, conf1)
+		}
+	}
+	conf2 := files2[SwanctlConfPath]
+	for _, want := range []string{"tunnel-from-server1 {", "remote_addrs = " + entryHost, "remote_ts = " + DefaultVPNSubnet} {
+		if !strings.Contains(conf2, want) {
+			t.Errorf("Server 2 swanctl.conf missing %q:\n%s", want, conf2)
+		}
+	}
+	if !strings.Contains(files1["/etc/strongswan.d/charon-prio.conf"], "install_routes = no") {
+		t.Errorf("Server 1 does not disable route installation")
+	}
+
+	// Policy routing is only configured on the entry point
+	routing := writtenFiles(t, server1)[routingScriptPath]
+	for _, want := range []string{
+		"ip -4 route replace " + exitHost + " via 198.51.100.1 dev eth0",
+		"add_rule -4 220 " + DefaultVPNSubnet + " 220",
+	} {
+		if !strings.Contains(routing, want) {
+			t.Errorf("Server 1 routing script missing %q:\n%s", want, routing)
+		}
+	}
+	if !server1.Ran("sudo systemctl enable " + routingUnitName) {
+		t.Errorf("Server 1 routing unit not enabled")
+	}
+	if _, ok := writtenFiles(t, server2)[routingScriptPath]; ok {
+		t.Errorf("Server 2 should not get policy routing")
+	}
+}
+
+func TestSetupAllSkipsExistingInstallation(t *testing.T) {
+	server1 := preflightOK(sshtest.NewFake()).SetFile(CACertPath, "CA1")
+	server2 := preflightOK(sshtest.NewFake()).SetFile(CACertPath, "CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	for name, f := range map[string]*sshtest.Fake{"server1": server1, "server2": server2} {
+		if f.Ran("apt-get install -y charon-systemd") {
+			t.Errorf("%s: StrongSwan reinstalled although present", name)
+		}
+		if f.Ran("pki --gen") {
+			t.Errorf("%s: certificates regenerated although present", name)
+		}
+	}
+}
+
+func TestSetupAllStopsOnFailure(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").Fail("apt-get install", fmt.Errorf("dpkg lock held"))
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	err := m.SetupAll()
+	if err == nil {
+		t.Fatal("expected SetupAll to fail")
+	}
+	if !strings.Contains(err.Error(), "Server 2") || !strings.Contains(err.Error(), "dpkg lock held") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// Only the preflight checks and the network check ran on Server 1
+	for _, cmd := range server1.Commands()[server1.Index("date +%s")+1:] {
+		if cmd != "ip -4 route show table main" {
+			t.Errorf("Server 1 should not be touched after Server 2 failed, got %q", cmd)
+		}
+	}
+}
+
+func TestSetupAllFailsOnCACopy(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").Fail("tee "+neighbourCAPath("server1"), fmt.Errorf("disk full"))
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	events := collect(m)
+
+	err := m.SetupAll()
+	if err == nil || !strings.Contains(err.Error(), "failed to copy CA cert of Server 1 to Server 2: disk full") {
+		t.Fatalf("SetupAll error = %v, want the failed CA copy", err)
+	}
+	for _, cmd := range append(server1.Commands(), server2.Commands()...) {
+		if cmd == "sudo systemctl restart "+serviceName {
+			t.Error("tunnels restarted without the neighbour CA")
+		}
+	}
+	all := <-events
+	if last := all[len(all)-1].Step; last.ID != "tunnel" || last.Status != StepFailed {
+		t.Errorf("tunnel step not reported as failed: %+v", last)
+	}
+}
+
+func TestPlanDoesNotChangeServers(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	plan, err := m.Plan()
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	for name, f := range map[string]*sshtest.Fake{"server1": server1, "server2": server2} {
+		for _, cmd := range f.Commands() {
+			// Read-only probes run sudo non-interactively
+			if strings.Contains(cmd, "sudo") && !strings.Contains(cmd, "sudo -n ") {
+				t.Errorf("%s: plan mode ran mutating command %q", name, cmd)
+			}
+		}
+	}
+
+	if len(plan.Servers) != 2 || plan.Servers[0].Host != entryHost || plan.Servers[1].Host != exitHost {
+		t.Fatalf("unexpected plan servers: %+v", plan.Servers)
+	}
+	script := plan.Servers[0].Script()
+	for _, want := range []string{"apt-get install -y charon-systemd", "sudo tee " + SwanctlConfPath + " >/dev/null <<'IKEV2TM_EOF'", "tunnel-to-server2 {"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Server 1 plan missing %q", want)
+		}
+	}
+}
+
+func TestSetupAllThreeHops(t *testing.T) {
+	const relayHost = "192.0.2.30"
+	entry := freshServer("198.51.100.1", "CA1")
+	relay := freshServer("192.0.2.1", "CA2")
+	exit := freshServer("203.0.113.1", "CA3")
+	m, logger := newTestManager([]string{entryHost, relayHost, exitHost}, entry, relay, exit)
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	// Hops are prepared from the exit node back to the entry point
+	if !(logger.index("Setting up Server 3 (exit node)") < logger.index("Setting up Server 2 (relay)") &&
+		logger.index("Setting up Server 2 (relay)") < logger.index("Setting up Server 1 (entry point")) {
+		t.Errorf("unexpected setup order, log: %v", logger.lines)
+	}
+
+	entryFiles := writtenFiles(t, entry)
+	relayFiles := writtenFiles(t, relay)
+	exitFiles := writtenFiles(t, exit)
+
+	// Every hop trusts the CAs of its neighbours only
+	if entryFiles[neighbourCAPath("server2")] != "CA2" {
+		t.Error("entry point missing relay CA")
+	}
+	if relayFiles[neighbourCAPath("server1")] != "CA1" || relayFiles[neighbourCAPath("server3")] != "CA3" {
+		t.Error("relay missing neighbour CAs")
+	}
+	if exitFiles[neighbourCAPath("server2")] != "CA2" {
+		t.Error("exit node missing relay CA")
+	}
+	if _, ok := exitFiles[neighbourCAPath("server1")]; ok {
+		t.Error("exit node should not trust the entry point directly")
+	}
+
+	expect := map[string][]string{
+		"entry": {"ikev2-vpn {", "tunnel-to-server2 {", "remote_addrs = " + relayHost},
+		"relay": {"tunnel-from-server1 {", "remote_addrs = " + entryHost, "tunnel-to-server3 {", "remote_addrs = " + exitHost, "local_ts = " + DefaultVPNSubnet},
+		"exit":  {"tunnel-from-server2 {", "remote_addrs = " + relayHost, "remote_ts = " + DefaultVPNSubnet},
+	}
+	confs := map[string]string{
+		"entry": entryFiles[SwanctlConfPath],
+		"relay": relayFiles[SwanctlConfPath],
+		"exit":  exitFiles[SwanctlConfPath],
+	}
+	for role, wants := range expect {
+		for _, want := range wants {
+			if !strings.Contains(confs[role], want) {
+				t.Errorf("%s swanctl.conf missing %q:\n%s", role, want, confs[role])
+			}
+		}
+	}
+	if strings.Contains(confs["relay"], "ikev2-vpn {") || strings.Contains(confs["exit"], "ikev2-vpn {") {
+		t.Error("only the entry point should accept VPN clients")
+	}
+
+	// Entry and relay route client traffic into the next tunnel, the exit node does not
+	if !strings.Contains(writtenFiles(t, entry)[routingScriptPath], "ip -4 route replace "+relayHost+" via 198.51.100.1 dev eth0") {
+		t.Error("entry point missing route to relay")
+	}
+	if !strings.Contains(writtenFiles(t, relay)[routingScriptPath], "ip -4 route replace "+exitHost+" via 192.0.2.1 dev eth0") {
+		t.Error("relay missing route to exit node")
+	}
+	if _, ok := writtenFiles(t, exit)[routingScriptPath]; ok {
+		t.Error("exit node should not get policy routing")
+	}
+}
+
+func TestSetupConfigValidate(t *testing.T) {
+	one := &SetupConfig{Hops: []*Hop{{Server: &ssh.ServerConfig{Host: entryHost}}}}
+	one.SetDefaults()
+	if err := one.Validate(); err == nil {
+		t.Error("expected a single hop to be rejected")
+	}
+	one.Topology = TopologySingle
+	if err := one.Validate(); err != nil {
+		t.Errorf("single-server topology with one hop: %v", err)
+	}
+
+	missing := &SetupConfig{Hops: []*Hop{
+		{Server: &ssh.ServerConfig{Host: entryHost}},
+		{Name: "Exit", Server: &ssh.ServerConfig{}},
+	}}
+	missing.SetDefaults()
+	if err := missing.Validate(); err == nil || !strings.Contains(err.Error(), "Exit") {
+		t.Errorf("expected missing host error naming the hop, got %v", err)
+	}
+}
+
+func TestSetupAllSingleServer(t *testing.T) {
+	server := freshServer("198.51.100.1", "CA1")
+	unused := sshtest.NewFake()
+	m, logger := newTestManager([]string{entryHost, exitHost}, server, unused)
+	m.config.Topology = TopologySingle
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	if logger.index("Setting up Server 1 (single server)") < 0 {
+		t.Errorf("unexpected log: %v", logger.lines)
+	}
+	if len(unused.Calls()) != 0 {
+		t.Errorf("second server must not be touched in single-server mode, got %v", unused.Commands())
+	}
+
+	conf := writtenFiles(t, server)[SwanctlConfPath]
+	if !strings.Contains(conf, "ikev2-vpn {") || !strings.Contains(conf, "addrs = "+DefaultVPNSubnet) {
+		t.Errorf("swanctl.conf does not serve VPN clients:\n%s", conf)
+	}
+	if strings.Contains(conf, "tunnel-") {
+		t.Errorf("single server must not have tunnel connections:\n%s", conf)
+	}
+	if !server.Ran("MASQUERADE") {
+		t.Error("NAT not configured")
+	}
+	if _, ok := writtenFiles(t, server)[routingScriptPath]; ok {
+		t.Error("policy routing should be skipped")
+	}
+}
+
+func TestSetupAllMigratesLegacyDeployment(t *testing.T) {
+	legacy := func(caCert string) *sshtest.Fake {
+		return preflightOK(sshtest.NewFake()).
+			On("/etc/ipsec.conf && echo legacy", "legacy\n").
+			On("cat "+legacySecretsPath, ": RSA server-key.pem\nalice : EAP \"alice-pass\"\n").
+			SetFile(CACertPath, caCert)
+	}
+	server1, server2 := legacy("CA1"), legacy("CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	for name, f := range map[string]*sshtest.Fake{"server1": server1, "server2": server2} {
+		steps := []string{
+			"cp -n /etc/ipsec.d/certs/server-cert.pem " + serverCertPath,
+			"systemctl disable --now strongswan-starter",
+			"mv /etc/ipsec.conf " + legacyBackupPath,
+			"systemctl restart strongswan",
+		}
+		last := -1
+		for _, step := range steps {
+			i := f.Index(step)
+			if i < 0 {
+				t.Errorf("%s: missing step %q", name, step)
+				continue
+			}
+			if i < last {
+				t.Errorf("%s: step %q ran out of order", name, step)
+			}
+			last = i
+		}
+		if f.Ran("pki --gen") {
+			t.Errorf("%s: migrated certificates must be kept", name)
+		}
+
+		users := parseSwanctlUsers(writtenFiles(t, f)[swanctlUsersPath])
+		if len(users) != 1 || users[0] != (User{Username: "alice", Password: "alice-pass"}) {
+			t.Errorf("%s: unexpected converted users %+v", name, users)
+		}
+	}
+}
+
+func TestSetupConfigValidateNetwork(t *testing.T) {
+	tests := []struct {
+		vpnSubnet, tunnelSubnet string
+		dns                     []string
+		wantErr                 string
+	}{
+		{"10.20.0.0/24", "10.20.1.0/24", []string{"1.1.1.1"}, ""},
+		{"10.20.0.0", "10.20.1.0/24", DefaultDNS, "VPN subnet"},
+		{"10.20.0.1/24", "10.20.1.0/24", DefaultDNS, "host bits"},
+		{"10.20.0.0/16", "10.20.1.0/24", DefaultDNS, "overlaps"},
+		{"10.20.0.0/24", "10.20.1.0/24", []string{"dns.example"}, "DNS"},
+		{"fd00::/64", "10.20.1.0/24", DefaultDNS, "must be IPv4"},
+		{"10.20.0.0/24", "10.20.1.0/24", []string{"2001:4860:4860::8888"}, ""},
+	}
+	for _, tt := range tests {
+		c := &SetupConfig{VPNSubnet: tt.vpnSubnet, TunnelSubnet: tt.tunnelSubnet, DNS: tt.dns}
+		err := c.ValidateNetwork()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s/%s: unexpected error %v", tt.vpnSubnet, tt.tunnelSubnet, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s/%s: expected error containing %q, got %v", tt.vpnSubnet, tt.tunnelSubnet, tt.wantErr, err)
+		}
+	}
+}
+
+func TestSetupAllCustomNetwork(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	m.config.VPNSubnet = "172.30.0.0/24"
+	m.config.TunnelSubnet = "172.30.1.0/24"
+	m.config.DNS = []string{"1.1.1.1"}
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	for _, subnet := range []string{"172.30.0.0/24", "172.30.1.0/24"} {
+		if !strings.Contains(restoredRules(t, server2)["iptables"], "-A IKEV2TM-POSTROUTING -s "+subnet+" -o eth0 -j MASQUERADE") {
+			t.Errorf("exit node missing NAT for %s", subnet)
+		}
+	}
+	if server2.Ran("10.10.0.0/16") {
+		t.Error("firewall still uses the fixed /16")
+	}
+	conf := writtenFiles(t, server1)[SwanctlConfPath]
+	if !strings.Contains(conf, "addrs = 172.30.0.0/24") || !strings.Contains(conf, "dns = 1.1.1.1\n") {
+		t.Errorf("swanctl.conf does not use the custom network:\n%s", conf)
+	}
+}
+
+func TestSetupConfigValidateIPv6(t *testing.T) {
+	c := &SetupConfig{VPNSubnet6: ExampleVPNSubnet6}
+	c.SetDefaults()
+	if err := c.ValidateNetwork(); err != nil {
+		t.Errorf("unexpected error for %s: %v", ExampleVPNSubnet6, err)
+	}
+	c.VPNSubnet6 = "10.30.0.0/24"
+	if err := c.ValidateNetwork(); err == nil || !strings.Contains(err.Error(), "must be IPv6") {
+		t.Errorf("expected an error for an IPv4 IPv6 subnet, got %v", err)
+	}
+}
+
+func TestSetupAllDualStack(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").
+		On("ip -6 route show default", defaultRouteVia("fe80::1", "ens3"))
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	m.config.VPNSubnet6 = ExampleVPNSubnet6
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	for name, f := range map[string]*sshtest.Fake{"server1": server1, "server2": server2} {
+		sysctl := writtenFiles(t, f)[sysctlConfPath]
+		for _, want := range []string{"net.ipv6.conf.all.forwarding = 1", "net.ipv6.conf.default.accept_ra = 2"} {
+			if !strings.Contains(sysctl, want) {
+				t.Errorf("%s: %s missing %q", name, sysctlConfPath, want)
+			}
+		}
+		rules := restoredRules(t, f)
+		for _, want := range []string{"-A IKEV2TM-INPUT -p udp --dport 500 -j ACCEPT", "-A IKEV2TM-FORWARD -s " + ExampleVPNSubnet6 + " -j ACCEPT"} {
+			if !strings.Contains(rules["ip6tables"], want) {
+				t.Errorf("%s: ip6tables rules missing %q:\n%s", name, want, rules["ip6tables"])
+			}
+		}
+		if strings.Contains(rules["iptables"], ExampleVPNSubnet6) {
+			t.Errorf("%s: IPv6 subnet passed to iptables", name)
+		}
+	}
+	if !strings.Contains(restoredRules(t, server2)["ip6tables"], "-s "+ExampleVPNSubnet6+" -o ens3 -j MASQUERADE") {
+		t.Error("exit node missing IPv6 NAT on its IPv6 interface")
+	}
+	if !strings.Contains(writtenFiles(t, server1)[routingScriptPath], "add_rule -6 220 "+ExampleVPNSubnet6+" 220") {
+		t.Error("entry point missing IPv6 policy routing")
+	}
+	conf := writtenFiles(t, server1)[SwanctlConfPath]
+	if !strings.Contains(conf, "pools = ikev2-vpn-pool, ikev2-vpn-pool6") || !strings.Contains(conf, "local_ts = 10.10.10.0/24, "+ExampleVPNSubnet6) {
+		t.Errorf("swanctl.conf is not dual-stack:\n%s", conf)
+	}
+}
+
+func TestSetupAllIPv6OnlyServers(t *testing.T) {
+	const entry6, exit6 = "2001:db8::10", "2001:db8:1::20"
+	server1 := freshServer("", "CA1").
+		On("ip -4 route show default", "").
+		On("ip -6 route show default", defaultRouteVia("fe80::1", "eth0"))
+	server2 := freshServer("", "CA2")
+	m, _ := newTestManager([]string{entry6, exit6}, server1, server2)
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	routing := writtenFiles(t, server1)[routingScriptPath]
+	for _, want := range []string{
+		"add_rule -6 100 " + entry6 + " main",
+		"ip -6 route replace " + exit6 + " via fe80::1 dev eth0",
+	} {
+		if !strings.Contains(routing, want) {
+			t.Errorf("routing script missing %q:\n%s", want, routing)
+		}
+	}
+	if !server1.Ran("ip6tables -I INPUT 1 -j IKEV2TM-INPUT") {
+		t.Error("missing IPv6 firewall jump")
+	}
+	conf := writtenFiles(t, server1)[SwanctlConfPath]
+	if !strings.Contains(conf, "remote_addrs = "+exit6) {
+		t.Errorf("tunnel does not use the IPv6 address:\n%s", conf)
+	}
+}
+
+func TestSetupAllRejectsOverlappingNetwork(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1").
+		On("ip -4 route show table main", "default via 198.51.100.1 dev eth0\n"+
+			"10.10.0.0/16 dev docker0 proto kernel scope link src 10.10.0.1\n"+
+			exitHost+" via 198.51.100.1 dev eth0\n")
+	server2 := freshServer("203.0.113.1", "CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	err := m.SetupAll()
+	if err == nil || !strings.Contains(err.Error(), "10.10.0.0/16") || !strings.Contains(err.Error(), "Server 1") {
+		t.Fatalf("expected overlap error naming the network and server, got %v", err)
+	}
+	for name, f := range map[string]*sshtest.Fake{"server1": server1, "server2": server2} {
+		// The read-only preflight checks use sudo too
+		for _, cmd := range f.Commands()[f.Index("date +%s")+1:] {
+			if strings.Contains(cmd, "sudo") {
+				t.Errorf("%s: changed before the network check passed: %q", name, cmd)
+			}
+		}
+	}
+}
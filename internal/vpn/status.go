@@ -1,6 +1,7 @@
 package vpn
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -9,116 +10,147 @@ import (
 
 // Status represents VPN connection status
 type Status struct {
-	Connected     bool
-	TunnelActive  bool
-	ActiveClients int
-	Uptime        string
-	ServerIP      string
-	Connections   []ConnectionInfo
+	Connected     bool             `json:"connected"`
+	TunnelActive  bool             `json:"tunnel_active"`
+	ActiveClients int              `json:"active_clients"`
+	Uptime        string           `json:"uptime"`
+	ServerIP      string           `json:"server_ip"`
+	ServerIPv6    string           `json:"server_ipv6,omitempty"`
+	RoutingDrift  []string         `json:"routing_drift,omitempty"` // Deployed policy routing missing on the server
+	Connections   []ConnectionInfo `json:"connections"`
 }
 
 // ConnectionInfo holds info about a VPN connection
 type ConnectionInfo struct {
-	Name       string
-	RemoteAddr string
-	State      string
-	Uptime     string
+	Name       string `json:"name"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	State      string `json:"state"`
+	Uptime     string `json:"uptime,omitempty"`
 }
 
 // GetStatus retrieves VPN status from a server
-func GetStatus(client *ssh.Client) (*Status, error) {
-	if !client.IsConnected() {
-		if err := client.Connect(); err != nil {
-			return nil, err
-		}
+func GetStatus(client ssh.Executor) (*Status, error) {
+	return GetStatusContext(context.Background(), client)
+}
+
+// GetStatusContext is GetStatus with the remote commands bound to ctx
+func GetStatusContext(ctx context.Context, client ssh.Executor) (*Status, error) {
+	if err := ssh.EnsureConnected(client); err != nil {
+		return nil, err
 	}
 
 	status := &Status{}
 
-	// Check if StrongSwan is running by checking if charon process exists
-	// or if ipsec status returns meaningful output
-	output, err := client.Run("pgrep -x charon >/dev/null && echo 'running' || echo 'stopped'")
+	// Check if the charon-systemd service is running
+	output, err := client.RunContext(ctx, fmt.Sprintf("systemctl is-active --quiet %s && echo 'running' || echo 'stopped'", serviceName))
 	if err != nil {
 		output = "stopped"
 	}
 	status.Connected = strings.TrimSpace(output) == "running"
 
+	// Policy routing is checked even while StrongSwan is down, since missing
+	// rules are a common reason for that after a reboot
+	if drift, err := checkRouting(ctx, client); err == nil {
+		status.RoutingDrift = drift
+	}
+
 	if !status.Connected {
 		return status, nil
 	}
 
-	// Get connection status - use statusall for complete output
-	ipsecOutput, err := client.Run("sudo ipsec statusall 2>/dev/null || echo 'No connections'")
+	// List IKE SAs over VICI
+	sasOutput, err := client.RunContext(ctx, "sudo swanctl --list-sas 2>/dev/null || echo 'No connections'")
 	if err != nil {
 		return status, nil
 	}
 
-	// Parse connections from Security Associations section
-	lines := strings.Split(ipsecOutput, "\n")
-	inSecurityAssociations := false
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-
-		// Detect Security Associations section
-		if strings.HasPrefix(line, "Security Associations") {
-			inSecurityAssociations = true
+	for _, conn := range parseSAs(sasOutput) {
+		if conn.State != "ESTABLISHED" {
 			continue
 		}
 
-		// Only parse ESTABLISHED connections in the Security Associations section
-		if inSecurityAssociations && strings.Contains(line, "ESTABLISHED") {
-			// Count VPN clients (ikev2-vpn connections)
-			if strings.Contains(line, "ikev2-vpn[") {
-				status.ActiveClients++
-			}
-
-			// Check tunnel status
-			if strings.Contains(line, "tunnel-to-server2[") {
-				status.TunnelActive = true
-			}
+		// Count VPN clients (ikev2-vpn connections)
+		if conn.Name == "ikev2-vpn" {
+			status.ActiveClients++
+		}
 
-			parts := strings.Fields(line)
-			if len(parts) >= 2 {
-				conn := ConnectionInfo{
-					Name:  parts[0],
-					State: "ESTABLISHED",
-				}
-				status.Connections = append(status.Connections, conn)
-			}
+		// Check tunnel status (any leg of the chain to or from this server)
+		if strings.HasPrefix(conn.Name, "tunnel-to-") || strings.HasPrefix(conn.Name, "tunnel-from-") {
+			status.TunnelActive = true
 		}
+
+		status.Connections = append(status.Connections, conn)
 	}
 
 	// Get uptime
-	output, err = client.Run("systemctl show strongswan-starter --property=ActiveEnterTimestamp 2>/dev/null | cut -d= -f2")
+	output, err = client.RunContext(ctx, "systemctl show "+serviceName+" --property=ActiveEnterTimestamp 2>/dev/null | cut -d= -f2")
 	if err == nil {
 		status.Uptime = strings.TrimSpace(output)
 	}
 
 	// Get server IP (force IPv4)
-	output, err = client.Run("curl -4 -s --max-time 5 ifconfig.me 2>/dev/null || echo 'unknown'")
+	output, err = client.RunContext(ctx, "curl -4 -s --max-time 5 ifconfig.me 2>/dev/null || echo 'unknown'")
 	if err == nil {
 		status.ServerIP = strings.TrimSpace(output)
 	}
 
+	// IPv6 exit address; empty when the server has no IPv6 connectivity
+	output, err = client.RunContext(ctx, "curl -6 -s --max-time 5 ifconfig.me 2>/dev/null || true")
+	if err == nil {
+		status.ServerIPv6 = strings.TrimSpace(output)
+	}
+
 	return status, nil
 }
 
-// GetDetailedLogs retrieves StrongSwan logs
-func GetDetailedLogs(client *ssh.Client, lines int) (string, error) {
-	if !client.IsConnected() {
-		if err := client.Connect(); err != nil {
-			return "", err
+// parseSAs reads IKE SAs from "swanctl --list-sas". Each SA starts with an
+// unindented "name: #id, STATE, IKEv2, ..." line followed by indented details
+// such as "remote 'alice' @ 192.0.2.5[4500]".
+func parseSAs(output string) []ConnectionInfo {
+	var conns []ConnectionInfo
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, rest, ok := strings.Cut(line, ": #")
+			if !ok {
+				continue
+			}
+			fields := strings.Split(rest, ", ")
+			if len(fields) < 2 {
+				continue
+			}
+			conns = append(conns, ConnectionInfo{Name: name, State: fields[1]})
+			continue
+		}
+
+		// Remote address of the current SA, stripped of the port
+		detail := strings.TrimSpace(line)
+		if len(conns) > 0 && strings.HasPrefix(detail, "remote ") {
+			if _, addr, ok := strings.Cut(detail, " @ "); ok {
+				addr, _, _ = strings.Cut(addr, "[")
+				conns[len(conns)-1].RemoteAddr = strings.TrimSpace(addr)
+			}
 		}
 	}
+	return conns
+}
+
+// GetDetailedLogs retrieves StrongSwan logs
+func GetDetailedLogs(client ssh.Executor, lines int) (string, error) {
+	if err := ssh.EnsureConnected(client); err != nil {
+		return "", err
+	}
 
 	// Get journal logs
-	logs, err := client.Run(fmt.Sprintf("sudo journalctl -u strongswan-starter -n %d --no-pager 2>/dev/null", lines))
+	logs, err := client.Run(fmt.Sprintf("sudo journalctl -u %s -n %d --no-pager 2>/dev/null", serviceName, lines))
 	if err != nil {
 		logs = fmt.Sprintf("Failed to get journal logs: %v", err)
 	}
 
 	// Get IPsec status
-	status, _ := client.Run("sudo ipsec statusall 2>/dev/null")
+	status, _ := client.Run("sudo swanctl --list-conns 2>/dev/null; sudo swanctl --list-sas 2>/dev/null")
 
 	// Get Interfaces
 	ifaces, _ := client.Run("ip addr")
@@ -133,25 +165,21 @@ func GetDetailedLogs(client *ssh.Client, lines int) (string, error) {
 }
 
 // RestartVPN restarts StrongSwan service
-func RestartVPN(client *ssh.Client) error {
-	if !client.IsConnected() {
-		if err := client.Connect(); err != nil {
-			return err
-		}
+func RestartVPN(client ssh.Executor) error {
+	if err := ssh.EnsureConnected(client); err != nil {
+		return err
 	}
 
-	_, err := client.Run("sudo systemctl restart strongswan-starter")
+	_, err := client.Run("sudo systemctl restart " + serviceName)
 	return err
 }
 
 // StopVPN stops StrongSwan service
-func StopVPN(client *ssh.Client) error {
-	if !client.IsConnected() {
-		if err := client.Connect(); err != nil {
-			return err
-		}
+func StopVPN(client ssh.Executor) error {
+	if err := ssh.EnsureConnected(client); err != nil {
+		return err
 	}
 
-	_, err := client.Run("sudo systemctl stop strongswan-starter")
+	_, err := client.Run("sudo systemctl stop " + serviceName)
 	return err
 }
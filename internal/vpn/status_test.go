@@ -0,0 +1,93 @@
+package vpn
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+)
+
+const testListSAs = `ikev2-vpn: #7, ESTABLISHED, IKEv2, 1b5d8e0c3f9a2b44_i 9c0e7d6a5b4f3e21_r*
+  local  '198.51.100.10' @ 198.51.100.10[4500]
+  remote '192.0.2.5' @ 192.0.2.5[4500] EAP: 'alice' [10.10.10.1]
+  AES_CBC-256/HMAC_SHA2_256_128/PRF_HMAC_SHA2_256/MODP_2048
+  established 600s ago
+  ikev2-vpn: #3, reqid 3, INSTALLED, TUNNEL-in-UDP, ESP:AES_CBC-256/HMAC_SHA2_256_128
+    local  0.0.0.0/0
+    remote 10.10.10.1/32
+ikev2-vpn: #8, ESTABLISHED, IKEv2, 2c6e9f1d4a0b3c55_i 0d1f8e7b6c5a4f32_r*
+  local  '198.51.100.10' @ 198.51.100.10[4500]
+  remote '192.0.2.9' @ 192.0.2.9[4500] EAP: 'bob' [10.10.10.2]
+tunnel-to-server2: #1, ESTABLISHED, IKEv2, 3d7f0a2e5b1c4d66_i* 1e2a9f8c7d6b5a43_r
+  local  '198.51.100.10' @ 198.51.100.10[4500]
+  remote '203.0.113.20' @ 203.0.113.20[4500]
+  tunnel-to-server2: #1, reqid 1, INSTALLED, TUNNEL, ESP:AES_CBC-256/HMAC_SHA2_256_128
+ikev2-vpn: #9, CONNECTING, IKEv2, 4e8a1b3f6c2d5e77_i 0000000000000000_r
+  local  '198.51.100.10' @ 198.51.100.10[4500]
+  remote '%any' @ 192.0.2.11[4500]
+`
+
+func TestGetStatus(t *testing.T) {
+	f := sshtest.NewFake().
+		On("systemctl is-active", "running\n").
+		On("swanctl --list-sas", testListSAs).
+		On("ActiveEnterTimestamp", "Wed 2024-01-10 10:00:00 UTC\n").
+		On("curl -4 -s --max-time 5 ifconfig.me", "198.51.100.10").
+		On("curl -6 -s --max-time 5 ifconfig.me", "2001:db8::10")
+
+	status, err := GetStatus(f)
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+
+	if !status.Connected {
+		t.Error("expected StrongSwan to be reported as running")
+	}
+	if !status.TunnelActive {
+		t.Error("expected tunnel to be active")
+	}
+	if status.ActiveClients != 2 {
+		t.Errorf("ActiveClients = %d, want 2", status.ActiveClients)
+	}
+	if len(status.Connections) != 3 {
+		t.Errorf("got %d connections, want 3: %+v", len(status.Connections), status.Connections)
+	} else if status.Connections[1].RemoteAddr != "192.0.2.9" || status.Connections[2].Name != "tunnel-to-server2" {
+		t.Errorf("unexpected connections: %+v", status.Connections)
+	}
+	if status.Uptime != "Wed 2024-01-10 10:00:00 UTC" {
+		t.Errorf("Uptime = %q", status.Uptime)
+	}
+	if status.ServerIP != "198.51.100.10" {
+		t.Errorf("ServerIP = %q", status.ServerIP)
+	}
+	if status.ServerIPv6 != "2001:db8::10" {
+		t.Errorf("ServerIPv6 = %q", status.ServerIPv6)
+	}
+}
+
+func TestGetStatusStopped(t *testing.T) {
+	f := sshtest.NewFake().On("systemctl is-active", "stopped\n")
+
+	status, err := GetStatus(f)
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	if status.Connected || status.TunnelActive || status.ActiveClients != 0 {
+		t.Errorf("unexpected status for stopped server: %+v", status)
+	}
+	if f.Ran("swanctl --list-sas") {
+		t.Error("SAs should not be queried when StrongSwan is stopped")
+	}
+}
+
+func TestGetStatusCommandError(t *testing.T) {
+	f := sshtest.NewFake().Fail("systemctl is-active", fmt.Errorf("connection reset"))
+
+	status, err := GetStatus(f)
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	if status.Connected {
+		t.Error("failed check should report StrongSwan as stopped")
+	}
+}
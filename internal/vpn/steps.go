@@ -0,0 +1,214 @@
+package vpn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Setup step names, in the order they run on each server. The firewall comes
+// before ipsec because that step restarts StrongSwan: clients are only
+// accepted once the IKE ports are open and their traffic is forwarded and NATed.
+const (
+	StepInstall  = "install"
+	StepSysctl   = "sysctl"
+	StepCerts    = "certs"
+	StepFirewall = "firewall"
+	StepIPsec    = "ipsec"
+	StepTunnel   = "tunnel"
+	StepRouting  = "routing"
+)
+
+// StepStatus is the state of a setup step
+type StepStatus string
+
+const (
+	StepPending StepStatus = "pending"
+	StepRunning StepStatus = "running"
+	StepDone    StepStatus = "done"
+	StepFailed  StepStatus = "failed"
+	// StepSkipped steps completed in an earlier run that is being resumed
+	StepSkipped StepStatus = "skipped"
+)
+
+// Step is one unit of the setup sequence
+type Step struct {
+	ID     string     `json:"id"`               // Unique within a setup, e.g. "Server 1/install"
+	Server string     `json:"server,omitempty"` // Empty for steps spanning all servers
+	Name   string     `json:"name"`             // One of the Step* names
+	Status StepStatus `json:"status"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// ProgressEvent reports a step changing status
+type ProgressEvent struct {
+	Step  Step
+	Index int // Position of the step in Steps()
+	Total int // Number of steps
+}
+
+// defaultStepTimeout bounds a setup step. It stays below rollbackTimeout so a
+// hanging firewall or routing step fails before the server reverts it.
+const defaultStepTimeout = 3 * time.Minute
+
+// stepTimeouts holds the steps that may take longer than defaultStepTimeout
+var stepTimeouts = map[string]time.Duration{
+	StepInstall: 15 * time.Minute, // apt-get update and install on a slow mirror
+	StepCerts:   10 * time.Minute, // Key generation on a VPS short of entropy
+}
+
+// setupStep is a Step with the function performing it
+type setupStep struct {
+	Step
+	run func() error
+}
+
+// timeout returns how long the step may run
+func (s *setupStep) timeout() time.Duration {
+	if t, ok := stepTimeouts[s.Name]; ok {
+		return t
+	}
+	return defaultStepTimeout
+}
+
+// setupSteps lists the steps for the configured topology. Servers are set up
+// from the exit node back to the entry point, so every hop's upstream is ready
+// before it starts its tunnel; the tunnels and routing follow once all are.
+func (m *Manager) setupSteps() []*setupStep {
+	var steps []*setupStep
+	add := func(server, name string, run func() error) {
+		id := name
+		if server != "" {
+			id = server + "/" + name
+		}
+		steps = append(steps, &setupStep{Step: Step{ID: id, Server: server, Name: name, Status: StepPending}, run: run})
+	}
+
+	hops := m.config.ActiveHops()
+	for i := len(hops) - 1; i >= 0; i-- {
+		name := hopName(hops[i], i)
+		add(name, StepInstall, func() error { return m.installStrongSwan(i) })
+		add(name, StepSysctl, func() error {
+			m.note(m.nodes[i], "Enabling IP forwarding...")
+			if err := m.enableForwarding(m.nodes[i]); err != nil {
+				return fmt.Errorf("failed to enable IP forwarding: %w", err)
+			}
+			return nil
+		})
+		add(name, StepCerts, func() error { return m.setupCertificates(i) })
+		add(name, StepFirewall, func() error {
+			n := m.nodes[i]
+			m.note(n, "Configuring firewall...")
+			return m.withRollback(n, "configuring the firewall", func() error {
+				if err := m.configureFirewall(n); err != nil {
+					return fmt.Errorf("failed to configure firewall: %w", err)
+				}
+				return nil
+			})
+		})
+		add(name, StepIPsec, func() error { return m.startIPsec(i) })
+	}
+
+	if m.config.Topology == TopologySingle {
+		return steps
+	}
+
+	add("", StepTunnel, func() error {
+		m.logger.Log("Configuring tunnels between servers...")
+		return m.setupTunnel()
+	})
+	// Every hop that forwards into a tunnel needs policy routing
+	for i := 0; i < len(hops)-1; i++ {
+		add(hopName(hops[i], i), StepRouting, func() error {
+			return m.withRollback(m.nodes[i], "configuring policy routing", func() error {
+				return m.setupRouting(i)
+			})
+		})
+	}
+	return steps
+}
+
+// runStep runs s with its remote commands bound to a context derived from
+// parent that expires after the step timeout. A step whose context ended
+// fails even if it ignored the error of an interrupted command, so it is
+// never recorded as completed.
+func (m *Manager) runStep(parent context.Context, s *setupStep) error {
+	ctx, cancel := context.WithTimeout(parent, s.timeout())
+	defer cancel()
+	m.ctx = ctx
+	defer func() { m.ctx = parent }()
+
+	err := s.run()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil && errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+		return fmt.Errorf("timed out after %s: %w", s.timeout(), err)
+	}
+	return err
+}
+
+// Steps returns the setup steps for the configuration in execution order;
+// steps passed to SkipSteps are marked as skipped
+func (m *Manager) Steps() []Step {
+	var steps []Step
+	for _, s := range m.setupSteps() {
+		if m.skip[s.ID] {
+			s.Status = StepSkipped
+		}
+		steps = append(steps, s.Step)
+	}
+	return steps
+}
+
+// SkipSteps makes SetupAll skip the steps with the given IDs, which completed
+// in an earlier run. Resuming a failed run this way continues with the step
+// that failed.
+func (m *Manager) SkipSteps(ids []string) {
+	m.skip = make(map[string]bool)
+	for _, id := range ids {
+		m.skip[id] = true
+	}
+}
+
+// Progress returns a channel receiving an event whenever a step of the next
+// SetupAll changes status; it is closed when SetupAll returns. The events are
+// sent synchronously, so the channel must be drained.
+func (m *Manager) Progress() <-chan ProgressEvent {
+	if m.progress == nil {
+		m.progress = make(chan ProgressEvent, 16)
+	}
+	return m.progress
+}
+
+// report sends a progress event for step i of total
+func (m *Manager) report(s *setupStep, i, total int, status StepStatus, err error) {
+	if m.planning || m.progress == nil {
+		return
+	}
+	step := s.Step
+	step.Status = status
+	if err != nil {
+		step.Error = err.Error()
+	}
+	m.progress <- ProgressEvent{Step: step, Index: i, Total: total}
+}
+
+// Fingerprint identifies the servers and settings steps were run with; a run
+// may only be resumed with the same fingerprint
+func (c *SetupConfig) Fingerprint() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s|%s|%s|%s|%s|%s|%s|", c.Topology, c.VPNSubnet, c.TunnelSubnet, c.VPNSubnet6,
+		strings.Join(c.DNS, ","), c.Proposals, c.Firewall)
+	for _, hop := range c.ActiveHops() {
+		if hop.Server != nil {
+			fmt.Fprintf(&b, "%s:%d,", hop.Server.Host, hop.Server.Port)
+		}
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,213 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupSteps(t *testing.T) {
+	m, _ := newTestManager([]string{entryHost, exitHost}, nil, nil)
+
+	var ids []string
+	for _, s := range m.Steps() {
+		ids = append(ids, s.ID)
+		if s.Status != StepPending {
+			t.Errorf("%s: status %s, want pending", s.ID, s.Status)
+		}
+	}
+	want := []string{
+		"Server 2/install", "Server 2/sysctl", "Server 2/certs", "Server 2/firewall", "Server 2/ipsec",
+		"Server 1/install", "Server 1/sysctl", "Server 1/certs", "Server 1/firewall", "Server 1/ipsec",
+		"tunnel", "Server 1/routing",
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("steps = %v, want %v", ids, want)
+	}
+
+	m.config.Topology = TopologySingle
+	if n := len(m.Steps()); n != 5 {
+		t.Errorf("single server has %d steps, want 5", n)
+	}
+}
+
+// collect drains the progress events of a SetupAll run
+func collect(m *Manager) <-chan []ProgressEvent {
+	done := make(chan []ProgressEvent)
+	events := m.Progress()
+	go func() {
+		var all []ProgressEvent
+		for ev := range events {
+			all = append(all, ev)
+		}
+		done <- all
+	}()
+	return done
+}
+
+func TestSetupAllProgress(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").Fail("pki --gen", fmt.Errorf("exit status 1"))
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	events := collect(m)
+
+	if err := m.SetupAll(); err == nil {
+		t.Fatal("expected SetupAll to fail")
+	}
+
+	var got []string
+	for _, ev := range <-events {
+		got = append(got, fmt.Sprintf("%d/%d %s %s", ev.Index, ev.Total, ev.Step.ID, ev.Step.Status))
+	}
+	want := []string{
+		"0/12 Server 2/install running", "0/12 Server 2/install done",
+		"1/12 Server 2/sysctl running", "1/12 Server 2/sysctl done",
+		"2/12 Server 2/certs running", "2/12 Server 2/certs failed",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestSetupAllResume(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2")
+	m, logger := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	m.SkipSteps([]string{"Server 2/install", "Server 2/sysctl"})
+	events := collect(m)
+
+	if err := m.SetupAll(); err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+
+	if server2.Ran("apt-get install -y charon-systemd") || server2.Ran("sysctl -p") {
+		t.Error("completed steps ran again")
+	}
+	if !server2.Ran("pki --gen") || !server1.Ran("apt-get install") {
+		t.Error("remaining steps did not run")
+	}
+	if logger.index("Skipping Server 2/install") < 0 {
+		t.Error("skipped step not logged")
+	}
+	if all := <-events; all[0].Step.Status != StepSkipped || all[len(all)-1].Step.Status != StepDone {
+		t.Errorf("unexpected events: %+v", all)
+	}
+	if m.Steps()[1].Status != StepSkipped {
+		t.Error("Steps does not mark skipped steps")
+	}
+}
+
+// setStepTimeout shortens the timeout of a step for the duration of a test
+func setStepTimeout(t *testing.T, name string, d time.Duration) {
+	old, ok := stepTimeouts[name]
+	stepTimeouts[name] = d
+	t.Cleanup(func() {
+		if ok {
+			stepTimeouts[name] = old
+		} else {
+			delete(stepTimeouts, name)
+		}
+	})
+}
+
+func TestSetupAllStepTimeout(t *testing.T) {
+	setStepTimeout(t, StepInstall, 50*time.Millisecond)
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2").Hang("apt-get install -y charon-systemd")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	events := collect(m)
+
+	err := m.SetupAll()
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "install on Server 2: timed out after 50ms") {
+		t.Fatalf("SetupAll error = %v, want a step timeout", err)
+	}
+	if server2.Ran("sysctl -p") {
+		t.Error("setup continued after the timeout")
+	}
+	if all := <-events; all[len(all)-1].Step.Status != StepFailed {
+		t.Errorf("timed out step not reported as failed: %+v", all[len(all)-1])
+	}
+}
+
+func TestRunStepIgnoringInterruptedCommand(t *testing.T) {
+	setStepTimeout(t, "careless", 50*time.Millisecond)
+	server := freshServer("198.51.100.1", "CA1").Hang("sleep 600")
+	m, _ := newTestManager([]string{entryHost}, server)
+	if err := m.connectServers(); err != nil {
+		t.Fatalf("connectServers: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	step := &setupStep{Step: Step{ID: "Server 1/careless", Server: "Server 1", Name: "careless"}}
+
+	// The step drops the error of its command, as a careless step function would
+	step.run = func() error {
+		m.run(m.nodes[0], "sleep 600")
+		return nil
+	}
+	if err := m.runStep(ctx, step); !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "timed out after 50ms") {
+		t.Errorf("timed out step: runStep error = %v, want a step timeout", err)
+	}
+
+	step.run = func() error {
+		cancel()
+		m.run(m.nodes[0], "sleep 600")
+		return nil
+	}
+	if err := m.runStep(ctx, step); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled step: runStep error = %v, want context.Canceled", err)
+	}
+}
+
+func TestSetupAllCancelled(t *testing.T) {
+	server1 := freshServer("198.51.100.1", "CA1")
+	server2 := freshServer("203.0.113.1", "CA2")
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := m.SetupAllContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SetupAllContext error = %v, want context.Canceled", err)
+	}
+	if server1.Ran("apt-get install") || server2.Ran("apt-get install") {
+		t.Error("setup continued after cancellation")
+	}
+	if m.ctx != context.Background() {
+		t.Error("cancelled context left bound to the manager")
+	}
+}
+
+func TestFileAccessCancelled(t *testing.T) {
+	server := freshServer("198.51.100.1", "CA1")
+	m, _ := newTestManager([]string{entryHost}, server)
+	if err := m.connectServers(); err != nil {
+		t.Fatalf("connectServers: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer m.bind(ctx)()
+
+	if _, err := m.ensureFile(m.nodes[0], CACertPath, "CA2"); !errors.Is(err, context.Canceled) {
+		t.Errorf("ensureFile error = %v, want context.Canceled", err)
+	}
+	// Plan mode must not mistake the cancelled read for a missing file
+	m.planning = true
+	if _, err := m.readFile(m.nodes[0], CACertPath); !errors.Is(err, context.Canceled) {
+		t.Errorf("readFile error = %v, want context.Canceled", err)
+	}
+}
+
+func TestSetupConfigFingerprint(t *testing.T) {
+	m, _ := newTestManager([]string{entryHost, exitHost}, nil, nil)
+	before := m.config.Fingerprint()
+	if m.config.Fingerprint() != before {
+		t.Error("fingerprint is not stable")
+	}
+	m.config.VPNSubnet = "172.30.0.0/24"
+	if m.config.Fingerprint() == before {
+		t.Error("fingerprint ignores the VPN subnet")
+	}
+}
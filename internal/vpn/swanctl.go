@@ -0,0 +1,163 @@
+package vpn
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// StrongSwan is configured through swanctl.conf and managed by the
+// charon-systemd service, which loads the configuration over VICI.
+const (
+	SwanctlConfPath = "/etc/swanctl/swanctl.conf"
+
+	// swanctlUsersPath holds the EAP secrets; swanctl.conf includes it in its secrets section
+	swanctlUsersPath = "/etc/swanctl/users.conf"
+
+	serverCertPath = "/etc/swanctl/x509/server-cert.pem"
+	serverKeyPath  = "/etc/swanctl/private/server-key.pem"
+	caKeyPath      = "/etc/swanctl/private/ca-key.pem"
+
+	// serviceName is the charon-systemd unit
+	serviceName = "strongswan"
+
+	// reloadCredsCmd reloads certificates, keys and EAP secrets without dropping connections
+	reloadCredsCmd = "swanctl --load-creds --clear --noprompt"
+
+	// clientPool and clientPool6 hand out VPNSubnet and VPNSubnet6 addresses to VPN clients
+	clientPool  = "ikev2-vpn-pool"
+	clientPool6 = "ikev2-vpn-pool6"
+)
+
+// Files and service of deployments made with ipsec.conf and the stroke starter
+const (
+	legacyConfPath    = "/etc/ipsec.conf"
+	legacySecretsPath = "/etc/ipsec.secrets"
+	legacyBackupPath  = "/etc/ipsec.conf.ikev2tm-legacy"
+	legacyServiceName = "strongswan-starter"
+)
+
+// neighbourCAPath is where a hop stores the CA certificate of neighbour id
+func neighbourCAPath(id string) string {
+	return fmt.Sprintf("/etc/swanctl/x509ca/%s-ca.pem", id)
+}
+
+//go:embed templates/swanctl.conf.tmpl
+var swanctlTemplateText string
+
+var swanctlTemplates = template.Must(template.New("swanctl").Funcs(template.FuncMap{
+	"join": strings.Join,
+	"inc":  func(i int) int { return i + 1 },
+}).Parse(swanctlTemplateText))
+
+// swanctlConfig is the model rendered into swanctl.conf for one hop
+type swanctlConfig struct {
+	Client    *clientConfig  // Road-warrior connection; nil on hops without VPN clients
+	Tunnels   []tunnelConfig // Legs of the chain to the neighbouring hops
+	UsersPath string         // EAP secrets file included into the secrets section
+}
+
+// proposals lists IKE and ESP algorithms; empty lists keep StrongSwan's defaults
+type proposals struct {
+	IKE []string
+	ESP []string
+}
+
+// dpdSettings configures dead peer detection
+type dpdSettings struct {
+	Delay  string // Interval between liveness checks, e.g. "300s"; empty disables DPD
+	Action string // What to do with the CHILD_SA of a dead peer: clear, trap or restart
+}
+
+// poolConfig is a virtual IP pool for VPN clients
+type poolConfig struct {
+	Name  string
+	Addrs string   // Client addresses handed out from the pool
+	DNS   []string // DNS servers pushed to clients, may be empty
+}
+
+// clientConfig is the connection VPN clients use, authenticated with EAP-MSCHAPv2
+type clientConfig struct {
+	Name      string       // Connection and CHILD_SA name
+	LocalID   string       // Server identity, must match the certificate SAN
+	Cert      string       // Server certificate in /etc/swanctl/x509
+	LocalTS   string       // Networks reachable through the VPN, comma separated
+	Pools     []poolConfig // One pool per address family
+	Proposals proposals
+	DPD       dpdSettings
+}
+
+// tunnelConfig is one leg of the chain between neighbouring hops
+type tunnelConfig struct {
+	Name        string // Connection and CHILD_SA name, e.g. "tunnel-to-server2"
+	LocalID     string // Identity of this hop
+	RemoteID    string // Identity of the neighbour
+	RemoteAddr  string // Address of the neighbour
+	Cert        string // Certificate of this hop in /etc/swanctl/x509
+	LocalTS     string // Traffic selectors on this side, comma separated
+	RemoteTS    string // Traffic selectors on the neighbour's side, comma separated
+	StartAction string // "start" on the initiator, "none" on the responder
+	Proposals   proposals
+	DPD         dpdSettings
+}
+
+// renderSwanctl renders swanctl.conf from the model
+func renderSwanctl(cfg *swanctlConfig) (string, error) {
+	return executeTemplate("swanctl.conf", cfg)
+}
+
+// renderSwanctlUsers renders EAP users as secrets sections. Sections are
+// numbered because usernames may contain characters swanctl does not allow
+// in section names.
+func renderSwanctlUsers(users []User) (string, error) {
+	return executeTemplate("users.conf", users)
+}
+
+func executeTemplate(name string, data any) (string, error) {
+	var b strings.Builder
+	if err := swanctlTemplates.ExecuteTemplate(&b, name, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", name, err)
+	}
+	return b.String(), nil
+}
+
+// parseSwanctlUsers reads the EAP users from the secrets file
+func parseSwanctlUsers(conf string) []User {
+	var users []User
+	var cur User
+	for _, line := range strings.Split(conf, "\n") {
+		line = strings.TrimSpace(line)
+		key, value, ok := strings.Cut(line, "=")
+		switch {
+		case ok && strings.TrimSpace(key) == "id":
+			cur.Username = strings.Trim(strings.TrimSpace(value), `"`)
+		case ok && strings.TrimSpace(key) == "secret":
+			cur.Password = strings.Trim(strings.TrimSpace(value), `"`)
+		case line == "}":
+			if cur.Username != "" {
+				users = append(users, cur)
+			}
+			cur = User{}
+		}
+	}
+	return users
+}
+
+// parseLegacySecrets reads EAP users from ipsec.secrets ("name : EAP "password"")
+func parseLegacySecrets(secrets string) []User {
+	var users []User
+	for _, line := range strings.Split(secrets, "\n") {
+		name, rest, ok := strings.Cut(strings.TrimSpace(line), " : EAP ")
+		if !ok {
+			continue
+		}
+		start := strings.Index(rest, "\"")
+		end := strings.LastIndex(rest, "\"")
+		if name == "" || name == "tunnel-user" || start == -1 || end <= start {
+			continue
+		}
+		users = append(users, User{Username: name, Password: rest[start+1 : end]})
+	}
+	return users
+}
@@ -0,0 +1,88 @@
+package vpn
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// checkGolden compares got with testdata/name, rewriting the file with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("failed to update %s: %v", path, err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run go test -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s does not match the golden file (run go test -update if the change is intended)\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestSwanctlConfGolden(t *testing.T) {
+	chain, _ := newTestManager([]string{entryHost, "192.0.2.30", exitHost}, nil, nil, nil)
+	single, _ := newTestManager([]string{entryHost}, nil)
+	single.config.Topology = TopologySingle
+	dualStack, _ := newTestManager([]string{entryHost, "2001:db8::20"}, nil, nil)
+	dualStack.config.VPNSubnet6 = ExampleVPNSubnet6
+
+	tests := []struct {
+		golden string
+		m      *Manager
+		hop    int
+	}{
+		{"swanctl-entry.conf", chain, 0},
+		{"swanctl-relay.conf", chain, 1},
+		{"swanctl-exit.conf", chain, 2},
+		{"swanctl-single.conf", single, 0},
+		{"swanctl-dualstack-entry.conf", dualStack, 0},
+		{"swanctl-dualstack-exit.conf", dualStack, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			conf, err := renderSwanctl(tt.m.swanctlModel(tt.hop, true))
+			if err != nil {
+				t.Fatalf("renderSwanctl: %v", err)
+			}
+			checkGolden(t, tt.golden, conf)
+		})
+	}
+}
+
+func TestSwanctlConfProposals(t *testing.T) {
+	m, _ := newTestManager([]string{entryHost, exitHost}, nil, nil)
+	m.config.Proposals = ProfileCNSA
+	cfg := m.swanctlModel(0, true)
+	cfg.Tunnels[0].DPD = dpdSettings{Delay: "30s", Action: "restart"}
+
+	conf, err := renderSwanctl(cfg)
+	if err != nil {
+		t.Fatalf("renderSwanctl: %v", err)
+	}
+	checkGolden(t, "swanctl-proposals.conf", conf)
+}
+
+func TestSwanctlUsersGolden(t *testing.T) {
+	conf, err := renderSwanctlUsers([]User{
+		{Username: "alice", Password: "alice-pass"},
+		{Username: "a.b*", Password: "p@ss word"},
+	})
+	if err != nil {
+		t.Fatalf("renderSwanctlUsers: %v", err)
+	}
+	checkGolden(t, "users.conf", conf)
+
+	users := parseSwanctlUsers(conf)
+	if len(users) != 2 || users[1].Username != "a.b*" || users[1].Password != "p@ss word" {
+		t.Errorf("rendered users do not parse back: %+v", users)
+	}
+}
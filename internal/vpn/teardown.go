@@ -0,0 +1,258 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// strongswanPackages are installed by installStrongSwan and removed by a purging teardown
+const strongswanPackages = "charon-systemd strongswan-swanctl strongswan-pki libcharon-extra-plugins libcharon-extauth-plugins"
+
+// charonPrioConfPath disables route installation by charon; written by configureIPsec
+const charonPrioConfPath = "/etc/strongswan.d/charon-prio.conf"
+
+// TeardownOptions selects what Teardown removes besides the deployment itself
+type TeardownOptions struct {
+	KeepCA bool // Keep the CA key and certificate so a new setup stays trusted by existing client profiles
+	Purge  bool // Also uninstall the StrongSwan packages
+}
+
+// TeardownReport lists what Teardown removed from one server
+type TeardownReport struct {
+	Name    string   `json:"name"`
+	Host    string   `json:"host"`
+	Removed []string `json:"removed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Teardown undoes SetupAll on every server of the topology: StrongSwan is
+// stopped, and the generated configuration, certificates, firewall rules,
+// policy routing and kernel settings are removed. A failing server does not
+// stop the others; every server gets a report.
+func (m *Manager) Teardown(opts TeardownOptions) ([]*TeardownReport, error) {
+	return m.TeardownContext(context.Background(), opts)
+}
+
+// TeardownContext is Teardown stopping when ctx is cancelled; servers not yet
+// reached get no report
+func (m *Manager) TeardownContext(ctx context.Context, opts TeardownOptions) ([]*TeardownReport, error) {
+	if err := m.config.Validate(); err != nil {
+		return nil, err
+	}
+	defer m.bind(ctx)()
+	m.logger.Log("Removing the VPN from all servers...")
+
+	if err := m.connectServers(); err != nil {
+		return nil, err
+	}
+	defer m.disconnectServers()
+
+	var reports []*TeardownReport
+	failed := 0
+	for _, n := range m.nodes {
+		report := &TeardownReport{Name: n.name, Host: n.config.Host}
+		if err := m.teardownHop(n, opts, report); err != nil {
+			m.logger.Errorf("[%s] Teardown failed: %v", n.name, err)
+			report.Error = err.Error()
+			failed++
+		}
+		reports = append(reports, report)
+		if err := ctx.Err(); err != nil {
+			return reports, fmt.Errorf("teardown cancelled: %w", err)
+		}
+	}
+
+	if failed > 0 {
+		return reports, fmt.Errorf("teardown failed on %d of %d servers", failed, len(m.nodes))
+	}
+	m.logger.Log("VPN removed from all servers")
+	return reports, nil
+}
+
+// teardownHop removes the deployment from one server, recording what it removed
+func (m *Manager) teardownHop(n *node, opts TeardownOptions, report *TeardownReport) error {
+	removed := func(format string, args ...interface{}) {
+		item := fmt.Sprintf(format, args...)
+		m.note(n, "Removed %s", item)
+		report.Removed = append(report.Removed, item)
+	}
+
+	m.note(n, "Stopping StrongSwan...")
+	if _, err := m.probe(n, fmt.Sprintf("systemctl is-enabled --quiet %[1]s || systemctl is-active --quiet %[1]s", serviceName)); err == nil {
+		if _, err := m.run(n, "sudo systemctl disable --now "+serviceName); err != nil {
+			return fmt.Errorf("failed to stop StrongSwan: %w", err)
+		}
+		removed("StrongSwan service (stopped and disabled)")
+	}
+
+	// Removing the rules that accept SSH can lock us out as much as adding them
+	err := m.withRollback(n, "removing the firewall and policy routing", func() error {
+		if err := m.teardownRouting(n, removed); err != nil {
+			return fmt.Errorf("failed to remove policy routing: %w", err)
+		}
+		if err := m.teardownFirewall(n, removed); err != nil {
+			return fmt.Errorf("failed to remove firewall rules: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.probe(n, "test -f "+sysctlConfPath); err == nil {
+		// The live values stay, other services (such as Docker) may rely on forwarding
+		if _, err := m.run(n, fmt.Sprintf("sudo rm -f %s && sudo sysctl --system >/dev/null", sysctlConfPath)); err != nil {
+			return fmt.Errorf("failed to remove kernel settings: %w", err)
+		}
+		removed("%s (IP forwarding stays enabled until reboot)", sysctlConfPath)
+	}
+
+	m.note(n, "Removing configuration and certificates...")
+	paths := []string{
+		SwanctlConfPath, swanctlUsersPath, charonPrioConfPath,
+		serverCertPath, serverKeyPath, neighbourCAPath("server*"),
+		rollbackScriptPath,
+	}
+	if !opts.KeepCA {
+		paths = append(paths, CACertPath, caKeyPath)
+	}
+	// The private key directory is root-only, so the globs are expanded as root
+	out, err := m.probe(n, fmt.Sprintf("sudo sh -c 'ls -d %s 2>/dev/null' || true", strings.Join(paths, " ")))
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	files := strings.Fields(out)
+	if len(files) > 0 {
+		if _, err := m.run(n, "sudo rm -f "+strings.Join(files, " ")); err != nil {
+			return fmt.Errorf("failed to remove files: %w", err)
+		}
+		for _, f := range files {
+			removed("%s", f)
+		}
+	}
+	if _, err := m.run(n, "sudo rmdir /etc/ikev2tm 2>/dev/null; sudo rm -rf /var/lib/ikev2tm"); err != nil {
+		return err
+	}
+
+	if opts.Purge {
+		out, _ := m.probe(n, fmt.Sprintf("dpkg-query -W -f='${Package} ${Status}\\n' %s 2>/dev/null | grep ' installed$' | cut -d' ' -f1 || true", strongswanPackages))
+		if installed := strings.Fields(out); len(installed) > 0 {
+			m.note(n, "Uninstalling StrongSwan...")
+			_, err := m.run(n, fmt.Sprintf(`
+		sudo DEBIAN_FRONTEND=noninteractive apt-get purge -y %s
+		sudo DEBIAN_FRONTEND=noninteractive apt-get autoremove -y
+	`, strings.Join(installed, " ")))
+			if err != nil {
+				return fmt.Errorf("failed to uninstall StrongSwan: %w", err)
+			}
+			removed("packages %s", strings.Join(installed, ", "))
+		}
+	}
+	return nil
+}
+
+// teardownRouting removes the routing unit and the rules and routes of its script
+func (m *Manager) teardownRouting(n *node, removed func(string, ...interface{})) error {
+	script, err := m.probe(n, "cat "+routingScriptPath+" 2>/dev/null || true")
+	if err != nil {
+		return err
+	}
+	rules, routes := parseRoutingScript(script)
+
+	var cmds []string
+	if len(rules) > 0 || len(routes) > 0 {
+		cmds = append(cmds,
+			fmt.Sprintf("sudo systemctl disable --now %s 2>/dev/null || true", routingUnitName),
+			fmt.Sprintf("sudo rm -f %s %s", routingUnitPath, routingScriptPath),
+			"sudo systemctl daemon-reload")
+	}
+	for _, r := range rules {
+		cmds = append(cmds, fmt.Sprintf("sudo ip %s rule del from %s lookup %s pref %d 2>/dev/null || true", r.Family, r.From, r.Table, r.Pref))
+	}
+	for _, r := range routes {
+		if r.Table != "" {
+			continue // The whole table is flushed below
+		}
+		route := r.Dst
+		if r.Via != "" {
+			route += " via " + r.Via
+		}
+		cmds = append(cmds, fmt.Sprintf("sudo ip %s route del %s dev %s 2>/dev/null || true", r.Family, route, r.Dev))
+	}
+	// Servers set up before the routing unit existed have the rules but no script
+	for _, family := range []string{"-4", "-6"} {
+		cmds = append(cmds,
+			fmt.Sprintf("while sudo ip %s rule del lookup 220 2>/dev/null; do :; done", family),
+			fmt.Sprintf("sudo ip %s route flush table 220 2>/dev/null || true", family))
+	}
+	if _, err := m.run(n, strings.Join(cmds, "\n")); err != nil {
+		return err
+	}
+
+	if len(rules) > 0 || len(routes) > 0 {
+		removed("policy routing (%s, %d rules, %d routes)", routingUnitName, len(rules), len(routes))
+	}
+	return nil
+}
+
+// teardownFirewall removes the rules of both backends and the rules earlier
+// versions added to the built-in iptables chains
+func (m *Manager) teardownFirewall(n *node, removed func(string, ...interface{})) error {
+	out, err := m.probe(n, fmt.Sprintf(`
+		sudo iptables -S %[1]s >/dev/null 2>&1 && echo iptables
+		sudo ip6tables -S %[1]s >/dev/null 2>&1 && echo ip6tables
+		sudo nft list table inet %[2]s >/dev/null 2>&1 && echo nftables
+		true
+	`, iptablesInputChain, nftTable))
+	if err != nil {
+		return err
+	}
+	found := strings.Fields(out)
+
+	fw, err := m.firewallModel(n)
+	if err != nil {
+		return err
+	}
+	var script strings.Builder
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		fmt.Fprintf(&script, `
+		if command -v %[1]s >/dev/null; then
+			while sudo %[1]s -D INPUT -j %[2]s 2>/dev/null; do :; done
+			while sudo %[1]s -D FORWARD -j %[3]s 2>/dev/null; do :; done
+			while sudo %[1]s -t nat -D POSTROUTING -j %[4]s 2>/dev/null; do :; done
+			sudo %[1]s -F %[2]s 2>/dev/null && sudo %[1]s -X %[2]s
+			sudo %[1]s -F %[3]s 2>/dev/null && sudo %[1]s -X %[3]s
+			sudo %[1]s -t nat -F %[4]s 2>/dev/null && sudo %[1]s -t nat -X %[4]s
+		fi
+`, cmd, iptablesInputChain, iptablesForwardChain, iptablesNatChain)
+
+		var subnets []natSubnet
+		for _, s := range fw.Subnets {
+			if (cmd == "ip6tables") != s.Subnet.Addr().Is4() {
+				subnets = append(subnets, s)
+			}
+		}
+		script.WriteString(iptablesLegacyCleanup(cmd, subnets))
+	}
+	fmt.Fprintf(&script, `
+		if command -v netfilter-persistent >/dev/null; then
+			sudo netfilter-persistent save
+		fi
+		sudo nft delete table inet %[1]s 2>/dev/null || true
+		sudo rm -f %[2]s
+		sudo sed -i '\|^%[3]s$|d' %[4]s 2>/dev/null || true
+	`, nftTable, nftRulesPath, nftIncludeLine, nftMainPath)
+	if _, err := m.run(n, script.String()); err != nil {
+		return err
+	}
+
+	for _, backend := range found {
+		if backend == "nftables" {
+			removed("nftables table inet %s", nftTable)
+		} else {
+			removed("%s chains %s, %s, %s", backend, iptablesInputChain, iptablesForwardChain, iptablesNatChain)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package vpn
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+)
+
+// deployedServer scripts a server set up with the iptables backend
+func deployedServer(files ...string) *sshtest.Fake {
+	return sshtest.NewFake().
+		On("ip -4 route show default", defaultRouteVia("198.51.100.1", "eth0")).
+		On("cat "+routingScriptPath, testRoutingScript).
+		On("echo ip6tables", "iptables\n").
+		On("ls -d", strings.Join(files, "\n")+"\n").
+		On("dpkg-query", "charon-systemd\nstrongswan-swanctl\n")
+}
+
+func TestTeardown(t *testing.T) {
+	server1 := deployedServer(SwanctlConfPath, serverKeyPath, CACertPath)
+	server2 := deployedServer(SwanctlConfPath)
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	reports, err := m.Teardown(TeardownOptions{})
+	if err != nil {
+		t.Fatalf("Teardown: %v", err)
+	}
+	if len(reports) != 2 || reports[0].Name != "Server 1" || reports[1].Host != exitHost {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+
+	for _, want := range []string{
+		"StrongSwan service (stopped and disabled)",
+		"policy routing (ikev2tm-routing.service, 2 rules, 2 routes)",
+		"iptables chains IKEV2TM-INPUT, IKEV2TM-FORWARD, IKEV2TM-POSTROUTING",
+		sysctlConfPath + " (IP forwarding stays enabled until reboot)",
+		CACertPath,
+	} {
+		if !slices.Contains(reports[0].Removed, want) {
+			t.Errorf("report missing %q: %q", want, reports[0].Removed)
+		}
+	}
+
+	for _, step := range []string{
+		"sudo systemctl disable --now " + serviceName,
+		"sudo ip -4 rule del from " + DefaultVPNSubnet + " lookup 220 pref 220",
+		"sudo ip -4 route del " + exitHost + " via 198.51.100.1 dev eth0",
+		"sudo ip -4 route flush table 220",
+		"sudo iptables -F IKEV2TM-INPUT 2>/dev/null && sudo iptables -X IKEV2TM-INPUT",
+		"while sudo iptables -D INPUT -p udp --dport 500 -j ACCEPT",
+		"sudo nft delete table inet " + nftTable,
+		"sudo rm -f " + SwanctlConfPath + " " + serverKeyPath + " " + CACertPath,
+	} {
+		if !server1.Ran(step) {
+			t.Errorf("missing step %q", step)
+		}
+	}
+	// Firewall and routing are removed behind the dead-man switch
+	if !server1.Ran(disarmCommand) {
+		t.Error("rollback not disarmed")
+	}
+	if server1.Ran("apt-get purge") {
+		t.Error("packages purged without the option")
+	}
+}
+
+func TestTeardownKeepCAAndPurge(t *testing.T) {
+	server := deployedServer(SwanctlConfPath)
+	m, _ := newTestManager([]string{entryHost}, server)
+	m.config.Topology = TopologySingle
+
+	reports, err := m.Teardown(TeardownOptions{KeepCA: true, Purge: true})
+	if err != nil {
+		t.Fatalf("Teardown: %v", err)
+	}
+
+	listed := server.Commands()[server.Index("ls -d")]
+	if strings.Contains(listed, CACertPath) || strings.Contains(listed, caKeyPath) {
+		t.Errorf("CA removed despite KeepCA: %s", listed)
+	}
+	if !strings.Contains(listed, serverCertPath) {
+		t.Errorf("server certificate not removed: %s", listed)
+	}
+	if !server.Ran("apt-get purge -y charon-systemd strongswan-swanctl") {
+		t.Error("installed packages not purged")
+	}
+	if !slices.Contains(reports[0].Removed, "packages charon-systemd, strongswan-swanctl") {
+		t.Errorf("purge not reported: %q", reports[0].Removed)
+	}
+}
+
+func TestTeardownContinuesAfterFailure(t *testing.T) {
+	server1 := deployedServer().Fail("systemctl disable --now "+serviceName, fmt.Errorf("exit status 1"))
+	server2 := deployedServer(SwanctlConfPath)
+	m, _ := newTestManager([]string{entryHost, exitHost}, server1, server2)
+
+	reports, err := m.Teardown(TeardownOptions{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(reports) != 2 || reports[0].Error == "" || reports[1].Error != "" {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	if !server2.Ran("sudo rm -f " + SwanctlConfPath) {
+		t.Error("second server not torn down")
+	}
+}
@@ -0,0 +1,74 @@
+
+		# Replace the contents of the dedicated chains
+		sudo iptables-restore --noflush <<'IKEV2TM_RULES'
+*filter
+:IKEV2TM-INPUT - [0:0]
+:IKEV2TM-FORWARD - [0:0]
+-A IKEV2TM-INPUT -p tcp --dport 22 -j ACCEPT
+-A IKEV2TM-INPUT -p udp --dport 500 -j ACCEPT
+-A IKEV2TM-INPUT -p udp --dport 4500 -j ACCEPT
+-A IKEV2TM-INPUT -p esp -j ACCEPT
+-A IKEV2TM-FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A IKEV2TM-FORWARD -s 10.10.10.0/24 -j ACCEPT
+-A IKEV2TM-FORWARD -s 10.10.20.0/24 -j ACCEPT
+COMMIT
+*nat
+:IKEV2TM-POSTROUTING - [0:0]
+-A IKEV2TM-POSTROUTING -s 10.10.10.0/24 -m policy --pol ipsec --dir out -j ACCEPT
+-A IKEV2TM-POSTROUTING -s 10.10.10.0/24 -o eth0 -j MASQUERADE
+-A IKEV2TM-POSTROUTING -s 10.10.20.0/24 -m policy --pol ipsec --dir out -j ACCEPT
+-A IKEV2TM-POSTROUTING -s 10.10.20.0/24 -o eth0 -j MASQUERADE
+COMMIT
+IKEV2TM_RULES
+
+		# Jump to them ahead of other rules, once
+		sudo iptables -C INPUT -j IKEV2TM-INPUT 2>/dev/null || sudo iptables -I INPUT 1 -j IKEV2TM-INPUT
+		sudo iptables -C FORWARD -j IKEV2TM-FORWARD 2>/dev/null || sudo iptables -I FORWARD 1 -j IKEV2TM-FORWARD
+		sudo iptables -t nat -C POSTROUTING -j IKEV2TM-POSTROUTING 2>/dev/null || sudo iptables -t nat -I POSTROUTING 1 -j IKEV2TM-POSTROUTING
+
+		# Remove rules earlier versions added to the built-in chains
+		while sudo iptables -D INPUT -p tcp --dport 22 -j ACCEPT 2>/dev/null; do :; done
+		while sudo iptables -D INPUT -p udp --dport 500 -j ACCEPT 2>/dev/null; do :; done
+		while sudo iptables -D INPUT -p udp --dport 4500 -j ACCEPT 2>/dev/null; do :; done
+		while sudo iptables -D INPUT -p esp -j ACCEPT 2>/dev/null; do :; done
+		while sudo iptables -D FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT 2>/dev/null; do :; done
+		while sudo iptables -D FORWARD -s 10.10.10.0/24 -j ACCEPT 2>/dev/null; do :; done
+		while sudo iptables -t nat -D POSTROUTING -s 10.10.10.0/24 -m policy --pol ipsec --dir out -j ACCEPT 2>/dev/null; do :; done
+		while sudo iptables -t nat -D POSTROUTING -s 10.10.10.0/24 -o eth0 -j MASQUERADE 2>/dev/null; do :; done
+		while sudo iptables -D FORWARD -s 10.10.20.0/24 -j ACCEPT 2>/dev/null; do :; done
+		while sudo iptables -t nat -D POSTROUTING -s 10.10.20.0/24 -m policy --pol ipsec --dir out -j ACCEPT 2>/dev/null; do :; done
+		while sudo iptables -t nat -D POSTROUTING -s 10.10.20.0/24 -o eth0 -j MASQUERADE 2>/dev/null; do :; done
+
+		# Replace the contents of the dedicated chains
+		sudo ip6tables-restore --noflush <<'IKEV2TM_RULES'
+*filter
+:IKEV2TM-INPUT - [0:0]
+:IKEV2TM-FORWARD - [0:0]
+-A IKEV2TM-INPUT -p tcp --dport 22 -j ACCEPT
+-A IKEV2TM-INPUT -p udp --dport 500 -j ACCEPT
+-A IKEV2TM-INPUT -p udp --dport 4500 -j ACCEPT
+-A IKEV2TM-INPUT -p esp -j ACCEPT
+-A IKEV2TM-FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A IKEV2TM-FORWARD -s fd10:10:10::/64 -j ACCEPT
+COMMIT
+*nat
+:IKEV2TM-POSTROUTING - [0:0]
+-A IKEV2TM-POSTROUTING -s fd10:10:10::/64 -m policy --pol ipsec --dir out -j ACCEPT
+-A IKEV2TM-POSTROUTING -s fd10:10:10::/64 -o eth0 -j MASQUERADE
+COMMIT
+IKEV2TM_RULES
+
+		# Jump to them ahead of other rules, once
+		sudo ip6tables -C INPUT -j IKEV2TM-INPUT 2>/dev/null || sudo ip6tables -I INPUT 1 -j IKEV2TM-INPUT
+		sudo ip6tables -C FORWARD -j IKEV2TM-FORWARD 2>/dev/null || sudo ip6tables -I FORWARD 1 -j IKEV2TM-FORWARD
+		sudo ip6tables -t nat -C POSTROUTING -j IKEV2TM-POSTROUTING 2>/dev/null || sudo ip6tables -t nat -I POSTROUTING 1 -j IKEV2TM-POSTROUTING
+
+		# Remove rules earlier versions added to the built-in chains
+		while sudo ip6tables -D INPUT -p tcp --dport 22 -j ACCEPT 2>/dev/null; do :; done
+		while sudo ip6tables -D INPUT -p udp --dport 500 -j ACCEPT 2>/dev/null; do :; done
+		while sudo ip6tables -D INPUT -p udp --dport 4500 -j ACCEPT 2>/dev/null; do :; done
+		while sudo ip6tables -D INPUT -p esp -j ACCEPT 2>/dev/null; do :; done
+		while sudo ip6tables -D FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT 2>/dev/null; do :; done
+		while sudo ip6tables -D FORWARD -s fd10:10:10::/64 -j ACCEPT 2>/dev/null; do :; done
+		while sudo ip6tables -t nat -D POSTROUTING -s fd10:10:10::/64 -m policy --pol ipsec --dir out -j ACCEPT 2>/dev/null; do :; done
+		while sudo ip6tables -t nat -D POSTROUTING -s fd10:10:10::/64 -o eth0 -j MASQUERADE 2>/dev/null; do :; done
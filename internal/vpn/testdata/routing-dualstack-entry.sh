@@ -0,0 +1,30 @@
+#!/bin/sh
+# Generated by IKEv2TunnelManager, changes will be overwritten
+# Policy routing for Server 1, applied at boot by ikev2tm-routing.service
+set -e
+
+# add_rule FAMILY PREF FROM TABLE adds "from FROM lookup TABLE" unless it exists
+add_rule() {
+    ip "$1" rule show pref "$2" | grep -qF "from $3 lookup $4" || ip "$1" rule add from "$3" lookup "$4" pref "$2"
+}
+
+# Only client traffic may use the IPsec table, never all traffic
+ip -4 rule del from all lookup 220 2>/dev/null || true
+
+# Prevent lockout: traffic from the server's own address always uses the main table
+add_rule -4 100 198.51.100.10 main
+
+# Only traffic from VPN clients follows the IPsec table 220
+add_rule -4 220 10.10.10.0/24 220
+
+# Same for IPv6 clients
+add_rule -6 220 fd10:10:10::/64 220
+
+# Keep the next hop reachable through the direct gateway
+ip -4 route replace 203.0.113.20 via 198.51.100.1 dev eth0
+
+# Table 220 needs a default route for the IPsec policies to match
+ip -4 route replace default dev eth0 table 220
+
+# Same for IPv6 clients
+ip -6 route replace default dev ens3 table 220
@@ -2,27 +2,37 @@ package vpn
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/vailcody/IKEv2TunnelManager/internal/ssh"
 )
 
+// Errors returned by UserManager
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+	ErrInvalidUser  = errors.New("invalid user")
+)
+
 // User represents a VPN user
 type User struct {
-	Username string
-	Password string
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
 }
 
 // UserManager handles VPN user operations
 type UserManager struct {
-	client *ssh.Client
+	client ssh.Executor
 	logger Logger
 }
 
 // NewUserManager creates a new user manager
-func NewUserManager(client *ssh.Client, logger Logger) *UserManager {
+func NewUserManager(client ssh.Executor, logger Logger) *UserManager {
 	return &UserManager{
 		client: client,
 		logger: logger,
@@ -31,46 +41,57 @@ func NewUserManager(client *ssh.Client, logger Logger) *UserManager {
 
 // ListUsers returns list of VPN users
 func (um *UserManager) ListUsers() ([]User, error) {
-	if !um.client.IsConnected() {
-		if err := um.client.Connect(); err != nil {
-			return nil, err
-		}
+	users, err := um.readUsers()
+	if err != nil {
+		return nil, err
 	}
+	for i := range users {
+		users[i].Password = ""
+	}
+	return users, nil
+}
 
-	output, err := um.client.RunSudo("cat /etc/ipsec.secrets")
-	if err != nil {
+// readUsers returns the VPN users with their passwords from the swanctl secrets file
+func (um *UserManager) readUsers() ([]User, error) {
+	if err := ssh.EnsureConnected(um.client); err != nil {
 		return nil, err
 	}
 
-	var users []User
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, ": EAP") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) >= 1 {
-				username := strings.TrimSpace(parts[0])
-				if username != "" && username != "tunnel-user" {
-					users = append(users, User{Username: username})
-				}
-			}
-		}
+	output, err := um.client.RunSudo("cat " + swanctlUsersPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VPN users: %w", err)
 	}
+	return parseSwanctlUsers(output), nil
+}
 
-	return users, nil
+// writeUsers replaces the swanctl secrets file and reloads the credentials
+func (um *UserManager) writeUsers(users []User) error {
+	conf, err := renderSwanctlUsers(users)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(conf))
+	cmd := fmt.Sprintf("echo '%s' | base64 -d | tee %s >/dev/null && chmod 600 %s", encoded, swanctlUsersPath, swanctlUsersPath)
+	if _, err := um.client.RunSudo(cmd); err != nil {
+		return err
+	}
+
+	// Reload secrets
+	if _, err := um.client.RunSudo(reloadCredsCmd); err != nil {
+		um.logger.Errorf("Warning: failed to reload secrets: %v", err)
+	}
+	return nil
 }
 
 // AddUser adds a new VPN user and returns the password (generated if not provided)
 func (um *UserManager) AddUser(username, password string) (string, error) {
-	if !um.client.IsConnected() {
-		if err := um.client.Connect(); err != nil {
-			return "", err
-		}
+	if err := ssh.EnsureConnected(um.client); err != nil {
+		return "", err
 	}
 
 	// Validate username
-	if strings.ContainsAny(username, " :\n'\"") {
-		return "", fmt.Errorf("invalid username: contains forbidden characters")
+	if err := validateUsername(username); err != nil {
+		return "", err
 	}
 
 	// Generate password if not provided
@@ -79,87 +100,110 @@ func (um *UserManager) AddUser(username, password string) (string, error) {
 		rand.Read(bytes)
 		password = hex.EncodeToString(bytes)
 	}
+	if err := validatePassword(password); err != nil {
+		return "", err
+	}
 
 	// Check if user already exists
-	users, err := um.ListUsers()
+	users, err := um.readUsers()
 	if err != nil {
 		return "", err
 	}
 	for _, u := range users {
 		if u.Username == username {
-			return "", fmt.Errorf("user %s already exists", username)
+			return "", fmt.Errorf("%w: %s", ErrUserExists, username)
 		}
 	}
 
-	// Add user to ipsec.secrets
-	secretLine := fmt.Sprintf(`%s : EAP "%s"`, username, password)
-	cmd := fmt.Sprintf(`echo '%s' | tee -a /etc/ipsec.secrets`, secretLine)
-	_, err = um.client.RunSudo(cmd)
-	if err != nil {
+	users = append(users, User{Username: username, Password: password})
+	if err := um.writeUsers(users); err != nil {
 		return "", fmt.Errorf("failed to add user: %w", err)
 	}
 
-	// Reload secrets
-	_, err = um.client.RunSudo("ipsec rereadsecrets")
-	if err != nil {
-		um.logger.Errorf("Warning: failed to reload secrets: %v", err)
-	}
-
 	um.logger.Logf("Added user: %s", username)
 	return password, nil
 }
 
-// GetUserPassword retrieves the password for a user from ipsec.secrets
+// GetUserPassword retrieves the password for a user from the swanctl secrets
 func (um *UserManager) GetUserPassword(username string) (string, error) {
-	if !um.client.IsConnected() {
-		if err := um.client.Connect(); err != nil {
-			return "", err
-		}
-	}
-
-	output, err := um.client.RunSudo("cat /etc/ipsec.secrets")
+	users, err := um.readUsers()
 	if err != nil {
 		return "", err
 	}
 
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, username+" : EAP") {
-			// Format: username : EAP "password"
-			start := strings.Index(line, "\"")
-			end := strings.LastIndex(line, "\"")
-			if start != -1 && end != -1 && end > start {
-				return line[start+1 : end], nil
-			}
+	for _, u := range users {
+		if u.Username == username {
+			return u.Password, nil
 		}
 	}
 
-	return "", fmt.Errorf("password not found for user %s", username)
+	return "", fmt.Errorf("%w: %s", ErrUserNotFound, username)
 }
 
 // RemoveUser removes a VPN user
 func (um *UserManager) RemoveUser(username string) error {
-	if !um.client.IsConnected() {
-		if err := um.client.Connect(); err != nil {
-			return err
-		}
+	if err := validateUsername(username); err != nil {
+		return err
 	}
 
-	// Remove user line from ipsec.secrets
-	cmd := fmt.Sprintf(`sed -i '/^%s : EAP/d' /etc/ipsec.secrets`, username)
-	_, err := um.client.RunSudo(cmd)
+	users, err := um.readUsers()
 	if err != nil {
+		return err
+	}
+	kept := slices.DeleteFunc(users, func(u User) bool { return u.Username == username })
+	if err := um.writeUsers(kept); err != nil {
 		return fmt.Errorf("failed to remove user: %w", err)
 	}
 
-	// Reload secrets
-	_, err = um.client.RunSudo("ipsec rereadsecrets")
+	um.logger.Logf("Removed user: %s", username)
+	return nil
+}
+
+// UpdatePassword replaces the password of an existing user and returns it (generated if not provided)
+func (um *UserManager) UpdatePassword(username, password string) (string, error) {
+	if err := validateUsername(username); err != nil {
+		return "", err
+	}
+	if password == "" {
+		password = GeneratePassword(32)
+	}
+	if err := validatePassword(password); err != nil {
+		return "", err
+	}
+
+	users, err := um.readUsers()
 	if err != nil {
-		um.logger.Errorf("Warning: failed to reload secrets: %v", err)
+		return "", err
+	}
+	i := slices.IndexFunc(users, func(u User) bool { return u.Username == username })
+	if i < 0 {
+		return "", fmt.Errorf("%w: %s", ErrUserNotFound, username)
 	}
 
-	um.logger.Logf("Removed user: %s", username)
+	// Rewrite only this user's secret
+	users[i].Password = password
+	if err := um.writeUsers(users); err != nil {
+		return "", fmt.Errorf("failed to update password: %w", err)
+	}
+
+	um.logger.Logf("Updated password for user: %s", username)
+	return password, nil
+}
+
+func validateUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("%w: empty username", ErrInvalidUser)
+	}
+	if strings.ContainsAny(username, " :\n'\"|/\\") {
+		return fmt.Errorf("%w: username contains forbidden characters", ErrInvalidUser)
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if strings.ContainsAny(password, "\n'\"|\\") {
+		return fmt.Errorf("%w: password must not contain quotes, backslashes, | or newlines", ErrInvalidUser)
+	}
 	return nil
 }
 
@@ -0,0 +1,166 @@
+package vpn
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/vailcody/IKEv2TunnelManager/internal/ssh/sshtest"
+)
+
+const testUsersConf = `# VPN users managed by IKEv2TunnelManager
+eap-1 {
+    id = "alice"
+    secret = "alice-pass"
+}
+eap-2 {
+  id = bob
+  secret = "p@ss word"
+}
+`
+
+func newTestUserManager() (*UserManager, *sshtest.Fake) {
+	f := sshtest.NewFake().On("cat "+swanctlUsersPath, testUsersConf)
+	return NewUserManager(f, &testLogger{}), f
+}
+
+var usersWritePattern = regexp.MustCompile(`^echo '([A-Za-z0-9+/=]*)' \| base64 -d \| tee ` + regexp.QuoteMeta(swanctlUsersPath) + ` `)
+
+// writtenUsers returns the users from the last rewrite of the secrets file
+func writtenUsers(t *testing.T, f *sshtest.Fake) []User {
+	t.Helper()
+	var users []User
+	written := false
+	for _, cmd := range f.Commands() {
+		m := usersWritePattern.FindStringSubmatch(cmd)
+		if m == nil {
+			continue
+		}
+		content, err := base64.StdEncoding.DecodeString(m[1])
+		if err != nil {
+			t.Fatalf("invalid base64 in %q: %v", cmd, err)
+		}
+		users, written = parseSwanctlUsers(string(content)), true
+	}
+	if !written {
+		t.Fatalf("users file not written, commands: %v", f.Commands())
+	}
+	return users
+}
+
+func TestListUsers(t *testing.T) {
+	um, _ := newTestUserManager()
+
+	users, err := um.ListUsers()
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	want := []User{{Username: "alice"}, {Username: "bob"}}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("ListUsers = %+v, want %+v", users, want)
+	}
+}
+
+func TestGetUserPassword(t *testing.T) {
+	um, _ := newTestUserManager()
+
+	for username, want := range map[string]string{"alice": "alice-pass", "bob": "p@ss word"} {
+		got, err := um.GetUserPassword(username)
+		if err != nil {
+			t.Errorf("GetUserPassword(%q): %v", username, err)
+		} else if got != want {
+			t.Errorf("GetUserPassword(%q) = %q, want %q", username, got, want)
+		}
+	}
+
+	if _, err := um.GetUserPassword("carol"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestAddUser(t *testing.T) {
+	um, f := newTestUserManager()
+
+	password, err := um.AddUser("carol", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	if len(password) != 32 {
+		t.Errorf("expected a generated 32 character password, got %q", password)
+	}
+	want := []User{
+		{Username: "alice", Password: "alice-pass"},
+		{Username: "bob", Password: "p@ss word"},
+		{Username: "carol", Password: password},
+	}
+	if got := writtenUsers(t, f); !reflect.DeepEqual(got, want) {
+		t.Errorf("written users = %+v, want %+v", got, want)
+	}
+	if !f.Ran("swanctl --load-creds") {
+		t.Errorf("secrets not reloaded")
+	}
+	for _, c := range f.Calls() {
+		if c.Command != "" && !c.Sudo {
+			t.Errorf("command %q should run with sudo", c.Command)
+		}
+	}
+
+	if _, err := um.AddUser("alice", "x"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("expected ErrUserExists, got %v", err)
+	}
+	if _, err := um.AddUser("bad:name", "x"); !errors.Is(err, ErrInvalidUser) {
+		t.Errorf("expected ErrInvalidUser for username, got %v", err)
+	}
+	if _, err := um.AddUser("dave", `it's`); !errors.Is(err, ErrInvalidUser) {
+		t.Errorf("expected ErrInvalidUser for password, got %v", err)
+	}
+}
+
+func TestRemoveUser(t *testing.T) {
+	um, f := newTestUserManager()
+
+	if err := um.RemoveUser("alice"); err != nil {
+		t.Fatalf("RemoveUser: %v", err)
+	}
+	want := []User{{Username: "bob", Password: "p@ss word"}}
+	if got := writtenUsers(t, f); !reflect.DeepEqual(got, want) {
+		t.Errorf("written users = %+v, want %+v", got, want)
+	}
+}
+
+func TestUpdatePassword(t *testing.T) {
+	um, f := newTestUserManager()
+
+	if _, err := um.UpdatePassword("alice", "new&pass"); err != nil {
+		t.Fatalf("UpdatePassword: %v", err)
+	}
+	want := []User{
+		{Username: "alice", Password: "new&pass"},
+		{Username: "bob", Password: "p@ss word"},
+	}
+	if got := writtenUsers(t, f); !reflect.DeepEqual(got, want) {
+		t.Errorf("written users = %+v, want %+v", got, want)
+	}
+
+	if _, err := um.UpdatePassword("carol", "x"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestParseLegacySecrets(t *testing.T) {
+	secrets := `# ipsec.secrets - strongSwan IPsec secrets file
+: RSA server-key.pem
+alice : EAP "alice-pass"
+  bob : EAP "p@ss word"
+tunnel-user : EAP "internal"
+`
+	want := []User{
+		{Username: "alice", Password: "alice-pass"},
+		{Username: "bob", Password: "p@ss word"},
+	}
+	if got := parseLegacySecrets(secrets); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLegacySecrets = %+v, want %+v", got, want)
+	}
+}